@@ -0,0 +1,141 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// abandonedPrefix is the prefix of the keys SweepAbandoned looks at, where
+// certmagic stores certificates, their private keys and metadata
+const abandonedPrefix = "certificates"
+
+// SweepAbandoned finds the values under certificates/ last modified more than
+// AbandonedAfter ago. Certmagic renews the certificates it manages well before
+// they expire, rewriting them, so those belong to domains no longer served.
+// They are only logged, unless DeleteAbandoned is set, in which case each is
+// deleted while holding its lock, and skipped when the lock is held elsewhere.
+// It returns the keys found, whether or not they were deleted, and nothing when
+// AbandonedAfter isn't set.
+func (rd RedisStorage) SweepAbandoned(ctx context.Context) ([]string, error) {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	keys, err := rd.sweepAbandoned(opCtx)
+	return keys, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd RedisStorage) sweepAbandoned(ctx context.Context) ([]string, error) {
+	if rd.AbandonedAfter <= 0 {
+		return nil, nil
+	}
+
+	now, err := rd.now(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get time: %v", err)
+	}
+	cutoff := now.Add(-time.Duration(rd.AbandonedAfter))
+
+	keys, err := rd.scanKeys(ctx, rd.keyPrefix(), abandonedPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var abandoned []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, lockKeySuffix) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return abandoned, err
+		}
+
+		info, err := rd.stat(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted since the scan
+			continue
+		}
+		if err != nil {
+			return abandoned, fmt.Errorf("unable to stat %s: %v", key, err)
+		}
+		if !info.Modified.Before(cutoff) {
+			continue
+		}
+		abandoned = append(abandoned, key)
+
+		if !rd.DeleteAbandoned {
+			rd.Logger.Infof("[INFO] Would delete abandoned certificate data, not modified since %v (key: %s)", info.Modified, key)
+			continue
+		}
+		deleted, err := rd.deleteAbandoned(ctx, key, cutoff)
+		if err != nil {
+			return abandoned, err
+		}
+		if deleted {
+			rd.Logger.Infof("[INFO] Deleted abandoned certificate data, not modified since %v (key: %s)", info.Modified, key)
+		}
+	}
+	return abandoned, nil
+}
+
+// deleteAbandoned deletes key, unless it is locked, or was modified after cutoff
+// since it was found, and returns whether it did
+func (rd *RedisStorage) deleteAbandoned(ctx context.Context, key string, cutoff time.Time) (bool, error) {
+	locked, err := rd.tryLock(ctx, key)
+	if err != nil {
+		return false, fmt.Errorf("unable to lock abandoned %s: %v", key, err)
+	}
+	if !locked {
+		rd.Logger.Infof("[INFO] Skipping abandoned certificate data, locked (key: %s)", key)
+		return false, nil
+	}
+	defer func() {
+		if err := rd.unlock(ctx, key); err != nil {
+			rd.Logger.Warnf("[WARNING] Unable to unlock abandoned certificate data: %v (key: %s)", err, key)
+		}
+	}()
+
+	info, err := rd.stat(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("unable to stat %s: %v", key, err)
+	}
+	if !info.Modified.Before(cutoff) {
+		return false, nil
+	}
+	if err := rd.delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, fmt.Errorf("unable to delete abandoned %s: %v", key, err)
+	}
+	rd.trackDeleted(key)
+	return true, nil
+}
+
+// sweepAbandonedPeriodically runs SweepAbandoned every AbandonedSweepInterval until ctx is done
+func (rd *RedisStorage) sweepAbandonedPeriodically(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, stackTraceBufferSize)
+			buf = buf[:runtime.Stack(buf, false)]
+			rd.Logger.Errorf("panic: sweeping abandoned certificates: %v\n%s", err, buf)
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(rd.AbandonedSweepInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := rd.SweepAbandoned(ctx); err != nil {
+				rd.Logger.Errorf("[ERROR] Sweeping abandoned certificates: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// storeModified stores value at key as if it was stored at modified
+func storeModified(t *testing.T, rd *RedisStorage, key string, value []byte, modified time.Time) {
+	encrypted, err := rd.encryptStorageData(key, &StorageData{Value: value, Modified: modified})
+	assert.NoError(t, err)
+	assert.NoError(t, rd.Client.Set(context.TODO(), rd.prefixKey(key), encrypted, 0).Err())
+}
+
+func TestRedisStorage_SweepAbandonedDryRun(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	rd := new(RedisStorage)
+	rd.Logger = zap.New(core).Sugar()
+	rd.AbandonedAfter = Duration(90 * 24 * time.Hour)
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+	abandoned := path.Join("certificates", "acme", "gone.example.com", "gone.example.com.crt")
+	served := path.Join("certificates", "acme", "example.com", "example.com.crt")
+	account := path.Join("acme", "acme", "users", "me", "me.key")
+	storeModified(t, rd, abandoned, []byte("crt data"), time.Now().Add(-100*24*time.Hour))
+	storeModified(t, rd, served, []byte("crt data"), time.Now().Add(-30*24*time.Hour))
+	storeModified(t, rd, account, []byte("key data"), time.Now().Add(-365*24*time.Hour))
+
+	keys, err := rd.SweepAbandoned(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{abandoned}, keys)
+	assert.Equal(t, 1, logs.FilterMessageSnippet("Would delete").FilterMessageSnippet(abandoned).Len())
+
+	for _, key := range []string{abandoned, served, account} {
+		assert.True(t, rd.Exists(context.TODO(), key), key)
+	}
+}
+
+func TestRedisStorage_SweepAbandonedDelete(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.AbandonedAfter = Duration(90 * 24 * time.Hour)
+	rd.DeleteAbandoned = true
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+	abandoned := path.Join("certificates", "acme", "gone.example.com", "gone.example.com.crt")
+	served := path.Join("certificates", "acme", "example.com", "example.com.crt")
+	storeModified(t, rd, abandoned, []byte("crt data"), time.Now().Add(-100*24*time.Hour))
+	assert.NoError(t, rd.Store(context.TODO(), served, []byte("crt data")))
+
+	keys, err := rd.SweepAbandoned(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{abandoned}, keys)
+	assert.False(t, rd.Exists(context.TODO(), abandoned))
+	assert.True(t, rd.Exists(context.TODO(), served))
+}
+
+func TestRedisStorage_SweepAbandonedPeriodically(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.AbandonedAfter = Duration(time.Hour)
+	rd.AbandonedSweepInterval = Duration(10 * time.Millisecond)
+	rd.DeleteAbandoned = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	abandoned := path.Join("certificates", "acme", "gone.example.com", "gone.example.com.crt")
+	storeModified(t, rd, abandoned, []byte("crt data"), time.Now().Add(-2*time.Hour))
+
+	mr.Select(9)
+	assert.Eventually(t, func() bool {
+		return !mr.Exists(rd.prefixKey(abandoned))
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisStorage_SweepAbandonedLocked(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.AbandonedAfter = Duration(90 * 24 * time.Hour)
+	rd.DeleteAbandoned = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	other := setupRedisEnvWithServer(t, mr)
+
+	locked := path.Join("certificates", "acme", "renewing.example.com", "renewing.example.com.crt")
+	abandoned := path.Join("certificates", "acme", "gone.example.com", "gone.example.com.crt")
+	storeModified(t, rd, locked, []byte("crt data"), time.Now().Add(-100*24*time.Hour))
+	storeModified(t, rd, abandoned, []byte("crt data"), time.Now().Add(-100*24*time.Hour))
+	assert.NoError(t, other.Lock(context.TODO(), locked))
+
+	keys, err := rd.SweepAbandoned(context.TODO())
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{locked, abandoned}, keys)
+	assert.True(t, rd.Exists(context.TODO(), locked), "a locked key survives the sweep")
+	assert.False(t, rd.Exists(context.TODO(), abandoned))
+
+	// the lock of the deleted key was released
+	obtained, err := other.TryLock(context.TODO(), abandoned)
+	assert.NoError(t, err)
+	assert.True(t, obtained)
+	assert.NoError(t, other.Unlock(context.TODO(), abandoned))
+	assert.NoError(t, other.Unlock(context.TODO(), locked))
+
+	_, err = rd.SweepAbandoned(context.TODO())
+	assert.NoError(t, err)
+	assert.False(t, rd.Exists(context.TODO(), locked))
+}
@@ -0,0 +1,30 @@
+package storageredis
+
+import (
+	"strings"
+)
+
+// isAccountKey reports whether key holds ACME account material, which certmagic
+// stores under acme/<issuer>/users/<email>/
+func isAccountKey(key string) bool {
+	segments := strings.Split(key, "/")
+	return len(segments) > 3 && segments[0] == "acme" && segments[2] == "users"
+}
+
+// storesAccount reports whether key is an account key routed to AccountStorageAddress
+func (rd *RedisStorage) storesAccount(key string) bool {
+	return rd.AccountStorageAddress != "" && isAccountKey(key)
+}
+
+// isAccountRedisKey reports whether redisKey, under KeyPrefix or one of the
+// ReadPrefixes, belongs to an account key routed to AccountStorageAddress
+func (rd *RedisStorage) isAccountRedisKey(redisKey string) bool {
+	redisKey = rd.trimHashTag(trimKeySuffixes(redisKey))
+	for _, keyPrefix := range append([]string{rd.keyPrefix()}, rd.ReadPrefixes...) {
+		if key, ok := trimListPrefix(redisKey, keyPrefix, "/"); ok {
+			key, err := rd.unescapeKey(key)
+			return err == nil && rd.storesAccount(key)
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_AccountStorage(t *testing.T) {
+	main, accounts := miniredis.RunT(t), miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.AccountStorageAddress = accounts.Addr()
+	rd.TTLPatterns = []TTLPattern{{Pattern: "acme/*/users/*/*", TTL: Duration(time.Hour)}}
+	rd = setupRedisEnvWithStorage(t, main, rd)
+	t.Cleanup(func() { rd.accounts.client.Close() })
+	main.Select(9)
+	accounts.Select(9)
+
+	account := path.Join("acme", "acme-v02.api.letsencrypt.org-directory", "users", "admin@example.com", "admin.key")
+	cert := path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), account, []byte("account key")))
+	assert.NoError(t, rd.Store(context.TODO(), cert, []byte("crt data")))
+
+	// account keys only go to the account storage, and never expire
+	assert.True(t, accounts.Exists(rd.prefixKey(account)))
+	assert.False(t, main.Exists(rd.prefixKey(account)))
+	assert.Equal(t, time.Duration(0), accounts.TTL(rd.prefixKey(account)))
+	assert.True(t, main.Exists(rd.prefixKey(cert)))
+	assert.False(t, accounts.Exists(rd.prefixKey(cert)))
+
+	content, err := rd.Load(context.TODO(), account)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("account key"), content)
+
+	// so are their locks
+	assert.NoError(t, rd.Lock(context.TODO(), account))
+	assert.True(t, accounts.Exists(rd.prefixKey(account)+lockKeySuffix))
+	assert.NoError(t, rd.Unlock(context.TODO(), account))
+
+	keys, err := rd.ListLeaves(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{account, cert}, keys)
+
+	assert.NoError(t, rd.Delete(context.TODO(), account))
+	assert.False(t, accounts.Exists(rd.prefixKey(account)))
+}
+
+func TestRedisStorage_AccountStorageEncryptKeys(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.Address = miniredis.RunT(t).Addr()
+	rd.AccountStorageAddress = miniredis.RunT(t).Addr()
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+	rd.EncryptKeys = true
+	rd.GetConfigValue()
+
+	assert.Error(t, rd.BuildRedisClient())
+}
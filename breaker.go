@@ -0,0 +1,159 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrCircuitOpen is returned for Redis commands while the circuit breaker is open
+var ErrCircuitOpen = errors.New("redis circuit breaker is open")
+
+const (
+	circuitClosed = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// circuitBreaker fast-fails Redis commands after too many consecutive failures.
+// After the cooldown it lets a single probe through, closing again if it succeeds.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu           sync.Mutex
+	state        int
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+	}
+}
+
+// allow reports whether a command may be sent to Redis
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case circuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		// let a single probe through
+		cb.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// a probe is already in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a command
+func (cb *circuitBreaker) record(failed bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if !failed {
+		cb.state = circuitClosed
+		cb.failures = 0
+		return
+	}
+
+	now := time.Now()
+	if cb.state == circuitHalfOpen {
+		cb.state = circuitOpen
+		cb.openedAt = now
+		return
+	}
+
+	if cb.failures == 0 || (cb.window > 0 && now.Sub(cb.firstFailure) > cb.window) {
+		cb.failures = 0
+		cb.firstFailure = now
+	}
+	cb.failures++
+	if cb.failures >= cb.threshold {
+		cb.state = circuitOpen
+		cb.openedAt = now
+		cb.failures = 0
+	}
+}
+
+// isConnectionFailure reports whether err means Redis is unavailable, as opposed
+// to a missing key or an error reply from a healthy server
+func isConnectionFailure(err error) bool {
+	if err == nil || err == redis.Nil || err == ErrCircuitOpen || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var redisErr redis.Error
+	return !errors.As(err, &redisErr)
+}
+
+// circuitBreakerHook wires a circuitBreaker into the go-redis client
+type circuitBreakerHook struct {
+	breaker *circuitBreaker
+}
+
+// expiredBeforeSendKey marks the context of commands whose context was already
+// done before they were sent. They fail without reaching Redis, so they say
+// nothing about its health and are left out of the breaker.
+type expiredBeforeSendKey struct{}
+
+func expiredBeforeSend(ctx context.Context) bool {
+	expired, _ := ctx.Value(expiredBeforeSendKey{}).(bool)
+	return expired
+}
+
+func (h circuitBreakerHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if ctx.Err() != nil {
+		return context.WithValue(ctx, expiredBeforeSendKey{}, true), nil
+	}
+	if !h.breaker.allow() {
+		return ctx, ErrCircuitOpen
+	}
+	return ctx, nil
+}
+
+func (h circuitBreakerHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if cmd.Err() != ErrCircuitOpen && !expiredBeforeSend(ctx) {
+		h.breaker.record(isConnectionFailure(cmd.Err()))
+	}
+	return nil
+}
+
+func (h circuitBreakerHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	if ctx.Err() != nil {
+		return context.WithValue(ctx, expiredBeforeSendKey{}, true), nil
+	}
+	if !h.breaker.allow() {
+		return ctx, ErrCircuitOpen
+	}
+	return ctx, nil
+}
+
+func (h circuitBreakerHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if expiredBeforeSend(ctx) {
+		return nil
+	}
+	failed := false
+	for _, cmd := range cmds {
+		if cmd.Err() == ErrCircuitOpen {
+			return nil
+		}
+		failed = failed || isConnectionFailure(cmd.Err())
+	}
+	h.breaker.record(failed)
+	return nil
+}
@@ -0,0 +1,63 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_CircuitBreaker(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.CircuitBreakerThreshold = 2
+	rd.CircuitBreakerCooldown = Duration(100 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	// take redis away until the breaker opens
+	addr := mr.Addr()
+	mr.Close()
+	for i := 0; i < rd.CircuitBreakerThreshold; i++ {
+		_, err := rd.Load(context.TODO(), key)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	_, err := rd.Load(context.TODO(), key)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	// once redis is back, the probe after the cooldown closes the breaker
+	assert.NoError(t, mr.StartAddr(addr))
+	_, err = rd.Load(context.TODO(), key)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	time.Sleep(time.Duration(rd.CircuitBreakerCooldown))
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	_, err = rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+}
+
+func TestRedisStorage_CircuitBreakerExpiredContext(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.CircuitBreakerThreshold = 2
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	// callers giving up before a command is sent say nothing about Redis
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	for i := 0; i < rd.CircuitBreakerThreshold*2; i++ {
+		_, err := rd.Load(ctx, key)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	}
+
+	_, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,230 @@
+package storageredis
+
+import (
+	"container/list"
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// invalidationChannel is where Redis publishes the keys to invalidate to the
+// connection tracking keys are redirected to
+const invalidationChannel = "__redis__:invalidate"
+
+// clientCache holds the values read from Redis with CLIENT TRACKING enabled, so
+// they can be served locally until Redis reports they changed. Without RESP3,
+// the invalidations are redirected to a connection subscribed to
+// invalidationChannel, one per Redis node. It holds at most size values, the
+// least recently used being evicted first.
+type clientCache struct {
+	mu sync.Mutex
+	// values are the elements of order, by Redis key
+	values map[string]*list.Element
+	// order holds the cachedValues from the most to the least recently used
+	order *list.List
+	size  int
+	// generation changes on every invalidation, so a value read before an
+	// invalidation is never cached after it
+	generation uint64
+
+	// redirects are the IDs of the connections receiving the invalidations of
+	// each client, 0 while they aren't subscribed. Set once by BuildRedisClient.
+	redirects map[redis.UniversalClient]*int64
+}
+
+// cachedValue is a value of the client-side cache
+type cachedValue struct {
+	redisKey string
+	value    []byte
+}
+
+// newClientCache returns an empty cache of at most size values read through clients
+func newClientCache(clients []redis.UniversalClient, size int) *clientCache {
+	c := &clientCache{
+		values:    make(map[string]*list.Element),
+		order:     list.New(),
+		size:      size,
+		redirects: make(map[redis.UniversalClient]*int64, len(clients)),
+	}
+	for _, client := range clients {
+		c.redirects[client] = new(int64)
+	}
+	return c
+}
+
+// get returns the value of redisKey from the cache, or else reads it with client
+// and caches it, if its invalidations can be received
+func (c *clientCache) get(ctx context.Context, client redis.UniversalClient, redisKey string) ([]byte, error) {
+	c.mu.Lock()
+	if element, ok := c.values[redisKey]; ok {
+		c.order.MoveToFront(element)
+		c.mu.Unlock()
+		return element.Value.(*cachedValue).value, nil
+	}
+	generation := c.generation
+	c.mu.Unlock()
+
+	redirect := int64(0)
+	if id, ok := c.redirects[client]; ok {
+		redirect = atomic.LoadInt64(id)
+	}
+	if redirect == 0 {
+		// invalidations would be lost
+		return client.Get(ctx, redisKey).Bytes()
+	}
+
+	// tracking is enabled on whichever connection of the pool the GET is sent
+	// on, and only for the keys read right after CLIENT CACHING
+	pipe := client.Pipeline()
+	tracking := pipe.Do(ctx, "client", "tracking", "on", "redirect", redirect, "optin")
+	pipe.Do(ctx, "client", "caching", "yes")
+	get := pipe.Get(ctx, redisKey)
+	_, _ = pipe.Exec(ctx)
+	if err := tracking.Err(); err != nil {
+		return client.Get(ctx, redisKey).Bytes()
+	}
+	value, err := get.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.generation == generation {
+		c.add(redisKey, value)
+	}
+	c.mu.Unlock()
+	return value, nil
+}
+
+// add caches value as the one of redisKey, evicting the least recently used
+// value when full. c.mu must be held.
+func (c *clientCache) add(redisKey string, value []byte) {
+	if element, ok := c.values[redisKey]; ok {
+		element.Value.(*cachedValue).value = value
+		c.order.MoveToFront(element)
+		return
+	}
+	c.values[redisKey] = c.order.PushFront(&cachedValue{redisKey: redisKey, value: value})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.values, oldest.Value.(*cachedValue).redisKey)
+	}
+}
+
+// invalidate removes redisKeys from the cache
+func (c *clientCache) invalidate(redisKeys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	for _, redisKey := range redisKeys {
+		if element, ok := c.values[redisKey]; ok {
+			c.order.Remove(element)
+			delete(c.values, redisKey)
+		}
+	}
+}
+
+// flush removes every value from the cache
+func (c *clientCache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.values = make(map[string]*list.Element)
+	c.order.Init()
+}
+
+// invalidateCached removes redisKeys from the client-side cache, if enabled,
+// so this instance reads its own writes without waiting for Redis to report them
+func (rd RedisStorage) invalidateCached(redisKeys ...string) {
+	if rd.cache != nil {
+		rd.cache.invalidate(redisKeys...)
+	}
+}
+
+// trackInvalidations subscribes a connection of its own to the invalidations of
+// the keys read through client, and removes them from the cache until ctx is done.
+// The cache isn't used for client while the connection is down, as the
+// invalidations sent meanwhile are lost.
+func (rd *RedisStorage) trackInvalidations(ctx context.Context, client *redis.Client) {
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, stackTraceBufferSize)
+			buf = buf[:runtime.Stack(buf, false)]
+			rd.Logger.Errorf("panic: tracking invalidations: %v\n%s", err, buf)
+		}
+	}()
+
+	redirect := rd.cache.redirects[client]
+	var connectionID int64
+	subscriber := rd.newClient(client.Options().Addr)
+	defer subscriber.Close()
+	subscriber.Options().OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		if err := rd.onConnect(ctx, cn); err != nil {
+			return err
+		}
+		id, err := cn.ClientID(ctx).Result()
+		atomic.StoreInt64(&connectionID, id)
+		return err
+	}
+
+	for {
+		err := rd.receiveInvalidations(ctx, subscriber, redirect, &connectionID)
+		if ctx.Err() != nil {
+			return
+		}
+		// Redis also sends an invalidation without keys when the database is
+		// flushed, which go-redis fails to parse, so whatever the failure the
+		// cache is emptied, and not used until subscribed again
+		if atomic.SwapInt64(redirect, 0) != 0 {
+			rd.Logger.Warnf("[WARNING] Client-side cache emptied, invalidations from %s interrupted: %v", client.Options().Addr, err)
+		}
+		rd.cache.flush()
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// receiveInvalidations subscribes subscriber to invalidationChannel, and removes
+// the keys it receives from the cache, until receiving fails or ctx is done
+func (rd *RedisStorage) receiveInvalidations(ctx context.Context, subscriber *redis.Client, redirect, connectionID *int64) error {
+	pubsub := subscriber.Subscribe(ctx, invalidationChannel)
+	defer pubsub.Close()
+	// Receive only returns once ctx is done if the connection is closed
+	received := make(chan struct{})
+	defer close(received)
+	go func() {
+		select {
+		case <-ctx.Done():
+			pubsub.Close()
+		case <-received:
+		}
+	}()
+
+	for {
+		msg, err := pubsub.Receive(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			// values cached from now on are invalidated through this connection
+			rd.cache.flush()
+			atomic.StoreInt64(redirect, atomic.LoadInt64(connectionID))
+		case *redis.Message:
+			if len(msg.PayloadSlice) > 0 {
+				rd.cache.invalidate(msg.PayloadSlice...)
+			} else {
+				rd.cache.invalidate(msg.Payload)
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeTracking records the connections subscribed to the invalidations, and
+// the names connections were given
+type fakeTracking struct {
+	mu          sync.Mutex
+	subscribers []*server.Peer
+	names       map[*server.Peer]string
+}
+
+// subscriber returns the last connection subscribed to the invalidations, and its name
+func (f *fakeTracking) subscriber() (*server.Peer, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subscribers) == 0 {
+		return nil, ""
+	}
+	peer := f.subscribers[len(f.subscribers)-1]
+	return peer, f.names[peer]
+}
+
+// fakeClientTracking makes mr accept the CLIENT commands of client-side caching,
+// which it doesn't implement. Invalidations have to be published by the test.
+func fakeClientTracking(mr *miniredis.Miniredis) *fakeTracking {
+	tracking := &fakeTracking{names: make(map[*server.Peer]string)}
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "SUBSCRIBE" && len(args) == 1 && args[0] == invalidationChannel {
+			tracking.mu.Lock()
+			tracking.subscribers = append(tracking.subscribers, c)
+			tracking.mu.Unlock()
+		}
+		if cmd != "CLIENT" || len(args) == 0 {
+			return false
+		}
+		switch strings.ToUpper(args[0]) {
+		case "ID":
+			c.WriteInt(42)
+			return true
+		case "TRACKING", "CACHING":
+			c.WriteOK()
+			return true
+		case "SETNAME":
+			if len(args) == 2 {
+				tracking.mu.Lock()
+				tracking.names[c] = args[1]
+				tracking.mu.Unlock()
+			}
+		}
+		return false
+	})
+	return tracking
+}
+
+func TestRedisStorage_ClientSideCache(t *testing.T) {
+	mr := miniredis.RunT(t)
+	fakeClientTracking(mr)
+	rd := new(RedisStorage)
+	rd.ClientSideCache = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	other := setupRedisEnvWithServer(t, mr)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(rd.cache.redirects[rd.Client]) == 42
+	}, time.Second, 10*time.Millisecond)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+	for i := 0; i < 3; i++ {
+		content, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("crt data"), content)
+	}
+	assert.Equal(t, 1, counter.count("get"))
+	// CLIENT TRACKING and CLIENT CACHING before the GET
+	assert.Equal(t, 2, counter.count("client"))
+
+	// served from the cache until redis reports the change
+	assert.NoError(t, other.Store(context.TODO(), key, []byte("new crt data")))
+	content, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), content)
+
+	mr.Publish(invalidationChannel, rd.prefixKey(key))
+	assert.Eventually(t, func() bool {
+		content, err := rd.Load(context.TODO(), key)
+		return err == nil && string(content) == "new crt data"
+	}, time.Second, 10*time.Millisecond)
+
+	// its own writes are read back at once
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("newer crt data")))
+	content, err = rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("newer crt data"), content)
+
+	assert.NoError(t, rd.Delete(context.TODO(), key))
+	assert.False(t, rd.Exists(context.TODO(), key))
+}
+
+func TestRedisStorage_ClientSideCacheDisconnected(t *testing.T) {
+	mr := miniredis.RunT(t)
+	fakeClientTracking(mr)
+	rd := new(RedisStorage)
+	rd.ClientSideCache = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(rd.cache.redirects[rd.Client]) == 42
+	}, time.Second, 10*time.Millisecond)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	_, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+
+	// invalidations sent while the subscriber is down are lost, so the cache is
+	// emptied and not used until it subscribed again
+	atomic.StoreInt64(rd.cache.redirects[rd.Client], 0)
+	rd.cache.flush()
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+	for i := 0; i < 2; i++ {
+		_, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, counter.count("get"))
+	assert.Equal(t, 0, counter.count("client"))
+}
+
+func TestRedisStorage_ClientSideCacheFlushed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	tracking := fakeClientTracking(mr)
+	rd := new(RedisStorage)
+	rd.ClientSideCache = true
+	rd.ConnectionName = "caddy-a"
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(rd.cache.redirects[rd.Client]) == 42
+	}, time.Second, 10*time.Millisecond)
+	subscriber, name := tracking.subscriber()
+	assert.Equal(t, "caddy-a", name, "the subscriber is named like the other connections")
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	_, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+	_, err = rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, counter.count("get"))
+
+	// Redis sends an invalidation without keys when the database is flushed
+	subscriber.Block(func(w *server.Writer) {
+		w.WriteLen(3)
+		w.WriteBulk("message")
+		w.WriteBulk(invalidationChannel)
+		w.WriteNull()
+		w.Flush()
+	})
+	assert.Eventually(t, func() bool {
+		_, err := rd.Load(context.TODO(), key)
+		return err == nil && counter.count("get") > 0
+	}, time.Second, 10*time.Millisecond)
+
+	// the cache is used again once subscribed again
+	assert.Eventually(t, func() bool {
+		resubscribed, _ := tracking.subscriber()
+		return resubscribed != subscriber && atomic.LoadInt64(rd.cache.redirects[rd.Client]) == 42
+	}, 3*time.Second, 10*time.Millisecond)
+	_, name = tracking.subscriber()
+	assert.Equal(t, "caddy-a", name)
+}
+
+func TestRedisStorage_ClientSideCacheSize(t *testing.T) {
+	mr := miniredis.RunT(t)
+	fakeClientTracking(mr)
+	rd := new(RedisStorage)
+	rd.ClientSideCache = true
+	rd.ClientSideCacheSize = 2
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(rd.cache.redirects[rd.Client]) == 42
+	}, time.Second, 10*time.Millisecond)
+
+	keys := []string{"ocsp/a", "ocsp/b", "ocsp/c"}
+	for _, key := range keys {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte(key)))
+	}
+	loads := func(keys ...string) int {
+		counter := &commandCounter{}
+		rd.Client.AddHook(counter)
+		for _, key := range keys {
+			content, err := rd.Load(context.TODO(), key)
+			assert.NoError(t, err)
+			assert.Equal(t, []byte(key), content)
+		}
+		return counter.count("get")
+	}
+
+	assert.Equal(t, 2, loads("ocsp/a", "ocsp/b"))
+	assert.Equal(t, 0, loads("ocsp/a"))
+	// ocsp/b, the least recently used, is evicted
+	assert.Equal(t, 1, loads("ocsp/c"))
+	assert.Equal(t, 0, loads("ocsp/a", "ocsp/c"))
+	assert.Equal(t, 1, loads("ocsp/b"))
+}
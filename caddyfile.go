@@ -0,0 +1,206 @@
+package storageredis
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// Interface guard
+var _ caddyfile.Unmarshaler = (*RedisStorage)(nil)
+
+// UnmarshalCaddyfile sets up the storage from Caddyfile tokens, the directives
+// being the JSON names of the options:
+//
+//	storage redis {
+//	    host          "127.0.0.1"
+//	    port          6379
+//	    tls_enabled
+//	    lock_timeout  "10s"
+//	    ttl_patterns  "ocsp/*" "72h" sliding
+//	}
+//
+// A bool directive without argument enables the option. Directives taking a list,
+// shard_addresses, addresses, sentinel_addresses, ready_keys, read_prefixes and
+// ttl_patterns, append to it when repeated; ttl_patterns takes a pattern, a TTL
+// and optionally "sliding".
+func (rd *RedisStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		options := rd.caddyfileOptions()
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			option, ok := options[d.Val()]
+			if !ok {
+				return d.Errf("unrecognized redis storage option '%s'", d.Val())
+			}
+			if err := unmarshalCaddyfileOption(d, option); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// caddyfileOptions returns the fields of rd set by every Caddyfile directive
+func (rd *RedisStorage) caddyfileOptions() map[string]interface{} {
+	return map[string]interface{}{
+		"address":                   &rd.Address,
+		"host":                      &rd.Host,
+		"port":                      &rd.Port,
+		"db":                        &rd.DB,
+		"username":                  &rd.Username,
+		"password":                  &rd.Password,
+		"timeout":                   &rd.Timeout,
+		"key_prefix":                &rd.KeyPrefix,
+		"value_prefix":              &rd.ValuePrefix,
+		"aes_key":                   &rd.AesKey,
+		"tls_enabled":               &rd.TlsEnabled,
+		"tls_insecure":              &rd.TlsInsecure,
+		"network":                   &rd.Network,
+		"password_file":             &rd.PasswordFile,
+		"aes_key_file":              &rd.AesKeyFile,
+		"tls_session_cache_size":    &rd.TlsSessionCacheSize,
+		"tls_ca_cert_file":          &rd.TlsCaCertFile,
+		"tls_client_cert_file":      &rd.TlsClientCertFile,
+		"tls_client_key_file":       &rd.TlsClientKeyFile,
+		"tls_server_name":           &rd.TlsServerName,
+		"tls_min_version":           &rd.TlsMinVersion,
+		"tls_renegotiation":         &rd.TlsRenegotiation,
+		"key_derivation":            &rd.KeyDerivation,
+		"key_derivation_salt":       &rd.KeyDerivationSalt,
+		"encryption_algorithm":      &rd.EncryptionAlgorithm,
+		"previous_aes_key":          &rd.PreviousAesKey,
+		"reencrypt_interval":        &rd.ReencryptInterval,
+		"reencrypt_concurrency":     &rd.ReencryptConcurrency,
+		"value_format":              &rd.ValueFormat,
+		"compression":               &rd.Compression,
+		"metrics_enabled":           &rd.MetricsEnabled,
+		"encrypt_keys":              &rd.EncryptKeys,
+		"shard_addresses":           &rd.ShardAddresses,
+		"cluster_enabled":           &rd.ClusterEnabled,
+		"addresses":                 &rd.Addresses,
+		"sentinel_enabled":          &rd.SentinelEnabled,
+		"master_name":               &rd.MasterName,
+		"sentinel_addresses":        &rd.SentinelAddresses,
+		"sentinel_password":         &rd.SentinelPassword,
+		"prefer_replica_reads":      &rd.PreferReplicaReads,
+		"account_storage_address":   &rd.AccountStorageAddress,
+		"escape_key_segments":       &rd.EscapeKeySegments,
+		"hash_tag_keys":             &rd.HashTagKeys,
+		"deterministic_encryption":  &rd.DeterministicEncryption,
+		"circuit_breaker_threshold": &rd.CircuitBreakerThreshold,
+		"circuit_breaker_window":    &rd.CircuitBreakerWindow,
+		"circuit_breaker_cooldown":  &rd.CircuitBreakerCooldown,
+		"rate_limit":                &rd.RateLimit,
+		"read_prefixes":             &rd.ReadPrefixes,
+		"list_order":                &rd.ListOrder,
+		"list_consistency":          &rd.ListConsistency,
+		"list_read_prefixes":        &rd.ListReadPrefixes,
+		"max_scan_iterations":       &rd.MaxScanIterations,
+		"scan_count":                &rd.ScanCount,
+		"delete_batch_size":         &rd.DeleteBatchSize,
+		"ttl_patterns":              &rd.TTLPatterns,
+		"namespace":                 &rd.Namespace,
+		"cluster_id":                &rd.ClusterID,
+		"lock_owner":                &rd.LockOwner,
+		"connection_name":           &rd.ConnectionName,
+		"lock_record_acquired":      &rd.LockRecordAcquired,
+		"lock_notifications":        &rd.LockNotifications,
+		"lock_fencing":              &rd.LockFencing,
+		"delete_locks":              &rd.DeleteLocks,
+		"lock_timeout":              &rd.LockTimeout,
+		"lock_refresh_interval":     &rd.LockRefreshInterval,
+		"lock_poll_interval":        &rd.LockPollInterval,
+		"lock_sweep_interval":       &rd.LockSweepInterval,
+		"abandoned_after":           &rd.AbandonedAfter,
+		"abandoned_sweep_interval":  &rd.AbandonedSweepInterval,
+		"delete_abandoned":          &rd.DeleteAbandoned,
+		"lock_held_warn_refreshes":  &rd.LockHeldWarnRefreshes,
+		"connect_retries":           &rd.ConnectRetries,
+		"connect_backoff":           &rd.ConnectBackoff,
+		"max_retries":               &rd.MaxRetries,
+		"min_retry_backoff":         &rd.MinRetryBackoff,
+		"max_retry_backoff":         &rd.MaxRetryBackoff,
+		"pool_size":                 &rd.PoolSize,
+		"min_idle_conns":            &rd.MinIdleConns,
+		"pool_timeout":              &rd.PoolTimeout,
+		"conn_max_idle_time":        &rd.ConnMaxIdleTime,
+		"warmup_connections":        &rd.WarmupConnections,
+		"ready_timeout":             &rd.ReadyTimeout,
+		"ready_keys":                &rd.ReadyKeys,
+		"slow_op_threshold":         &rd.SlowOpThreshold,
+		"deadline_margin":           &rd.DeadlineMargin,
+		"clock_skew_warn_threshold": &rd.ClockSkewWarnThreshold,
+		"health_check_interval":     &rd.HealthCheckInterval,
+		"use_server_time":           &rd.UseServerTime,
+		"light_stat":                &rd.LightStat,
+		"verify_writes":             &rd.VerifyWrites,
+		"store_if_newer":            &rd.StoreIfNewer,
+		"validate_cert_data":        &rd.ValidateCertData,
+		"client_side_cache":         &rd.ClientSideCache,
+		"client_side_cache_size":    &rd.ClientSideCacheSize,
+		"track_served_keys":         &rd.TrackServedKeys,
+	}
+}
+
+// unmarshalCaddyfileOption parses the arguments of the directive d is at into
+// option, one of the fields returned by caddyfileOptions
+func unmarshalCaddyfileOption(d *caddyfile.Dispenser, option interface{}) error {
+	name := d.Val()
+	args := d.RemainingArgs()
+	switch option := option.(type) {
+	case *[]string:
+		if len(args) == 0 {
+			return d.ArgErr()
+		}
+		*option = append(*option, args...)
+		return nil
+	case *[]TTLPattern:
+		if len(args) < 2 || len(args) > 3 || (len(args) == 3 && args[2] != "sliding") {
+			return d.Errf("%s takes a pattern, a TTL and optionally sliding, got %q", name, args)
+		}
+		ttl, err := caddy.ParseDuration(args[1])
+		if err != nil {
+			return d.Errf("invalid %s TTL %q: %v", name, args[1], err)
+		}
+		*option = append(*option, TTLPattern{Pattern: args[0], TTL: Duration(ttl), Sliding: len(args) == 3})
+		return nil
+	case *bool:
+		if len(args) == 0 {
+			*option = true
+			return nil
+		}
+	}
+
+	if len(args) != 1 {
+		return d.ArgErr()
+	}
+	arg := args[0]
+	var err error
+	switch option := option.(type) {
+	case *string:
+		*option = arg
+	case *bool:
+		*option, err = strconv.ParseBool(arg)
+	case *int:
+		*option, err = strconv.Atoi(arg)
+	case *int64:
+		*option, err = strconv.ParseInt(arg, 10, 64)
+	case *float64:
+		*option, err = strconv.ParseFloat(arg, 64)
+	case *Duration:
+		var dur time.Duration
+		dur, err = caddy.ParseDuration(arg)
+		*option = Duration(dur)
+	default:
+		return d.Errf("unsupported type %T of %s", option, name)
+	}
+	if err != nil {
+		return d.Errf("invalid %s %q: %v", name, arg, err)
+	}
+	return nil
+}
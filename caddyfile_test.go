@@ -0,0 +1,150 @@
+package storageredis
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_UnmarshalCaddyfile(t *testing.T) {
+	rd := new(RedisStorage)
+	err := rd.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`
+	redis {
+		host                  "redis.example.com"
+		port                  6380
+		db                    2
+		username              "caddy"
+		password              "secret"
+		timeout               10
+		key_prefix            "caddytls"
+		aes_key               "redistls-01234567890-caddytls-32"
+		tls_enabled
+		tls_insecure          false
+		tls_ca_cert_file      "/etc/redis/ca.pem"
+		tls_client_cert_file  "/etc/redis/client.pem"
+		tls_client_key_file   "/etc/redis/client.key"
+		tls_min_version       "1.3"
+		compression           "gzip"
+		scan_count            200
+		rate_limit            12.5
+		shard_addresses       "redis1:6379" "redis2:6379"
+		shard_addresses       "redis3:6379"
+		lock_timeout          "30s"
+		abandoned_after       "30d"
+		ttl_patterns          "ocsp/*" "72h" sliding
+		ttl_patterns          "certificates/*/*/*.json" "2160h"
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "redis.example.com", rd.Host)
+	assert.Equal(t, "6380", rd.Port)
+	assert.Equal(t, 2, rd.DB)
+	assert.Equal(t, "caddy", rd.Username)
+	assert.Equal(t, "secret", rd.Password)
+	assert.Equal(t, 10, rd.Timeout)
+	assert.Equal(t, "caddytls", rd.KeyPrefix)
+	assert.Equal(t, "redistls-01234567890-caddytls-32", rd.AesKey)
+	assert.True(t, rd.TlsEnabled)
+	assert.False(t, rd.TlsInsecure)
+	assert.Equal(t, "/etc/redis/ca.pem", rd.TlsCaCertFile)
+	assert.Equal(t, "/etc/redis/client.pem", rd.TlsClientCertFile)
+	assert.Equal(t, "/etc/redis/client.key", rd.TlsClientKeyFile)
+	assert.Equal(t, "1.3", rd.TlsMinVersion)
+	assert.Equal(t, CompressionGzip, rd.Compression)
+	assert.Equal(t, int64(200), rd.ScanCount)
+	assert.Equal(t, 12.5, rd.RateLimit)
+	assert.Equal(t, []string{"redis1:6379", "redis2:6379", "redis3:6379"}, rd.ShardAddresses)
+	assert.Equal(t, Duration(30*time.Second), rd.LockTimeout)
+	assert.Equal(t, Duration(30*24*time.Hour), rd.AbandonedAfter)
+	assert.Equal(t, []TTLPattern{
+		{Pattern: "ocsp/*", TTL: Duration(72 * time.Hour), Sliding: true},
+		{Pattern: "certificates/*/*/*.json", TTL: Duration(2160 * time.Hour)},
+	}, rd.TTLPatterns)
+}
+
+func TestRedisStorage_UnmarshalCaddyfilePartial(t *testing.T) {
+	rd := new(RedisStorage)
+	assert.NoError(t, rd.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`redis {
+		address "redis:6379"
+	}`)))
+	assert.Equal(t, "redis:6379", rd.Address)
+
+	// options left out stay unset, for GetConfigValue to default them
+	assert.Equal(t, RedisStorage{Address: "redis:6379"}, *rd)
+
+	rd = new(RedisStorage)
+	assert.NoError(t, rd.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`redis`)))
+	assert.Equal(t, RedisStorage{}, *rd)
+}
+
+func TestRedisStorage_UnmarshalCaddyfileMalformed(t *testing.T) {
+	for _, tt := range []struct {
+		name, input, err string
+	}{
+		{"unknown option", `redis {
+			hostname "redis"
+		}`, "unrecognized redis storage option 'hostname'"},
+		{"argument after module", `redis "redis:6379"`, "wrong argument count"},
+		{"missing argument", `redis {
+			host
+		}`, "wrong argument count"},
+		{"extra argument", `redis {
+			port 6379 6380
+		}`, "wrong argument count"},
+		{"invalid int", `redis {
+			db one
+		}`, `invalid db "one"`},
+		{"invalid bool", `redis {
+			tls_enabled maybe
+		}`, `invalid tls_enabled "maybe"`},
+		{"invalid duration", `redis {
+			lock_timeout 10
+		}`, `invalid lock_timeout "10"`},
+		{"invalid float", `redis {
+			rate_limit fast
+		}`, `invalid rate_limit "fast"`},
+		{"empty list", `redis {
+			shard_addresses
+		}`, "wrong argument count"},
+		{"ttl pattern without ttl", `redis {
+			ttl_patterns "ocsp/*"
+		}`, "ttl_patterns takes a pattern, a TTL and optionally sliding"},
+		{"ttl pattern with unknown flag", `redis {
+			ttl_patterns "ocsp/*" "72h" fixed
+		}`, "ttl_patterns takes a pattern, a TTL and optionally sliding"},
+		{"invalid ttl", `redis {
+			ttl_patterns "ocsp/*" forever
+		}`, `invalid ttl_patterns TTL "forever"`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := new(RedisStorage).UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.err)
+			}
+		})
+	}
+}
+
+func TestRedisStorage_CaddyfileOptions(t *testing.T) {
+	rd := new(RedisStorage)
+	options := rd.caddyfileOptions()
+
+	// every option set in JSON has a directive, set to the field of the same name
+	typ := reflect.TypeOf(*rd)
+	value := reflect.ValueOf(rd).Elem()
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		name := strings.Split(typ.Field(i).Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		names = append(names, name)
+		if assert.Contains(t, options, name) {
+			assert.Same(t, value.Field(i).Addr().Interface(), options[name], name)
+		}
+	}
+	assert.Len(t, options, len(names))
+}
@@ -0,0 +1,52 @@
+package storageredis
+
+import (
+	"context"
+	"time"
+)
+
+// ClockSkew returns how far the local clock is ahead of the Redis server clock,
+// negative if it is behind. The round trip is accounted for by comparing the
+// server time with the local time halfway through the TIME command.
+func (rd *RedisStorage) ClockSkew(ctx context.Context) (time.Duration, error) {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+
+	before := time.Now()
+	serverTime, err := rd.Client.Time(opCtx).Result()
+	if err != nil {
+		return 0, classifyTimeout(ctx, opCtx, err)
+	}
+	after := time.Now()
+
+	localTime := before.Add(after.Sub(before) / 2)
+	return localTime.Sub(serverTime), nil
+}
+
+// checkClockSkew logs a warning when the clock skew exceeds ClockSkewWarnThreshold
+func (rd *RedisStorage) checkClockSkew(ctx context.Context) {
+	if rd.ClockSkewWarnThreshold <= 0 {
+		return
+	}
+
+	skew, err := rd.ClockSkew(ctx)
+	if err != nil {
+		rd.Logger.Warnf("[WARNING] Unable to check clock skew with Redis: %v", err)
+		return
+	}
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > time.Duration(rd.ClockSkewWarnThreshold) {
+		rd.Logger.Warnf("[WARNING] Local clock is %v off from Redis, modified times of stored values may be inaccurate", skew)
+	}
+}
+
+// now returns the time to record as modified time of stored values
+func (rd *RedisStorage) now(ctx context.Context) (time.Time, error) {
+	if !rd.UseServerTime {
+		return time.Now(), nil
+	}
+	return rd.Client.Time(ctx).Result()
+}
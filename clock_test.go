@@ -0,0 +1,59 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedisStorage_ClockSkew(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	mr.SetTime(time.Now().Add(-time.Hour))
+	skew, err := rd.ClockSkew(context.TODO())
+	assert.NoError(t, err)
+	assert.InDelta(t, float64(time.Hour), float64(skew), float64(time.Second))
+
+	mr.SetTime(time.Now().Add(time.Minute))
+	skew, err = rd.ClockSkew(context.TODO())
+	assert.NoError(t, err)
+	assert.InDelta(t, float64(-time.Minute), float64(skew), float64(time.Second))
+}
+
+func TestRedisStorage_ClockSkewWarning(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Now().Add(-time.Hour))
+
+	core, logs := observer.New(zap.WarnLevel)
+	rd := new(RedisStorage)
+	rd.Logger = zap.New(core).Sugar()
+	rd.ClockSkewWarnThreshold = Duration(time.Minute)
+	setupRedisEnvWithStorage(t, mr, rd)
+
+	assert.Equal(t, 1, logs.FilterMessageSnippet("off from Redis").Len())
+}
+
+func TestRedisStorage_UseServerTime(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.UseServerTime = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	serverTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	mr.SetTime(serverTime)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	err := rd.Store(context.TODO(), key, []byte("crt data"))
+	assert.NoError(t, err)
+
+	info, err := rd.Stat(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.True(t, serverTime.Equal(info.Modified))
+}
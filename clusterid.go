@@ -0,0 +1,43 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrClusterMismatch is returned by BuildRedisClient when ClusterID is set and
+// KeyPrefix already belongs to another cluster on one of the Redis nodes
+var ErrClusterMismatch = errors.New("key prefix belongs to another cluster")
+
+// clusterIDKey returns the Redis key recording the ClusterID of the cluster KeyPrefix belongs to
+func (rd *RedisStorage) clusterIDKey() string {
+	return path.Join(rd.keyPrefix(), internalKeyNamePrefix+"cluster_id")
+}
+
+// checkClusterID claims KeyPrefix on the node of redisClient, at address, for ClusterID,
+// and returns ErrClusterMismatch if another cluster claimed it first
+func (rd *RedisStorage) checkClusterID(ctx context.Context, redisClient redis.UniversalClient, address string) error {
+	if rd.ClusterID == "" {
+		return nil
+	}
+
+	var owner *redis.StringCmd
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SetNX(ctx, rd.clusterIDKey(), rd.ClusterID, 0)
+		owner = pipe.Get(ctx, rd.clusterIDKey())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to check the cluster ID on %s: %v", address, err)
+	}
+	if owner.Val() != rd.ClusterID {
+		return fmt.Errorf("%w: %s in db %d on %s belongs to cluster %q, not %q; check the `db` and `key_prefix` settings, "+
+			"or delete %s if that cluster is gone",
+			ErrClusterMismatch, rd.keyPrefix(), rd.DB, address, owner.Val(), rd.ClusterID, rd.clusterIDKey())
+	}
+	return nil
+}
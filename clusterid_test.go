@@ -0,0 +1,52 @@
+package storageredis
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// buildCluster builds a storage of cluster clusterID with the settings of the test environment
+func buildCluster(t *testing.T, clusterID string, keyPrefix string) (*RedisStorage, error) {
+	rd := new(RedisStorage)
+	rd.ClusterID = clusterID
+	rd.KeyPrefix = keyPrefix
+	rd.GetConfigValue()
+	err := rd.BuildRedisClient()
+	t.Cleanup(func() {
+		rd.Cleanup()
+		if rd.Client != nil {
+			rd.Client.Close()
+		}
+	})
+	return rd, err
+}
+
+func TestRedisStorage_ClusterID(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.ClusterID = "a"
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	// the marker was flushed with the test database
+	assert.NoError(t, rd.BuildRedisClient())
+	mr.Select(9)
+	owner, err := mr.Get(rd.clusterIDKey())
+	assert.NoError(t, err)
+	assert.Equal(t, "a", owner)
+
+	_, err = buildCluster(t, "b", "")
+	assert.True(t, errors.Is(err, ErrClusterMismatch), "%v", err)
+	assert.Contains(t, err.Error(), `belongs to cluster "a", not "b"`)
+
+	// other instances of the same cluster
+	_, err = buildCluster(t, "a", "")
+	assert.NoError(t, err)
+
+	// other clusters under other prefixes
+	_, err = buildCluster(t, "b", "otherprefix")
+	assert.NoError(t, err)
+	_, err = buildCluster(t, "", "")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,71 @@
+package storageredis
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+const (
+	// CompressionNone stores values as they are
+	CompressionNone = "none"
+
+	// CompressionGzip compresses values with gzip, before they are encrypted
+	CompressionGzip = "gzip"
+)
+
+// gzipMarker starts the values compressed with CompressionGzip, so they can be
+// told apart from values stored uncompressed
+const gzipMarker = "caddy-tlsredis-gzip:"
+
+// checkCompression checks Compression is known
+func (rd *RedisStorage) checkCompression() error {
+	switch rd.Compression {
+	case "", CompressionNone, CompressionGzip:
+		return nil
+	default:
+		return fmt.Errorf("unknown compression %q", rd.Compression)
+	}
+}
+
+// compress returns value compressed according to Compression, or value itself
+// when compressing doesn't make it smaller, as with short values
+func (rd *RedisStorage) compress(value []byte) ([]byte, error) {
+	if rd.Compression != CompressionGzip {
+		return value, nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(gzipMarker)
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(value); err != nil {
+		return nil, fmt.Errorf("unable to compress: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("unable to compress: %v", err)
+	}
+	if buf.Len() >= len(value) {
+		return value, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// decompress returns value decompressed if it was compressed, whatever the
+// current Compression, so values stored before changing it remain readable
+func decompress(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, []byte(gzipMarker)) {
+		return value, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(value[len(gzipMarker):]))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress: %v", err)
+	}
+	defer reader.Close()
+	decompressed, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decompress: %v", err)
+	}
+	return decompressed, nil
+}
@@ -0,0 +1,83 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_Compression(t *testing.T) {
+	chain := []byte(strings.Repeat("-----BEGIN CERTIFICATE-----\nMIIFazCCA1OgAwIBAgIRAIIQz7DSQONZRGPgu2OCiwAwDQYJKoZIhvcNAQELBQAw\n-----END CERTIFICATE-----\n", 20))
+	short := []byte("ok")
+
+	for _, compression := range []string{CompressionNone, CompressionGzip} {
+		for _, aesKey := range []string{"", "redistls-01234567890-caddytls-32"} {
+			t.Run(compression+"/encrypted="+strconv.FormatBool(aesKey != ""), func(t *testing.T) {
+				mr := miniredis.RunT(t)
+				rd := new(RedisStorage)
+				rd.Compression = compression
+				rd.AesKey = aesKey
+				rd = setupRedisEnvWithStorage(t, mr, rd)
+				uncompressed := setupRedisEnvWithStorage(t, mr, new(RedisStorage))
+				uncompressed.AesKey = aesKey
+
+				key := path.Join("certificates", "example.com", "example.com.crt")
+				assert.NoError(t, rd.Store(context.TODO(), key, chain))
+				value, err := rd.Load(context.TODO(), key)
+				assert.NoError(t, err)
+				assert.Equal(t, chain, value)
+
+				mr.Select(9)
+				stored, err := mr.Get(rd.prefixKey(key))
+				assert.NoError(t, err)
+				if compression == CompressionGzip {
+					assert.Less(t, len(stored), len(chain)/4)
+				} else {
+					assert.Greater(t, len(stored), len(chain))
+				}
+
+				// short values aren't made longer
+				shortKey := path.Join("certificates", "example.com", "example.com.json")
+				assert.NoError(t, rd.Store(context.TODO(), shortKey, short))
+				value, err = rd.Load(context.TODO(), shortKey)
+				assert.NoError(t, err)
+				assert.Equal(t, short, value)
+				stored, err = mr.Get(rd.prefixKey(shortKey))
+				assert.NoError(t, err)
+				assert.NotContains(t, stored, gzipMarker)
+
+				// compressed values are read with compression disabled
+				value, err = uncompressed.Load(context.TODO(), key)
+				assert.NoError(t, err)
+				assert.Equal(t, chain, value)
+			})
+		}
+	}
+}
+
+func TestRedisStorage_CompressionMixed(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.Compression = CompressionGzip
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	old := setupRedisEnvWithStorage(t, mr, new(RedisStorage))
+
+	// values stored before enabling compression remain readable
+	oldKey := path.Join("certificates", "example.org", "example.org.crt")
+	content := []byte(strings.Repeat("crt data ", 100))
+	assert.NoError(t, old.Store(context.TODO(), oldKey, content))
+	value, err := rd.Load(context.TODO(), oldKey)
+	assert.NoError(t, err)
+	assert.Equal(t, content, value)
+
+	unknown := new(RedisStorage)
+	unknown.Address = mr.Addr()
+	unknown.Compression = "zstd"
+	unknown.GetConfigValue()
+	assert.Error(t, unknown.BuildRedisClient())
+}
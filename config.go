@@ -0,0 +1,159 @@
+package storageredis
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetConfigValue get Config value from env, if already been set by Caddyfile or JSON, don't overwrite
+func (rd *RedisStorage) GetConfigValue() {
+	rd.Network = configureString(rd.Network, EnvNameRedisNetwork, NetworkTCP)
+	rd.Host = configureString(rd.Host, EnvNameRedisHost, DefaultRedisHost)
+	rd.Port = configureString(rd.Port, EnvNameRedisPort, DefaultRedisPort)
+	rd.DB = configureInt(rd.DB, EnvNameRedisDB, DefaultRedisDB)
+	rd.Username = configureString(rd.Username, EnvNameRedisUsername, DefaultRedisUsername)
+	rd.Password = configureString(rd.Password, EnvNameRedisPassword, DefaultRedisPassword)
+	rd.Timeout = configureInt(rd.Timeout, EnvNameRedisTimeout, DefaultRedisTimeout)
+	rd.MaxRetries = configureInt(rd.MaxRetries, EnvNameRedisMaxRetries, DefaultMaxRetries)
+	rd.ScanCount = int64(configureInt(int(rd.ScanCount), EnvNameScanCount, int(ScanCount)))
+	rd.KeyPrefix = configureString(rd.KeyPrefix, EnvNameKeyPrefix, DefaultKeyPrefix)
+	rd.ValuePrefix = configureString(rd.ValuePrefix, EnvNameValuePrefix, DefaultValuePrefix)
+	rd.AesKey = configureString(rd.AesKey, EnvNameAESKey, DefaultAESKey)
+	rd.PasswordFile = configureString(rd.PasswordFile, EnvNameRedisPasswordFile, "")
+	rd.AesKeyFile = configureString(rd.AesKeyFile, EnvNameAESKeyFile, "")
+	rd.TlsEnabled = configureBool(rd.TlsEnabled, EnvNameTLSEnabled, DefaultRedisTLS)
+	rd.TlsInsecure = configureBool(rd.TlsInsecure, EnvNameTLSInsecure, DefaultRedisTLSInsecure)
+	rd.LockOwner = configureString(rd.LockOwner, EnvNameLockOwner, "")
+	rd.ConnectionName = configureString(rd.ConnectionName, EnvNameConnectionName, DefaultConnectionName)
+	rd.ClusterEnabled = configureBool(rd.ClusterEnabled, EnvNameRedisCluster, false)
+	rd.Addresses = configureStrings(rd.Addresses, EnvNameRedisAddresses)
+	rd.SentinelEnabled = configureBool(rd.SentinelEnabled, EnvNameRedisSentinel, false)
+	rd.MasterName = configureString(rd.MasterName, EnvNameRedisMasterName, "")
+	rd.SentinelAddresses = configureStrings(rd.SentinelAddresses, EnvNameRedisSentinelAddresses)
+	rd.SentinelPassword = configureString(rd.SentinelPassword, EnvNameRedisSentinelPassword, "")
+
+	// address is build from host and port, unless explicitly set
+	if rd.Address == "" {
+		rd.Address = net.JoinHostPort(rd.Host, rd.Port)
+	}
+}
+
+// readSecretFiles replaces Password and AesKey with the content of PasswordFile and
+// AesKeyFile, when set
+func (rd *RedisStorage) readSecretFiles() error {
+	if rd.PasswordFile != "" {
+		password, err := readSecretFile(rd.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("unable to read redis password: %w", err)
+		}
+		rd.Password = password
+	}
+	if rd.AesKeyFile != "" {
+		aesKey, err := readSecretFile(rd.AesKeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to read AES key: %w", err)
+		}
+		rd.AesKey = aesKey
+	}
+	return nil
+}
+
+// readSecretFile returns the content of the file at name without trailing newlines,
+// which editors and `echo` add
+func readSecretFile(name string) (string, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", name)
+	}
+	return secret, nil
+}
+
+// configureString returns value if set, otherwise the env variable, otherwise the default
+func configureString(value string, envVariableName string, valueDefault string) string {
+	if value != "" {
+		return value
+	}
+	if envValue := os.Getenv(envVariableName); envValue != "" {
+		return envValue
+	}
+	return valueDefault
+}
+
+// configureStrings returns value if set, otherwise the comma-separated values of the env variable
+func configureStrings(value []string, envVariableName string) []string {
+	if len(value) > 0 {
+		return value
+	}
+	var values []string
+	for _, envValue := range strings.Split(os.Getenv(envVariableName), ",") {
+		if envValue = strings.TrimSpace(envValue); envValue != "" {
+			values = append(values, envValue)
+		}
+	}
+	return values
+}
+
+// configureInt returns value if set, otherwise the env variable, otherwise the default
+func configureInt(value int, envVariableName string, valueDefault int) int {
+	if value != 0 {
+		return value
+	}
+	if envValue := os.Getenv(envVariableName); envValue != "" {
+		if intValue, err := strconv.Atoi(envValue); err == nil {
+			return intValue
+		}
+	}
+	return valueDefault
+}
+
+// configureBool returns the env variable if set, otherwise value if true, otherwise the default
+func configureBool(value bool, envVariableName string, valueDefault bool) bool {
+	if envValue := os.Getenv(envVariableName); envValue != "" {
+		if boolValue, err := strconv.ParseBool(envValue); err == nil {
+			return boolValue
+		}
+	}
+	if value {
+		return value
+	}
+	return valueDefault
+}
+
+// Duration is a time.Duration that can be unmarshaled from JSON as either
+// a duration string like "10s" or an integer number of nanoseconds
+type Duration time.Duration
+
+// UnmarshalJSON satisfies json.Unmarshaler
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	if len(b) == 0 {
+		return fmt.Errorf("empty duration")
+	}
+	if b[0] != '"' {
+		nanos, err := strconv.ParseInt(string(b), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid duration %s: %v", b, err)
+		}
+		*d = Duration(nanos)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	dur, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %s: %v", s, err)
+	}
+	*d = Duration(dur)
+	return nil
+}
@@ -0,0 +1,86 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/go-redis/redis/v8"
+)
+
+// setCreatedSource records in KEYS[2] the time ARGV[1] the value KEYS[1] is first
+// stored at, and expires it with the value after ARGV[2] milliseconds, unless 0.
+// It runs before the value is set, in the same transaction. A value stored before
+// creation times were recorded keeps an unknown creation time.
+const setCreatedSource = `
+if redis.call("exists", KEYS[2]) == 0 then
+	if redis.call("exists", KEYS[1]) == 1 then
+		return 0
+	end
+	redis.call("set", KEYS[2], ARGV[1])
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call("pexpire", KEYS[2], ARGV[2])
+else
+	redis.call("persist", KEYS[2])
+end
+return 1
+`
+
+// ExtendedKeyInfo is certmagic.KeyInfo with the time the key was first stored at
+type ExtendedKeyInfo struct {
+	certmagic.KeyInfo
+
+	// Created is when the key was first stored, kept when it is stored again. It is
+	// zero for keys stored before creation times were recorded, and for keys only
+	// found under ReadPrefixes.
+	Created time.Time
+}
+
+// setCreatedCommand returns the arguments of the command recording created as the
+// creation time of key, when it doesn't exist yet, to run in the transaction storing it
+func (rd *RedisStorage) setCreatedCommand(key string, created time.Time, ttl time.Duration) []interface{} {
+	return []interface{}{"eval", setCreatedSource, 2, rd.prefixKey(key), rd.createdKey(key), created.Format(time.RFC3339Nano), ttl.Milliseconds()}
+}
+
+// ExtendedStat returns information about key, as Stat, along with when it was first stored.
+func (rd RedisStorage) ExtendedStat(ctx context.Context, key string) (ExtendedKeyInfo, error) {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	info, err := rd.extendedStat(opCtx, key)
+	return info, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd RedisStorage) extendedStat(ctx context.Context, key string) (ExtendedKeyInfo, error) {
+	info, err := rd.stat(ctx, key)
+	if err != nil {
+		return ExtendedKeyInfo{}, err
+	}
+
+	created, err := rd.getCreated(ctx, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return ExtendedKeyInfo{}, err
+	}
+	return ExtendedKeyInfo{KeyInfo: info, Created: created}, nil
+}
+
+// getCreated returns the time key was first stored at
+func (rd RedisStorage) getCreated(ctx context.Context, key string) (time.Time, error) {
+	value, err := rd.clientFor(rd.createdKey(key)).Get(ctx, rd.createdKey(key)).Result()
+	if err == redis.Nil {
+		return time.Time{}, fs.ErrNotExist
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("unable to obtain creation time for %s: %w", key, err)
+	}
+
+	created, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unable to decode creation time for %s: %v", key, err)
+	}
+	return created, nil
+}
@@ -0,0 +1,79 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_ExtendedStat(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.UseServerTime = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	key := path.Join("certificates", "acme", "example.com", "example.com.crt")
+
+	created := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		mr.SetTime(created.Add(time.Duration(i) * time.Hour))
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+		info, err := rd.ExtendedStat(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, key, info.Key)
+		assert.True(t, created.Equal(info.Created), "created: %v", info.Created)
+		assert.True(t, created.Add(time.Duration(i)*time.Hour).Equal(info.Modified), "modified: %v", info.Modified)
+	}
+
+	// stored again from scratch once deleted
+	assert.NoError(t, rd.Delete(context.TODO(), key))
+	mr.Select(9)
+	assert.False(t, mr.Exists(rd.createdKey(key)))
+	mr.SetTime(created.Add(24 * time.Hour))
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	info, err := rd.ExtendedStat(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.True(t, created.Add(24*time.Hour).Equal(info.Created), "created: %v", info.Created)
+
+	_, err = rd.ExtendedStat(context.TODO(), path.Join("certificates", "missing"))
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "%v", err)
+}
+
+func TestRedisStorage_ExtendedStatStoredBefore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithStorage(t, mr, new(RedisStorage))
+	key := path.Join("certificates", "acme", "example.com", "example.com.crt")
+
+	// stored before creation times were recorded
+	storeModified(t, rd, key, []byte("crt data"), time.Now().Add(-time.Hour))
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	info, err := rd.ExtendedStat(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.True(t, info.Created.IsZero(), "created: %v", info.Created)
+	value, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), value)
+}
+
+func TestRedisStorage_CreatedExpires(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.TTLPatterns = []TTLPattern{{Pattern: "ocsp/*", TTL: Duration(time.Hour)}}
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	key := path.Join("ocsp", "example.com-ocsp")
+
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("staple")))
+	mr.Select(9)
+	assert.Equal(t, time.Hour, mr.TTL(rd.createdKey(key)))
+
+	mr.FastForward(30 * time.Minute)
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("staple")))
+	assert.Equal(t, time.Hour, mr.TTL(rd.createdKey(key)))
+}
@@ -3,94 +3,357 @@ package storageredis
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
-	"encoding/json"
+	"crypto/sha256"
 	"fmt"
 	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
 )
 
-func (rd *RedisStorage) encrypt(bytes []byte) ([]byte, error) {
-	// No key? No encrypt
-	if len(rd.AesKey) == 0 {
-		return bytes, nil
+// deterministicMarker starts the values stored with DeterministicEncryption,
+// so they can be told apart from values encrypted with a random nonce
+const deterministicMarker = "caddy-tlsredis-siv:"
+
+// chachaMarker starts the values encrypted with EncryptionChaCha20Poly1305
+const chachaMarker = "caddy-tlsredis-chacha20poly1305:"
+
+// aesGCMMarker starts the values encrypted with EncryptionAESGCM, except those
+// stored before it was introduced, which have no marker
+const aesGCMMarker = "caddy-tlsredis-aes-gcm:"
+
+// plaintextMarker starts the values stored with EncryptionNone while an AES key
+// is set, so a value failing to decrypt is never taken for one in the clear
+const plaintextMarker = "caddy-tlsredis-none:"
+
+// scrypt parameters of KeyDerivationScrypt, the ones recommended for interactive
+// logins, as the keys are only derived once, see scryptKeys
+const (
+	scryptN      = 1 << 15
+	scryptR      = 8
+	scryptP      = 1
+	scryptKeyLen = 32
+)
+
+// scryptKeys holds the keys derived with scrypt, by passphrase and salt, which is
+// too slow to run on every operation
+var scryptKeys sync.Map
+
+// deriveAESKeys checks KeyDerivation, and derives the keys of AesKey and
+// PreviousAesKey ahead of the first operation
+func (rd *RedisStorage) deriveAESKeys() error {
+	if rd.KeyDerivation != "" && rd.KeyDerivation != KeyDerivationRaw && rd.KeyDerivation != KeyDerivationScrypt {
+		return fmt.Errorf("unknown key derivation %q", rd.KeyDerivation)
 	}
+	if _, err := rd.deriveAESKey(rd.AesKey); err != nil {
+		return fmt.Errorf("unable to derive AES key: %v", err)
+	}
+	if _, err := rd.deriveAESKey(rd.PreviousAesKey); err != nil {
+		return fmt.Errorf("unable to derive previous AES key: %v", err)
+	}
+	return nil
+}
 
-	c, err := aes.NewCipher(rd.GetAESKeyByte())
+// deriveAESKey returns the key derived from passphrase according to KeyDerivation
+func (rd *RedisStorage) deriveAESKey(passphrase string) ([]byte, error) {
+	if rd.KeyDerivation != KeyDerivationScrypt || passphrase == "" {
+		return []byte(passphrase), nil
+	}
+	salt := rd.KeyDerivationSalt
+	if salt == "" {
+		salt = rd.KeyPrefix
+	}
+
+	cacheKey := passphrase + "\x00" + salt
+	if key, ok := scryptKeys.Load(cacheKey); ok {
+		return key.([]byte), nil
+	}
+	key, err := scrypt.Key([]byte(passphrase), []byte(salt), scryptN, scryptR, scryptP, scryptKeyLen)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create AES cipher: %v", err)
+		return nil, err
 	}
+	scryptKeys.Store(cacheKey, key)
+	return key, nil
+}
+
+// encryptionAlgorithm returns EncryptionAlgorithm, or its default
+func (rd *RedisStorage) encryptionAlgorithm() string {
+	switch {
+	case rd.EncryptionAlgorithm != "":
+		return rd.EncryptionAlgorithm
+	case len(rd.AesKey) == 0:
+		return EncryptionNone
+	default:
+		return EncryptionAESGCM
+	}
+}
+
+// checkEncryption checks EncryptionAlgorithm can be used with the key of AesKey
+func (rd *RedisStorage) checkEncryption() error {
+	algorithm := rd.encryptionAlgorithm()
+	switch algorithm {
+	case EncryptionNone:
+		return nil
+	case EncryptionAESGCM, EncryptionChaCha20Poly1305:
+		if len(rd.AesKey) == 0 {
+			return fmt.Errorf("%s encryption requires an AES key", algorithm)
+		}
+		if err := checkKeySize(algorithm, "AES key", rd.GetAESKeyByte()); err != nil {
+			return err
+		}
+		if rd.PreviousAesKey == "" {
+			return nil
+		}
+		// values encrypted with the previous key may predate EncryptionAlgorithm
+		return checkKeySize(EncryptionAESGCM, "previous AES key", rd.previousAESKeyByte())
+	default:
+		return fmt.Errorf("unknown encryption algorithm %q", algorithm)
+	}
+}
 
+// checkKeySize checks key, described by name, has a size algorithm accepts
+func checkKeySize(algorithm, name string, key []byte) error {
+	switch {
+	case algorithm == EncryptionChaCha20Poly1305 && len(key) != chacha20poly1305.KeySize:
+		return fmt.Errorf("%s encryption requires a %d byte %s, got %d bytes, use key_derivation %q for passphrases",
+			algorithm, chacha20poly1305.KeySize, name, len(key), KeyDerivationScrypt)
+	case algorithm == EncryptionAESGCM && len(key) != 16 && len(key) != 24 && len(key) != 32:
+		return fmt.Errorf("%s encryption requires a 16, 24 or 32 byte %s, got %d bytes, use key_derivation %q for passphrases",
+			algorithm, name, len(key), KeyDerivationScrypt)
+	}
+	return nil
+}
+
+// newAEAD returns the cipher of algorithm, EncryptionAESGCM or EncryptionChaCha20Poly1305, with key
+func newAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	if algorithm == EncryptionChaCha20Poly1305 {
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create ChaCha20-Poly1305 cipher: %v", err)
+		}
+		return aead, nil
+	}
+
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create AES cipher: %v", err)
+	}
 	gcm, err := cipher.NewGCM(c)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create GCM cipher: %v", err)
 	}
+	return gcm, nil
+}
+
+// previousAESKeyByte returns the key derived from PreviousAesKey, see GetAESKeyByte
+func (rd *RedisStorage) previousAESKeyByte() []byte {
+	key, _ := rd.deriveAESKey(rd.PreviousAesKey)
+	return key
+}
+
+// deriveKey returns a subkey of the AES key for purpose, so each use of the
+// key material gets its own key
+func (rd *RedisStorage) deriveKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, rd.GetAESKeyByte())
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func (rd *RedisStorage) encrypt(bytes []byte) ([]byte, error) {
+	algorithm := rd.encryptionAlgorithm()
+	if algorithm == EncryptionNone {
+		if len(rd.AesKey) == 0 {
+			return bytes, nil
+		}
+		return append([]byte(plaintextMarker), bytes...), nil
+	}
+
+	aead, err := newAEAD(algorithm, rd.GetAESKeyByte())
+	if err != nil {
+		return nil, err
+	}
 
-	nonce := make([]byte, gcm.NonceSize())
+	nonce := make([]byte, aead.NonceSize())
 	_, err = io.ReadFull(rand.Reader, nonce)
 	if err != nil {
 		return nil, fmt.Errorf("unable to generate nonce: %v", err)
 	}
 
-	return gcm.Seal(nonce, nonce, bytes, nil), nil
+	marker := aesGCMMarker
+	if algorithm == EncryptionChaCha20Poly1305 {
+		marker = chachaMarker
+	}
+	return aead.Seal(append([]byte(marker), nonce...), nonce, bytes, nil), nil
 }
 
-// EncryptStorageData encrypt storage data, so it won't be plain data
-func (rd *RedisStorage) EncryptStorageData(data *StorageData) ([]byte, error) {
-	// JSON marshal, then encrypt if key is there
-	bytes, err := json.Marshal(data)
+// encryptDeterministic encrypts value with a synthetic nonce derived from key
+// and value, so the same value stored under the same key always encrypts to
+// the same bytes. The key is also authenticated, so the ciphertext can't be
+// moved to another key.
+func (rd *RedisStorage) encryptDeterministic(key string, value []byte) ([]byte, error) {
+	gcm, err := newAEAD(EncryptionAESGCM, rd.GetAESKeyByte())
 	if err != nil {
-		return nil, fmt.Errorf("unable to marshal: %v", err)
+		return nil, err
 	}
 
-	// Prefix with simple prefix and then encrypt
-	bytes = append([]byte(rd.ValuePrefix), bytes...)
-	return rd.encrypt(bytes)
+	mac := hmac.New(sha256.New, rd.deriveKey("caddy-tlsredis deterministic nonces"))
+	mac.Write([]byte(key))
+	mac.Write([]byte{0})
+	mac.Write(value)
+	nonce := mac.Sum(nil)[:gcm.NonceSize()]
+
+	return gcm.Seal(nonce, nonce, value, []byte(key)), nil
 }
 
-func (rd *RedisStorage) decrypt(bytes []byte) ([]byte, error) {
-	// No key? No decrypt
-	if len(rd.AesKey) == 0 {
-		return bytes, nil
+func (rd *RedisStorage) decryptDeterministic(key string, bytes []byte) ([]byte, error) {
+	return rd.open(EncryptionAESGCM, bytes, []byte(key))
+}
+
+// open decrypts bytes sealed by algorithm with additionalData, with AesKey or else PreviousAesKey
+func (rd *RedisStorage) open(algorithm string, bytes []byte, additionalData []byte) ([]byte, error) {
+	out, err := openWith(algorithm, rd.GetAESKeyByte(), bytes, additionalData)
+	if err != nil && len(rd.PreviousAesKey) != 0 {
+		// not re-encrypted with the new key yet
+		if previous, previousErr := openWith(algorithm, rd.previousAESKeyByte(), bytes, additionalData); previousErr == nil {
+			return previous, nil
+		}
 	}
-	if len(bytes) < aes.BlockSize {
+	return out, err
+}
+
+func openWith(algorithm string, key []byte, bytes []byte, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(algorithm, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes) < aead.NonceSize() {
 		return nil, fmt.Errorf("invalid contents")
 	}
 
-	block, err := aes.NewCipher(rd.GetAESKeyByte())
+	out, err := aead.Open(nil, bytes[:aead.NonceSize()], bytes[aead.NonceSize():], additionalData)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create AES cipher: %v", err)
+		return nil, fmt.Errorf("decryption failure: %v", err)
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	return out, nil
+}
+
+// EncryptStorageData encrypt storage data, so it won't be plain data
+func (rd *RedisStorage) EncryptStorageData(data *StorageData) ([]byte, error) {
+	return rd.encryptStorageData("", data)
+}
+
+// encryptStorageData encrypts data stored under key. With DeterministicEncryption
+// in the policy of key only the value is encrypted, deterministically, and the modified time is kept
+// next to it in the clear, so storing the same value again only changes the time.
+func (rd *RedisStorage) encryptStorageData(key string, data *StorageData) ([]byte, error) {
+	// Compress, serialize, then encrypt if key is there, as encrypted bytes
+	// don't compress
+	serializer, err := rd.serializer()
 	if err != nil {
-		return nil, fmt.Errorf("unable to create GCM cipher: %v", err)
+		return nil, err
+	}
+	value, err := rd.compress(data.Value)
+	if err != nil {
+		return nil, err
+	}
+	data = &StorageData{Value: value, Modified: data.Modified}
+
+	if rd.policy(key).DeterministicEncryption && rd.encryptionAlgorithm() != EncryptionNone {
+		value, err := rd.encryptDeterministic(key, data.Value)
+		if err != nil {
+			return nil, err
+		}
+		bytes, err := serializer.Serialize(&StorageData{Value: value, Modified: data.Modified})
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte(deterministicMarker), bytes...), nil
 	}
 
-	out, err := gcm.Open(nil, bytes[:gcm.NonceSize()], bytes[gcm.NonceSize():], nil)
+	bytes, err := serializer.Serialize(data)
 	if err != nil {
-		return nil, fmt.Errorf("decryption failure: %v", err)
+		return nil, err
 	}
+	return rd.encrypt(bytes)
+}
 
-	return out, nil
+// decrypt decrypts bytes with the algorithm they were encrypted with, whatever
+// EncryptionAlgorithm is now. Values stored in the clear are only read with
+// EncryptionNone, and values without a marker are AES-GCM ones stored before
+// markers were introduced.
+func (rd *RedisStorage) decrypt(bytes []byte) ([]byte, error) {
+	if hasMarker(bytes, plaintextMarker) {
+		if algorithm := rd.encryptionAlgorithm(); algorithm != EncryptionNone {
+			return nil, fmt.Errorf("value stored in the clear, while encrypting with %s", algorithm)
+		}
+		return bytes[len(plaintextMarker):], nil
+	}
+	// No key? No decrypt
+	if len(rd.AesKey) == 0 {
+		return bytes, nil
+	}
+	switch {
+	case hasMarker(bytes, chachaMarker):
+		return rd.open(EncryptionChaCha20Poly1305, bytes[len(chachaMarker):], nil)
+	case hasMarker(bytes, aesGCMMarker):
+		return rd.open(EncryptionAESGCM, bytes[len(aesGCMMarker):], nil)
+	default:
+		return rd.open(EncryptionAESGCM, bytes, nil)
+	}
+}
+
+// hasMarker returns whether bytes start with marker
+func hasMarker(bytes []byte, marker string) bool {
+	return len(bytes) >= len(marker) && string(bytes[:len(marker)]) == marker
 }
 
 // DecryptStorageData decrypt storage data, so we can read it
 func (rd *RedisStorage) DecryptStorageData(bytes []byte) (*StorageData, error) {
-	// We have to decrypt if there is an AES key and then JSON unmarshal
-	bytes, err := rd.decrypt(bytes)
+	return rd.decryptStorageData("", bytes)
+}
+
+// decryptStorageData decrypts data stored under key, whether or not it was
+// encrypted deterministically
+func (rd *RedisStorage) decryptStorageData(key string, bytes []byte) (*StorageData, error) {
+	serializer, err := rd.serializer()
 	if err != nil {
 		return nil, err
 	}
 
-	// Simple sanity check of the beginning of the byte array just to check
-	if len(bytes) < len(rd.ValuePrefix) || string(bytes[:len(rd.ValuePrefix)]) != rd.ValuePrefix {
-		return nil, fmt.Errorf("invalid data format")
+	if len(rd.AesKey) != 0 && hasMarker(bytes, deterministicMarker) {
+		data, err := serializer.Deserialize(bytes[len(deterministicMarker):])
+		if err != nil {
+			return nil, err
+		}
+		data.Value, err = rd.decryptDeterministic(key, data.Value)
+		if err != nil {
+			return nil, err
+		}
+		data.Value, err = decompress(data.Value)
+		if err != nil {
+			return nil, err
+		}
+		return data, nil
 	}
 
-	// Now just json unmarshal
-	data := &StorageData{}
-	if err := json.Unmarshal(bytes[len(rd.ValuePrefix):], data); err != nil {
-		return nil, fmt.Errorf("unable to unmarshal result: %v", err)
+	// We have to decrypt if there is an AES key and then deserialize
+	bytes, err = rd.decrypt(bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	// Now just deserialize, and decompress
+	data, err := serializer.Deserialize(bytes)
+	if err != nil {
+		return nil, err
+	}
+	data.Value, err = decompress(data.Value)
+	if err != nil {
+		return nil, err
 	}
 	return data, nil
 }
@@ -1,9 +1,14 @@
 package storageredis
 
 import (
+	"context"
+	"encoding/hex"
+	"path"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,3 +31,184 @@ func TestRedisStorage_EncryptDecryptStorageData(t *testing.T) {
 	assert.Equal(t, sd.Value, decryptedData.Value)
 	assert.Equal(t, sd.Modified.Format(time.RFC822), decryptedData.Modified.Format(time.RFC822))
 }
+
+func TestRedisStorage_EncryptionAlgorithm(t *testing.T) {
+	newStorage := func(algorithm string) *RedisStorage {
+		rd := new(RedisStorage)
+		rd.GetConfigValue()
+		rd.AesKey = "redistls-01234567890-caddytls-32"
+		rd.EncryptionAlgorithm = algorithm
+		assert.NoError(t, rd.checkEncryption())
+		return rd
+	}
+	sd := &StorageData{Value: []byte("crt data"), Modified: time.Now()}
+
+	stored := map[string][]byte{}
+	for _, algorithm := range []string{"", EncryptionAESGCM, EncryptionChaCha20Poly1305, EncryptionNone} {
+		rd := newStorage(algorithm)
+		encrypted, err := rd.EncryptStorageData(sd)
+		assert.NoError(t, err)
+		// the serialized value is base64 encoded
+		if algorithm == EncryptionNone {
+			assert.Contains(t, string(encrypted), "Y3J0IGRhdGE=")
+		} else {
+			assert.NotContains(t, string(encrypted), "Y3J0IGRhdGE=")
+		}
+		stored[algorithm] = encrypted
+
+		decrypted, err := rd.DecryptStorageData(encrypted)
+		assert.NoError(t, err, algorithm)
+		assert.Equal(t, sd.Value, decrypted.Value, algorithm)
+	}
+	// AES-GCM is the default, and every algorithm marks the values it stores
+	assert.True(t, strings.HasPrefix(string(stored[""]), aesGCMMarker))
+	assert.True(t, strings.HasPrefix(string(stored[EncryptionAESGCM]), aesGCMMarker))
+	assert.True(t, strings.HasPrefix(string(stored[EncryptionChaCha20Poly1305]), chachaMarker))
+	assert.True(t, strings.HasPrefix(string(stored[EncryptionNone]), plaintextMarker))
+	// AES-GCM values stored before they were marked
+	stored["legacy"] = stored[EncryptionAESGCM][len(aesGCMMarker):]
+
+	// whatever the algorithm, values encrypted with another one remain readable,
+	// while values stored in the clear are only read when not encrypting
+	for _, algorithm := range []string{EncryptionAESGCM, EncryptionChaCha20Poly1305, EncryptionNone} {
+		rd := newStorage(algorithm)
+		for storedWith, encrypted := range stored {
+			decrypted, err := rd.DecryptStorageData(encrypted)
+			if storedWith == EncryptionNone && algorithm != EncryptionNone {
+				assert.Error(t, err, "%s read by %s", storedWith, algorithm)
+				continue
+			}
+			assert.NoError(t, err, "%s read by %s", storedWith, algorithm)
+			assert.Equal(t, sd.Value, decrypted.Value, "%s read by %s", storedWith, algorithm)
+		}
+	}
+
+	// a value failing to decrypt is never taken for one stored in the clear
+	rd := newStorage(EncryptionNone)
+	for storedWith, encrypted := range stored {
+		if storedWith == EncryptionNone {
+			continue
+		}
+		tampered := append([]byte(nil), encrypted...)
+		tampered[len(tampered)-1] ^= 0xff
+		_, err := rd.decrypt(tampered)
+		assert.Error(t, err, "tampered %s value", storedWith)
+	}
+	_, err := rd.decrypt([]byte("short"))
+	assert.Error(t, err)
+	_, err = rd.decrypt(append([]byte(aesGCMMarker), "short"...))
+	assert.Error(t, err)
+
+	rd = newStorage(EncryptionChaCha20Poly1305)
+	rd.AesKey = "redistls-0123456"
+	assert.EqualError(t, rd.checkEncryption(), `chacha20-poly1305 encryption requires a 32 byte AES key, got 16 bytes, use key_derivation "scrypt" for passphrases`)
+	rd.AesKey = ""
+	assert.EqualError(t, rd.checkEncryption(), "chacha20-poly1305 encryption requires an AES key")
+	rd.EncryptionAlgorithm = "rot13"
+	assert.EqualError(t, rd.checkEncryption(), `unknown encryption algorithm "rot13"`)
+	rd.EncryptionAlgorithm = EncryptionNone
+	rd.EncryptKeys = true
+	rd.Address = miniredis.RunT(t).Addr()
+	assert.EqualError(t, rd.BuildRedisClient(), "encrypting keys requires an AES key")
+}
+
+func TestRedisStorage_EncryptDeterministic(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.GetConfigValue()
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+
+	first, err := rd.encryptStorageData("acme/key", &StorageData{Value: []byte("crt data"), Modified: time.Now()})
+	assert.NoError(t, err)
+	second, err := rd.encryptStorageData("acme/key", &StorageData{Value: []byte("crt data"), Modified: time.Now()})
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, second)
+
+	rd.DeterministicEncryption = true
+	sealed := func(key string, modified time.Time) []byte {
+		encoded, err := rd.encryptStorageData(key, &StorageData{Value: []byte("crt data"), Modified: modified})
+		assert.NoError(t, err)
+		serializer, err := rd.serializer()
+		assert.NoError(t, err)
+		data, err := serializer.Deserialize(encoded[len(deterministicMarker):])
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data.Value), "crt data")
+		return data.Value
+	}
+
+	// the timestamp doesn't take part in the encryption of the value
+	assert.Equal(t, sealed("acme/key", time.Now()), sealed("acme/key", time.Now().Add(time.Hour)))
+	// the same value under another key encrypts differently
+	assert.NotEqual(t, sealed("acme/key", time.Now()), sealed("acme/other", time.Now()))
+
+	modified := time.Now()
+	encoded, err := rd.encryptStorageData("acme/key", &StorageData{Value: []byte("crt data"), Modified: modified})
+	assert.NoError(t, err)
+	decryptedData, err := rd.decryptStorageData("acme/key", encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), decryptedData.Value)
+	assert.True(t, modified.Equal(decryptedData.Modified))
+
+	// the ciphertext is bound to its key
+	_, err = rd.decryptStorageData("acme/other", encoded)
+	assert.Error(t, err)
+
+	// values encrypted with a random nonce are still read
+	rd.DeterministicEncryption = false
+	decryptedData, err = rd.decryptStorageData("acme/key", encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), decryptedData.Value)
+	rd.DeterministicEncryption = true
+	decryptedData, err = rd.decryptStorageData("acme/key", first)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), decryptedData.Value)
+}
+
+func TestRedisStorage_KeyDerivation(t *testing.T) {
+	mr := miniredis.RunT(t)
+	key := path.Join("certificates", "example.com", "example.com.crt")
+
+	rd := new(RedisStorage)
+	rd.AesKey = "correct horse"
+	rd.KeyDerivation = KeyDerivationScrypt
+	rd.KeyDerivationSalt = "caddytls"
+
+	// a short passphrase makes an AES-256 key, which is the same every time
+	derived := rd.GetAESKeyByte()
+	assert.Len(t, derived, 32)
+	assert.Equal(t, "ca26599ab89b31835854923400aa891b6b0c80fc17b9315a27a1ba7fc2c241b5", hex.EncodeToString(derived))
+
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	// as after a restart
+	restarted := new(RedisStorage)
+	restarted.AesKey = "correct horse"
+	restarted.KeyDerivation = KeyDerivationScrypt
+	restarted.KeyDerivationSalt = "caddytls"
+	restarted.Address = mr.Addr()
+	restarted.GetConfigValue()
+	assert.NoError(t, restarted.BuildRedisClient())
+	t.Cleanup(func() { restarted.Cleanup() })
+	value, err := restarted.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), value)
+
+	// the salt changes the key, and defaults to the key prefix
+	salted := *rd
+	salted.KeyDerivationSalt = "other"
+	assert.NotEqual(t, derived, salted.GetAESKeyByte())
+	prefixed := *rd
+	prefixed.KeyDerivationSalt = ""
+	prefixed.KeyPrefix = "caddytls"
+	assert.Equal(t, derived, prefixed.GetAESKeyByte())
+
+	// the raw key is used as it is
+	raw := *rd
+	raw.KeyDerivation = KeyDerivationRaw
+	assert.Equal(t, []byte("correct horse"), raw.GetAESKeyByte())
+
+	unknown := new(RedisStorage)
+	unknown.KeyDerivation = "bcrypt"
+	unknown.GetConfigValue()
+	assert.Error(t, unknown.BuildRedisClient())
+}
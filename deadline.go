@@ -0,0 +1,39 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTimeout is returned by operations that ran out of time before the deadline
+// of the caller's context, when DeadlineMargin is set
+var ErrTimeout = errors.New("redis operation timed out")
+
+// orBackground returns ctx, or context.Background() if ctx is nil, so callers
+// outside certmagic passing a nil context don't make go-redis panic
+func orBackground(ctx context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// withDeadlineMargin returns a context expiring DeadlineMargin before ctx does
+func (rd RedisStorage) withDeadlineMargin(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || rd.DeadlineMargin <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, deadline.Add(-time.Duration(rd.DeadlineMargin)))
+}
+
+// classifyTimeout turns err into ErrTimeout when the operation context opCtx
+// expired while the caller's ctx is still alive
+func classifyTimeout(ctx context.Context, opCtx context.Context, err error) error {
+	if err == nil || opCtx.Err() == nil || ctx.Err() != nil {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrTimeout, err)
+}
@@ -0,0 +1,195 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_DeadlineMargin(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.DeadlineMargin = Duration(200 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	assert.NoError(t, rd.Store(context.TODO(), "example.com", []byte("crt data")))
+
+	// a slow redis
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "GET" {
+			time.Sleep(time.Second)
+		}
+		return false
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err := rd.Load(ctx, "example.com")
+	assert.True(t, errors.Is(err, ErrTimeout), "%v", err)
+	assert.False(t, errors.Is(err, context.DeadlineExceeded))
+	assert.NoError(t, ctx.Err(), "the caller's deadline shouldn't have expired yet")
+}
+
+func TestRedisStorage_DeadlineMarginOperations(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.DeadlineMargin = Duration(200 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	assert.NoError(t, rd.Store(context.TODO(), "example.com", []byte("crt data")))
+
+	// a slow redis
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		time.Sleep(600 * time.Millisecond)
+		return false
+	})
+
+	operations := map[string]func(ctx context.Context) error{
+		"TryLock": func(ctx context.Context) error {
+			_, err := rd.TryLock(ctx, "example.com")
+			return err
+		},
+		"DeletePrefix": func(ctx context.Context) error {
+			_, err := rd.DeletePrefix(ctx, "")
+			return err
+		},
+		"ListModifiedSince": func(ctx context.Context) error {
+			_, err := rd.ListModifiedSince(ctx, "", time.Time{})
+			return err
+		},
+		"Usage": func(ctx context.Context) error {
+			_, err := rd.Usage(ctx)
+			return err
+		},
+		"SweepLocks": func(ctx context.Context) error {
+			_, err := rd.SweepLocks(ctx)
+			return err
+		},
+		"ClockSkew": func(ctx context.Context) error {
+			_, err := rd.ClockSkew(ctx)
+			return err
+		},
+	}
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+
+			err := operation(ctx)
+			assert.True(t, errors.Is(err, ErrTimeout), "%v", err)
+			assert.NoError(t, ctx.Err(), "the caller's deadline shouldn't have expired yet")
+		})
+	}
+}
+
+func TestRedisStorage_CanceledContext(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	assert.NoError(t, rd.Store(context.TODO(), "example.com", []byte("crt data")))
+	assert.NoError(t, rd.Lock(context.TODO(), "locked.example.com"))
+
+	// a redis hanging for longer than the test waits
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		time.Sleep(2 * time.Second)
+		return false
+	})
+
+	operations := map[string]func(ctx context.Context) error{
+		"Store": func(ctx context.Context) error {
+			return rd.Store(ctx, "example.com", []byte("crt data"))
+		},
+		"Load": func(ctx context.Context) error {
+			_, err := rd.Load(ctx, "example.com")
+			return err
+		},
+		"Delete": func(ctx context.Context) error {
+			return rd.Delete(ctx, "example.com")
+		},
+		"Stat": func(ctx context.Context) error {
+			_, err := rd.Stat(ctx, "example.com")
+			return err
+		},
+		"List": func(ctx context.Context) error {
+			_, err := rd.List(ctx, "", true)
+			return err
+		},
+		"Lock": func(ctx context.Context) error {
+			return rd.Lock(ctx, "other.example.com")
+		},
+		"Unlock": func(ctx context.Context) error {
+			return rd.Unlock(ctx, "locked.example.com")
+		},
+	}
+	for name, operation := range operations {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+
+			start := time.Now()
+			err := operation(ctx)
+			assert.True(t, errors.Is(err, context.Canceled), "%v", err)
+			assert.True(t, time.Since(start) < time.Second, "returned after %v", time.Since(start))
+		})
+	}
+}
+
+func TestRedisStorage_DeadlineMarginLock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.DeadlineMargin = Duration(200 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	other := setupRedisEnvWithServer(t, mr)
+	assert.NoError(t, other.Lock(context.TODO(), "example.com"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err := rd.Lock(ctx, "example.com")
+	assert.True(t, errors.Is(err, ErrTimeout), "%v", err)
+	assert.NoError(t, ctx.Err(), "the caller's deadline shouldn't have expired yet")
+	assert.NoError(t, other.Unlock(context.TODO(), "example.com"))
+}
+
+func TestRedisStorage_NilContext(t *testing.T) {
+	rd := setupRedisEnv(t)
+	var ctx context.Context
+	key := "example.com"
+
+	assert.NotPanics(t, func() {
+		assert.NoError(t, rd.Store(ctx, key, []byte("crt data")))
+		assert.NoError(t, rd.StoreUnsafe(ctx, key, []byte("crt data")))
+		_, err := rd.Load(ctx, key)
+		assert.NoError(t, err)
+		assert.True(t, rd.Exists(ctx, key))
+		_, err = rd.Stat(ctx, key)
+		assert.NoError(t, err)
+		_, err = rd.List(ctx, "", true)
+		assert.NoError(t, err)
+		assert.NoError(t, rd.ListFunc(ctx, "", func(key string) error { return nil }))
+		_, err = rd.ListLeaves(ctx, "")
+		assert.NoError(t, err)
+		_, err = rd.ListModifiedSince(ctx, "", time.Time{})
+		assert.NoError(t, err)
+		assert.NoError(t, rd.Lock(ctx, key))
+		assert.NoError(t, rd.Unlock(ctx, key))
+		_, err = rd.TryLock(ctx, key)
+		assert.NoError(t, err)
+		assert.NoError(t, rd.Unlock(ctx, key))
+		_, err = rd.Usage(ctx)
+		assert.NoError(t, err)
+		_, err = rd.SweepLocks(ctx)
+		assert.NoError(t, err)
+		_, err = rd.SweepAbandoned(ctx)
+		assert.NoError(t, err)
+		_, err = rd.ClockSkew(ctx)
+		assert.NoError(t, err)
+		assert.NoError(t, rd.Warmup(ctx, 1))
+		assert.NoError(t, rd.Delete(ctx, key))
+		_, err = rd.DeletePrefix(ctx, "")
+		assert.NoError(t, err)
+	})
+}
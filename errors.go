@@ -0,0 +1,121 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrWriteVerification is returned by Store when VerifyWrites is enabled and the
+// value read back isn't the one stored
+var ErrWriteVerification = errors.New("write verification failed")
+
+// ErrStaleWrite is returned by Store when StoreIfNewer is enabled and the stored
+// value was modified at or after the one being stored
+var ErrStaleWrite = errors.New("stored value is newer")
+
+// ErrFencedOut is returned by Store when LockFencing is enabled and the lock whose
+// fencing token it was called with was obtained again since
+var ErrFencedOut = errors.New("lock was obtained again since the fencing token")
+
+// ErrStorageFull is returned for writes Redis refused because it reached its
+// maxmemory and can't evict keys
+var ErrStorageFull = errors.New("redis is out of memory")
+
+// hasErrorPrefix reports whether err is a Redis error reply with the given error code
+func hasErrorPrefix(err error, code string) bool {
+	return err != nil && strings.HasPrefix(err.Error(), code+" ")
+}
+
+// classifyConnectError turns the errors of the initial connection to Redis into
+// errors telling the operator how to fix their configuration
+func (rd *RedisStorage) classifyConnectError(redisClient redis.UniversalClient, err error) error {
+	// a Redis Cluster only has db 0, and BuildRedisClient refuses any other
+	node, standalone := redisClient.(*redis.Client)
+	switch {
+	case standalone && isDBOutOfRange(err):
+		return rd.dbOutOfRangeError(node, err)
+	case hasErrorPrefix(err, "NOAUTH"):
+		return fmt.Errorf("redis requires authentication; set the `password` field or `%s`: %w", EnvNameRedisPassword, err)
+	case hasErrorPrefix(err, "WRONGPASS"):
+		return fmt.Errorf("redis rejected the username %q or its password: %w", rd.aclUsername(), err)
+	default:
+		return err
+	}
+}
+
+// aclCheckScript is run by checkPermissions, it does nothing
+const aclCheckScript = `return 0`
+
+// isDBOutOfRange reports whether err is the reply to selecting a DB beyond the
+// databases configured on the server
+func isDBOutOfRange(err error) bool {
+	return hasErrorPrefix(err, "ERR") && strings.Contains(err.Error(), "DB index is out of range")
+}
+
+// dbOutOfRangeError names the number of databases of the server in err, reading it
+// with CONFIG GET when the user is allowed to
+func (rd *RedisStorage) dbOutOfRangeError(redisClient *redis.Client, err error) error {
+	// the configured DB can't be selected, so ask from the default one
+	options := *redisClient.Options()
+	options.DB = 0
+	configClient := redis.NewClient(&options)
+	defer configClient.Close()
+
+	config, configErr := configClient.ConfigGet(rd.ctx, "databases").Result()
+	if configErr != nil || len(config) != 2 {
+		return fmt.Errorf("redis db %d doesn't exist on the server, check its `databases` setting: %w", rd.DB, err)
+	}
+	databases, convErr := strconv.Atoi(fmt.Sprint(config[1]))
+	if convErr != nil {
+		return fmt.Errorf("redis db %d doesn't exist on the server, check its `databases` setting: %w", rd.DB, err)
+	}
+	return fmt.Errorf("redis db %d doesn't exist, the server has %d databases, numbered 0 to %d: %w", rd.DB, databases, databases-1, err)
+}
+
+// checkPermissions runs harmless commands like the ones the storage needs, so a
+// user lacking ACL permissions fails at startup with an error naming the denied
+// command rather than on the first certificate operation
+func (rd *RedisStorage) checkPermissions(ctx context.Context, redisClient redis.UniversalClient) error {
+	probe := path.Join(rd.keyPrefix(), internalKeyNamePrefix+"acl_check")
+	checks := []redis.Cmder{
+		redisClient.Exists(ctx, probe),
+		redisClient.Scan(ctx, 0, probe, 1),
+		// the probe key expires on its own should DEL be denied
+		redisClient.Set(ctx, probe, "", time.Minute),
+		redisClient.Del(ctx, probe),
+		// locks and the sweeper run scripts, loaded with EVAL then run with EVALSHA
+		redisClient.Eval(ctx, aclCheckScript, []string{probe}),
+		redisClient.EvalSha(ctx, redis.NewScript(aclCheckScript).Hash(), []string{probe}),
+	}
+	for _, cmd := range checks {
+		if err := cmd.Err(); hasErrorPrefix(err, "NOPERM") {
+			return fmt.Errorf("redis user %q is not allowed to run %s on %s, check its ACL rules: %w",
+				rd.aclUsername(), strings.ToUpper(cmd.Name()), probe, err)
+		}
+	}
+	return nil
+}
+
+// aclUsername returns the name of the Redis user we authenticate as
+func (rd *RedisStorage) aclUsername() string {
+	if rd.Username == "" {
+		return "default"
+	}
+	return rd.Username
+}
+
+// classifyWriteError turns the error of a write refused because Redis ran out of
+// memory into ErrStorageFull
+func classifyWriteError(err error) error {
+	if hasErrorPrefix(err, "OOM") {
+		return fmt.Errorf("%w, increase its maxmemory or free some memory: %v", ErrStorageFull, err)
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/caddyserver/certmagic"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_ConnectNoAuth(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+
+	rd := new(RedisStorage)
+	rd.Address = mr.Addr()
+	rd.GetConfigValue()
+
+	err := rd.BuildRedisClient()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "redis requires authentication; set the `password` field or `"+EnvNameRedisPassword+"`")
+}
+
+func TestRedisStorage_ConnectRetry(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	pings := 0
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "PING" {
+			return false
+		}
+		pings++
+		if pings <= 2 {
+			// not a LOADING error, which go-redis already retries by itself
+			c.WriteError("ERR server not ready")
+			return true
+		}
+		return false
+	})
+
+	rd := new(RedisStorage)
+	rd.Address = mr.Addr()
+	rd.ConnectBackoff = Duration(time.Millisecond)
+	rd.GetConfigValue()
+
+	assert.NoError(t, rd.BuildRedisClient())
+	assert.Equal(t, 3, pings)
+	t.Cleanup(func() { rd.Client.Close() })
+}
+
+func TestRedisStorage_ConnectRetryGivesUp(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	pings := 0
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "PING" {
+			return false
+		}
+		pings++
+		c.WriteError("ERR server not ready")
+		return true
+	})
+
+	rd := new(RedisStorage)
+	rd.Address = mr.Addr()
+	rd.ConnectRetries = 2
+	rd.ConnectBackoff = Duration(time.Millisecond)
+	rd.GetConfigValue()
+
+	assert.Error(t, rd.BuildRedisClient())
+	assert.Equal(t, 3, pings)
+}
+
+func TestRedisStorage_ConnectNoPerm(t *testing.T) {
+	for _, denied := range []string{"SCAN", "SET", "DEL", "EVAL", "EVALSHA"} {
+		t.Run(denied, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+				if cmd == denied {
+					c.WriteError(fmt.Sprintf("NOPERM this user has no permissions to run the '%s' command", strings.ToLower(cmd)))
+					return true
+				}
+				return false
+			})
+
+			rd := new(RedisStorage)
+			rd.Address = mr.Addr()
+			rd.Username = "caddy"
+			rd.GetConfigValue()
+
+			err := rd.BuildRedisClient()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), fmt.Sprintf(`redis user "caddy" is not allowed to run %s`, denied))
+		})
+	}
+}
+
+func TestRedisStorage_ConnectDBOutOfRange(t *testing.T) {
+	for _, configAllowed := range []bool{true, false} {
+		t.Run(fmt.Sprintf("config_allowed=%v", configAllowed), func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			selects := 0
+			mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+				switch {
+				case cmd == "SELECT" && args[0] != "0":
+					selects++
+					c.WriteError("ERR DB index is out of range")
+					return true
+				case cmd == "CONFIG" && configAllowed:
+					c.WriteLen(2)
+					c.WriteBulk("databases")
+					c.WriteBulk("16")
+					return true
+				case cmd == "CONFIG":
+					c.WriteError("NOPERM this user has no permissions to run the 'config' command")
+					return true
+				}
+				return false
+			})
+
+			rd := new(RedisStorage)
+			rd.Address = mr.Addr()
+			rd.DB = 20
+			rd.GetConfigValue()
+
+			err := rd.BuildRedisClient()
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "redis db 20 doesn't exist")
+			if configAllowed {
+				assert.Contains(t, err.Error(), "the server has 16 databases, numbered 0 to 15")
+			}
+			// not retried
+			assert.Equal(t, 1, selects)
+		})
+	}
+}
+
+func TestRedisStorage_StorageFull(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	key := path.Join("certificates", "example.com", "example.com.crt")
+
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "SET" {
+			c.WriteError("OOM command not allowed when used memory > 'maxmemory'.")
+			return true
+		}
+		return false
+	})
+
+	err := rd.Store(context.TODO(), key, []byte("crt data"))
+	assert.ErrorIs(t, err, ErrStorageFull)
+	assert.Contains(t, err.Error(), "maxmemory")
+	_, err = rd.Load(context.TODO(), key)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	err = rd.Lock(context.TODO(), key)
+	assert.ErrorIs(t, err, ErrStorageFull)
+}
+
+func TestRedisStorage_Retries(t *testing.T) {
+	mr := miniredis.RunT(t)
+	key := path.Join("certificates", "example.com", "example.com.crt")
+
+	rd := new(RedisStorage)
+	rd.MaxRetries = 2
+	rd.MinRetryBackoff = Duration(time.Millisecond)
+	rd.MaxRetryBackoff = Duration(5 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	options := rd.Client.(*redis.Client).Options()
+	assert.Equal(t, 2, options.MaxRetries)
+	assert.Equal(t, time.Millisecond, options.MinRetryBackoff)
+	assert.Equal(t, 5*time.Millisecond, options.MaxRetryBackoff)
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	// Redis fails the first reads while coming back from a failover
+	failures := 0
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "GET" && failures < 2 {
+			failures++
+			c.WriteError("LOADING Redis is loading the dataset in memory")
+			return true
+		}
+		return false
+	})
+	value, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), value)
+	assert.Equal(t, 2, failures)
+
+	// without retries the first failure is returned
+	noRetries := new(RedisStorage)
+	noRetries.MaxRetries = -1
+	noRetries = setupRedisEnvWithStorage(t, mr, noRetries)
+	assert.Equal(t, 0, noRetries.Client.(*redis.Client).Options().MaxRetries)
+	failures = 0
+	_, err = noRetries.Load(context.TODO(), key)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "LOADING")
+}
+
+func TestRedisStorage_RetriesConfig(t *testing.T) {
+	os.Setenv(EnvNameRedisMaxRetries, "7")
+	defer os.Unsetenv(EnvNameRedisMaxRetries)
+	rd := new(RedisStorage)
+	rd.GetConfigValue()
+	assert.Equal(t, 7, rd.MaxRetries)
+
+	// the configured value wins over the env variable
+	rd = new(RedisStorage)
+	rd.MaxRetries = -1
+	rd.GetConfigValue()
+	assert.Equal(t, -1, rd.MaxRetries)
+
+	os.Unsetenv(EnvNameRedisMaxRetries)
+	rd = new(RedisStorage)
+	rd.GetConfigValue()
+	assert.Equal(t, DefaultMaxRetries, rd.MaxRetries)
+
+	rd.MinRetryBackoff = Duration(time.Second)
+	rd.MaxRetryBackoff = Duration(time.Millisecond)
+	assert.Error(t, rd.BuildRedisClient())
+}
+
+func TestRedisStorage_MissIsNotExist(t *testing.T) {
+	options := map[string]func(rd *RedisStorage){
+		"default":       func(rd *RedisStorage) {},
+		"light stat":    func(rd *RedisStorage) { rd.LightStat = true },
+		"encrypt keys":  func(rd *RedisStorage) { rd.EncryptKeys = true },
+		"read prefixes": func(rd *RedisStorage) { rd.ReadPrefixes = []string{"oldprefix"} },
+	}
+	key := path.Join("certificates", "example.com", "example.com.crt")
+
+	// the linked certmagic's own storage tells the misses it expects
+	fileStorage := &certmagic.FileStorage{Path: t.TempDir()}
+	_, fileErr := fileStorage.Load(context.TODO(), key)
+	assert.ErrorIs(t, fileErr, fs.ErrNotExist)
+
+	for name, option := range options {
+		t.Run(name, func(t *testing.T) {
+			rd := new(RedisStorage)
+			rd.AesKey = "redistls-01234567890-caddytls-32"
+			option(rd)
+			rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+			_, err := rd.Load(context.TODO(), key)
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			_, err = rd.Stat(context.TODO(), key)
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			_, err = rd.ExtendedStat(context.TODO(), key)
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			assert.False(t, rd.Exists(context.TODO(), key))
+			assert.ErrorIs(t, rd.Delete(context.TODO(), key), fs.ErrNotExist)
+		})
+	}
+}
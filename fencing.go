@@ -0,0 +1,126 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+)
+
+// fenceTTL is how long the fencing token of a lock is kept after the lock was
+// last obtained, at least, far beyond the time a holder can stall and still
+// write, so the counters of locks no longer used don't pile up
+const fenceTTL = 7 * 24 * time.Hour
+
+// fenceTTLLockTimeouts is how many lock timeouts the fencing token of a lock is
+// kept, at least, for very long lock timeouts
+const fenceTTLLockTimeouts = 100
+
+// incrementFenceScript increments the fencing token of a lock, only if the lock
+// still carries our value, so a lock lost before its token is incremented can't
+// be given a token above the one of the instance which obtained it since
+var incrementFenceScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	local token = redis.call("INCR", KEYS[2])
+	redis.call("PEXPIRE", KEYS[2], ARGV[2])
+	return token
+end
+return false
+`)
+
+// fence is the fencing token of the lock of key
+type fence struct {
+	key   string
+	token int64
+}
+
+// heldFence is the fencing token of a lock held by this instance
+type heldFence struct {
+	lock  *redislock.Lock
+	token int64
+}
+
+type fencingTokenKey struct{}
+
+// WithFencingToken returns a copy of ctx carrying token, the fencing token of the
+// lock of key returned by FencingToken. With LockFencing, Store called with it
+// fails with ErrFencedOut if that lock was obtained again since. Only the Stores
+// of programs passing such a context are fenced: those certmagic makes itself,
+// while holding its locks, carry no token and are never checked.
+func WithFencingToken(ctx context.Context, key string, token int64) context.Context {
+	return context.WithValue(ctx, fencingTokenKey{}, fence{key: normalizeKey(key), token: token})
+}
+
+// fencingTokenFrom returns the fencing token ctx carries, see WithFencingToken
+func fencingTokenFrom(ctx context.Context) (fence, bool) {
+	f, ok := ctx.Value(fencingTokenKey{}).(fence)
+	return f, ok
+}
+
+// FencingToken returns the fencing token of the lock of key, when held by this
+// instance and LockFencing is enabled. Tokens only ever increase: every time the
+// lock of a key is obtained, by any instance, it gets a greater one. They start
+// over once the lock wasn't obtained for fenceTTL, or 100 lock timeouts if longer.
+func (rd *RedisStorage) FencingToken(key string) (int64, bool) {
+	key = normalizeKey(key)
+	if rd.locks == nil {
+		return 0, false
+	}
+	lockI, exists := rd.locks.Load(key)
+	if !exists {
+		return 0, false
+	}
+	lock, ok := lockI.(*redislock.Lock)
+	if !ok || !rd.locks.owns(key, lock) {
+		return 0, false
+	}
+	heldI, exists := rd.locks.fences.Load(key)
+	if !exists {
+		return 0, false
+	}
+	held := heldI.(heldFence)
+	if held.lock != lock {
+		return 0, false
+	}
+	return held.token, true
+}
+
+// fenceKey returns the key of the fencing token of the lock of key
+func (rd *RedisStorage) fenceKey(key string) string {
+	return rd.prefixKey(key) + fenceKeySuffix
+}
+
+// incrementFence increments the fencing token of the lock of key, just obtained,
+// and returns it. It fails with redislock.ErrNotObtained if the lock expired since.
+func (rd *RedisStorage) incrementFence(ctx context.Context, key string, lock *redislock.Lock) (int64, error) {
+	lockName := rd.prefixKey(key) + lockKeySuffix
+	ttl := fenceTTL
+	if timeouts := fenceTTLLockTimeouts * rd.Tunables().LockTimeout; timeouts > ttl {
+		ttl = timeouts
+	}
+	token, err := incrementFenceScript.Run(ctx, rd.clientFor(lockName), []string{lockName, rd.fenceKey(key)},
+		lock.Token()+lock.Metadata(), ttl.Milliseconds()).Int64()
+	if err == redis.Nil {
+		return 0, redislock.ErrNotObtained
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to increment fencing token: %w", err)
+	}
+	return token, nil
+}
+
+// fenceCheck fails with ErrFencedOut when the lock of f was obtained again since f
+// was its token
+func (rd RedisStorage) fenceCheck(ctx context.Context, f fence) txCheck {
+	return func(tx *redis.Tx) error {
+		current, err := tx.Get(ctx, rd.fenceKey(f.key)).Int64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if current > f.token {
+			return fmt.Errorf("%w: lock of %v obtained with token %d, after %d", ErrFencedOut, f.key, current, f.token)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,107 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_LockFencing(t *testing.T) {
+	mr := miniredis.RunT(t)
+	stalled := setupRedisEnvWithStorage(t, mr, &RedisStorage{LockFencing: true})
+	other := setupRedisEnvWithStorage(t, mr, &RedisStorage{LockFencing: true})
+	lockKey := "issue_cert_example.com"
+	key := path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com", "example.com.crt")
+
+	assert.NoError(t, stalled.Lock(context.TODO(), lockKey))
+	stalledToken, ok := stalled.FencingToken(lockKey)
+	assert.True(t, ok)
+	assert.Equal(t, int64(1), stalledToken)
+	_, ok = other.FencingToken(lockKey)
+	assert.False(t, ok, "the lock isn't held by the other instance")
+	stalledCtx := WithFencingToken(context.TODO(), lockKey, stalledToken)
+	assert.NoError(t, stalled.Store(stalledCtx, key, []byte("crt data")))
+
+	// the holder stalls past the expiration of its lock, which another instance obtains
+	mr.FastForward(stalled.Tunables().LockTimeout)
+	assert.NoError(t, other.Lock(context.TODO(), lockKey))
+	otherToken, ok := other.FencingToken(lockKey)
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), otherToken)
+	otherCtx := WithFencingToken(context.TODO(), lockKey, otherToken)
+	assert.NoError(t, other.Store(otherCtx, key, []byte("renewed crt data")))
+
+	// the stalled instance still believes it holds the lock, but its writes are rejected
+	_, ok = stalled.FencingToken(lockKey)
+	assert.True(t, ok)
+	err := stalled.Store(stalledCtx, key, []byte("stale crt data"))
+	assert.True(t, errors.Is(err, ErrFencedOut), "%v", err)
+	value, err := other.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("renewed crt data"), value)
+
+	// writes without a token aren't fenced
+	assert.NoError(t, stalled.Store(context.TODO(), path.Join("ocsp", "example.com-1234"), []byte("ocsp")))
+
+	// the tokens of locks no longer used expire, long after the locks
+	ttl := mr.DB(9).TTL(other.fenceKey(lockKey))
+	assert.Equal(t, fenceTTL, ttl)
+
+	// tokens keep increasing after the lock is released
+	assert.NoError(t, other.Unlock(context.TODO(), lockKey))
+	_, ok = other.FencingToken(lockKey)
+	assert.False(t, ok)
+	assert.NoError(t, other.Lock(context.TODO(), lockKey))
+	otherToken, _ = other.FencingToken(lockKey)
+	assert.Equal(t, int64(3), otherToken)
+	assert.NoError(t, other.Unlock(context.TODO(), lockKey))
+
+	// fencing tokens aren't values
+	keys, err := other.List(context.TODO(), "", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{key, path.Join("ocsp", "example.com-1234")}, keys)
+
+	// without LockFencing, tokens are ignored
+	unfenced := setupRedisEnvWithStorage(t, mr, new(RedisStorage))
+	assert.NoError(t, unfenced.Store(stalledCtx, key, []byte("unfenced crt data")))
+}
+
+func TestRedisStorage_LockFencingConcurrentLock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithStorage(t, mr, &RedisStorage{LockFencing: true})
+	lockKey := "issue_cert_example.com"
+	key := path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com", "example.com.crt")
+
+	assert.NoError(t, rd.Lock(context.TODO(), lockKey))
+	token, _ := rd.FencingToken(lockKey)
+	ctx := WithFencingToken(context.TODO(), lockKey, token)
+
+	// the lock is obtained again between the check of the token and the write
+	var once sync.Once
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "EXEC" {
+			once.Do(func() {
+				mr.Select(9)
+				mr.Incr(rd.fenceKey(lockKey), 1)
+			})
+		}
+		return false
+	})
+	err := rd.Store(ctx, key, []byte("crt data"))
+	assert.True(t, errors.Is(err, ErrFencedOut), "%v", err)
+	mr.Server().SetPreHook(nil)
+	assert.False(t, rd.Exists(context.TODO(), key))
+}
+
+func TestRedisStorage_LockFencingConfig(t *testing.T) {
+	rd := &RedisStorage{LockFencing: true, ShardAddresses: []string{"redis1:6379", "redis2:6379"}}
+	assert.EqualError(t, rd.Validate(), "lock fencing can't be combined with redis cluster, several shard addresses or account storage")
+	rd = &RedisStorage{LockFencing: true, Address: "redis:6379", AccountStorageAddress: "accounts:6379"}
+	assert.Error(t, rd.Validate())
+}
@@ -0,0 +1,62 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// checkHealthPeriodically pings every Redis node every HealthCheckInterval, until ctx
+// is done, logging when they stop answering and when they answer again. go-redis
+// reconnects by itself, this only tells the operator before certmagic fails.
+func (rd *RedisStorage) checkHealthPeriodically(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, stackTraceBufferSize)
+			buf = buf[:runtime.Stack(buf, false)]
+			rd.Logger.Errorf("panic: checking health: %v\n%s", err, buf)
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(rd.HealthCheckInterval))
+	defer ticker.Stop()
+
+	// the client was built, so Redis answered
+	healthy := true
+	for {
+		select {
+		case <-ticker.C:
+			err := rd.checkHealth(ctx)
+			if ctx.Err() != nil {
+				// stopped while pinging
+				return
+			}
+			if err != nil && healthy {
+				rd.Logger.Errorf("[ERROR] Redis became unreachable: %v", err)
+			} else if err == nil && !healthy {
+				rd.Logger.Infof("[INFO] Redis is reachable again")
+			}
+			healthy = err == nil
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// checkHealth pings every Redis node once, giving up after HealthCheckInterval
+func (rd *RedisStorage) checkHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(rd.HealthCheckInterval))
+	defer cancel()
+
+	nodes, err := rd.nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, client := range nodes {
+		if err := client.Ping(ctx).Err(); err != nil {
+			return fmt.Errorf("unable to reach %s: %v", client.Options().Addr, err)
+		}
+	}
+	return nil
+}
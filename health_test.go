@@ -0,0 +1,39 @@
+package storageredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedisStorage_HealthCheck(t *testing.T) {
+	mr := miniredis.RunT(t)
+	core, logs := observer.New(zap.InfoLevel)
+	rd := new(RedisStorage)
+	rd.Logger = zap.New(core).Sugar()
+	rd.HealthCheckInterval = Duration(20 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	// every transition is logged once
+	mr.Close()
+	assert.Eventually(t, func() bool {
+		return logs.FilterMessageSnippet("Redis became unreachable").Len() > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.NoError(t, mr.Restart())
+	assert.Eventually(t, func() bool {
+		return logs.FilterMessageSnippet("Redis is reachable again").Len() > 0
+	}, 2*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, logs.FilterMessageSnippet("Redis became unreachable").Len())
+	assert.Equal(t, 1, logs.FilterMessageSnippet("Redis is reachable again").Len())
+
+	// and the checks stop with the storage
+	assert.NoError(t, rd.Cleanup())
+	mr.Close()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, logs.FilterMessageSnippet("Redis became unreachable").Len())
+}
@@ -0,0 +1,89 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// ImportFromFS copies the values under prefix of src, such as the
+// certmagic.FileStorage Caddy used before, into Redis, keeping their modified
+// times, so moving to Redis doesn't require issuing every certificate again.
+// Keys already stored in Redis are left alone unless overwrite is set. It
+// returns how many values were imported, and stops at the first failure.
+//
+// Like StoreUnsafe, it takes no lock: it is meant to run once, before the
+// instances using Redis start, or while nothing else writes the same keys.
+func (rd *RedisStorage) ImportFromFS(ctx context.Context, src certmagic.Storage, prefix string, overwrite bool) (int, error) {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	imported, err := rd.importFrom(opCtx, src, prefix, overwrite)
+	return imported, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd *RedisStorage) importFrom(ctx context.Context, src certmagic.Storage, prefix string, overwrite bool) (int, error) {
+	keys, err := src.List(ctx, prefix, true)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("unable to list keys to import: %v", err)
+	}
+
+	_, fromFiles := src.(*certmagic.FileStorage)
+	imported := 0
+	for _, key := range keys {
+		// the locks of certmagic.FileStorage are files next to the keys, not values
+		if fromFiles && (key == "locks" || strings.HasPrefix(key, "locks/")) {
+			continue
+		}
+
+		info, err := src.Stat(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted since it was listed
+			continue
+		} else if err != nil {
+			return imported, fmt.Errorf("unable to stat %v to import: %v", key, err)
+		}
+		if !info.IsTerminal {
+			continue
+		}
+
+		key = normalizeKey(key)
+		if !overwrite {
+			_, err := rd.readData(ctx, key)
+			if err == nil {
+				continue
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return imported, fmt.Errorf("unable to check whether %v is already stored: %w", key, err)
+			}
+		}
+
+		value, err := src.Load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return imported, fmt.Errorf("unable to load %v to import: %v", key, err)
+		}
+		modified := info.Modified
+		if modified.IsZero() {
+			if modified, err = rd.now(ctx); err != nil {
+				return imported, fmt.Errorf("unable to get time for %v: %v", key, err)
+			}
+		}
+		err = rd.storeModified(ctx, key, value, modified)
+		if errors.Is(err, ErrStaleWrite) {
+			// with StoreIfNewer, Redis already has a newer value
+			continue
+		} else if err != nil {
+			return imported, err
+		}
+		rd.trackServed(key)
+		imported++
+	}
+	return imported, nil
+}
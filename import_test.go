@@ -0,0 +1,100 @@
+package storageredis
+
+import (
+	"context"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_ImportFromFS(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+	files := &certmagic.FileStorage{Path: t.TempDir()}
+
+	modified := time.Date(2023, 3, 1, 12, 0, 0, 0, time.UTC)
+	values := map[string][]byte{
+		path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com", "example.com.crt"):  []byte("crt data"),
+		path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com", "example.com.key"):  []byte("key data"),
+		path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com", "example.com.json"): []byte("{}"),
+		path.Join("acme", "acme-v02.api.letsencrypt.org-directory", "users", "admin@example.com", "admin.key"): []byte("account key"),
+		path.Join("ocsp", "example.com-1234"): []byte("ocsp"),
+	}
+	for key, value := range values {
+		assert.NoError(t, files.Store(context.TODO(), key, value))
+		assert.NoError(t, os.Chtimes(files.Filename(key), modified, modified))
+	}
+	// a lock held by an instance still using the files isn't a value
+	assert.NoError(t, files.Lock(context.TODO(), "issue_cert_example.com"))
+	defer files.Unlock(context.TODO(), "issue_cert_example.com")
+
+	imported, err := rd.ImportFromFS(context.TODO(), files, "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, len(values), imported)
+
+	keys, err := rd.List(context.TODO(), "", true)
+	assert.NoError(t, err)
+	var stored []string
+	for key := range values {
+		stored = append(stored, key)
+	}
+	assert.ElementsMatch(t, stored, keys)
+	for key, value := range values {
+		loaded, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, value, loaded)
+		info, err := rd.Stat(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.True(t, modified.Equal(info.Modified), "modified: %v", info.Modified)
+		assert.Equal(t, int64(len(value)), info.Size)
+	}
+
+	// keys already in Redis are kept, unless overwriting them
+	ocsp := path.Join("ocsp", "example.com-1234")
+	assert.NoError(t, rd.Store(context.TODO(), ocsp, []byte("newer ocsp")))
+	imported, err = rd.ImportFromFS(context.TODO(), files, "", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+	loaded, err := rd.Load(context.TODO(), ocsp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("newer ocsp"), loaded)
+
+	imported, err = rd.ImportFromFS(context.TODO(), files, "ocsp", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, imported)
+	loaded, err = rd.Load(context.TODO(), ocsp)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("ocsp"), loaded)
+
+	// a missing prefix has nothing to import
+	imported, err = rd.ImportFromFS(context.TODO(), files, "missing", false)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+}
+
+func TestRedisStorage_ImportFromFSStoreIfNewer(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.StoreIfNewer = true
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+	files := &certmagic.FileStorage{Path: t.TempDir()}
+
+	key := path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com", "example.com.crt")
+	assert.NoError(t, files.Store(context.TODO(), key, []byte("old crt data")))
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(files.Filename(key), old, old))
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	// the value renewed in Redis isn't replaced by an older one, even when overwriting
+	imported, err := rd.ImportFromFS(context.TODO(), files, "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, imported)
+	loaded, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), loaded)
+}
@@ -0,0 +1,224 @@
+package storageredis
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	// keyIndexName is the name of the hash holding the encrypted key names when EncryptKeys is enabled
+	keyIndexName = internalKeyNamePrefix + "keys"
+
+	// internalKeyNamePrefix starts the names of the keys this package stores for
+	// its own use under the key prefix, such as the key index
+	internalKeyNamePrefix = "__"
+)
+
+// internalKeySuffixes end the keys this package stores next to a value
+var internalKeySuffixes = []string{metadataKeySuffix, tombstoneKeySuffix, createdKeySuffix, fenceKeySuffix}
+
+// isInternalKey reports whether redisKey is one of the keys this package stores
+// for its own use, which are never listed. Lock keys aren't internal.
+func isInternalKey(redisKey string) bool {
+	for _, suffix := range internalKeySuffixes {
+		if strings.HasSuffix(redisKey, suffix) {
+			return true
+		}
+	}
+	return strings.HasPrefix(path.Base(redisKey), internalKeyNamePrefix)
+}
+
+// normalizeKey strips the trailing separators of key, so "acme/" and "acme" are
+// the same key. Every name and encryption derived from the key uses its normalized form.
+func normalizeKey(key string) string {
+	return strings.TrimRight(key, "/")
+}
+
+// trimListPrefix returns key relative to prefix, whose segments are split by
+// separator, and whether key is under prefix at all. Every key is under an empty
+// or wildcard prefix, while prefix itself and keys only sharing the beginning of
+// its last segment are not. Listing removes KeyPrefix from Redis keys and the
+// listed prefix from keys with it, on every node and read prefix alike.
+func trimListPrefix(key string, prefix string, separator string) (string, bool) {
+	prefix = strings.TrimRight(strings.TrimSpace(prefix), separator)
+	if prefix == "" || prefix == "*" {
+		return key, true
+	}
+	if !strings.HasPrefix(key, prefix+separator) {
+		return "", false
+	}
+	return key[len(prefix)+len(separator):], true
+}
+
+// redisKey returns the Redis key storing key under keyPrefix
+func (rd *RedisStorage) redisKey(keyPrefix string, key string) string {
+	key = normalizeKey(key)
+	var name string
+	if rd.EncryptKeys {
+		name = path.Join(keyPrefix, rd.opaqueKeyName(key))
+	} else {
+		name = path.Join(keyPrefix, rd.escapeKey(key))
+	}
+	if rd.HashTagKeys {
+		name += rd.hashTag(key)
+	}
+	return name
+}
+
+// hashTag returns the Redis Cluster hash tag appended to the Redis key of key when
+// HashTagKeys is enabled. It is derived from the directory of key, so the
+// certificate, private key and metadata certmagic stores side by side share it
+// and hash to the same slot.
+func (rd *RedisStorage) hashTag(key string) string {
+	dir := path.Dir(key)
+	if rd.EncryptKeys {
+		// a plain hash of the directory could be matched against domain names
+		mac := hmac.New(sha256.New, rd.deriveKey("caddy-tlsredis hash tags"))
+		mac.Write([]byte(dir))
+		return "{" + hex.EncodeToString(mac.Sum(nil)[:4]) + "}"
+	}
+	h := fnv.New32a()
+	h.Write([]byte(dir))
+	return fmt.Sprintf("{%08x}", h.Sum32())
+}
+
+// trimHashTag removes the hash tag added by hashTag from the Redis key name
+// redisKey, which may still end with a lock, metadata or tombstone suffix
+func (rd *RedisStorage) trimHashTag(redisKey string) string {
+	if !rd.HashTagKeys {
+		return redisKey
+	}
+	// the tag is the last thing appended before the suffixes, which contain no braces
+	start := strings.LastIndex(redisKey, "{")
+	if start < 0 {
+		return redisKey
+	}
+	end := strings.Index(redisKey[start:], "}")
+	if end < 0 {
+		return redisKey
+	}
+	return redisKey[:start] + redisKey[start+end+1:]
+}
+
+// escapeKey percent-encodes every segment of key when EscapeKeySegments is enabled,
+// so segments can't contain the separator or SCAN pattern characters
+func (rd *RedisStorage) escapeKey(key string) string {
+	if !rd.EscapeKeySegments {
+		return key
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escapeGlob escapes the characters of s which have a meaning in the patterns of
+// SCAN and KEYS, so the pattern s matches s itself only
+func escapeGlob(s string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// unescapeKey reverses escapeKey
+func (rd *RedisStorage) unescapeKey(key string) (string, error) {
+	if !rd.EscapeKeySegments {
+		return key, nil
+	}
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		unescaped, err := url.PathUnescape(segment)
+		if err != nil {
+			return "", err
+		}
+		segments[i] = unescaped
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// opaqueKeyName returns the name key is stored under when EncryptKeys is enabled
+func (rd *RedisStorage) opaqueKeyName(key string) string {
+	// don't use the AES key directly, so key names and values use distinct keys
+	mac := hmac.New(sha256.New, rd.deriveKey("caddy-tlsredis key names"))
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// keyIndex returns the Redis key of the index of the encrypted key names under keyPrefix
+func (rd *RedisStorage) keyIndex(keyPrefix string) string {
+	return path.Join(keyPrefix, keyIndexName)
+}
+
+// encryptKeyName returns key encrypted for the key index
+func (rd *RedisStorage) encryptKeyName(key string) (string, error) {
+	encrypted, err := rd.encrypt([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// decryptKeyName returns the key encrypted by encryptKeyName
+func (rd *RedisStorage) decryptKeyName(encrypted string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+	key, err := rd.decrypt(decoded)
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+// scanKeyIndex returns all keys in the key index of keyPrefix, prefixed with keyPrefix
+func (rd RedisStorage) scanKeyIndex(ctx context.Context, keyPrefix string) ([]string, error) {
+	var keys []string
+	index := rd.keyIndex(keyPrefix)
+	scanCount := rd.Tunables().ScanCount
+
+	if rd.ListConsistency == ListConsistencyKeys {
+		names, err := rd.clientFor(index).HVals(ctx, index).Result()
+		if err != nil {
+			return keys, err
+		}
+		for _, name := range names {
+			key, err := rd.decryptKeyName(name)
+			if err != nil {
+				return keys, fmt.Errorf("unable to decrypt key name: %v", err)
+			}
+			keys = append(keys, path.Join(keyPrefix, key))
+		}
+		return keys, nil
+	}
+
+	err := rd.iterateCursor(ctx, "scan of "+index, func(cursor uint64) ([]string, uint64, error) {
+		return rd.clientFor(index).HScan(ctx, index, cursor, "", scanCount).Result()
+	}, func(results []string) error {
+		// results alternate between the opaque name and the encrypted key name
+		for i := 1; i < len(results); i += 2 {
+			key, err := rd.decryptKeyName(results[i])
+			if err != nil {
+				return fmt.Errorf("unable to decrypt key name %s: %v", results[i-1], err)
+			}
+			keys = append(keys, path.Join(keyPrefix, key))
+		}
+		return nil
+	})
+	return keys, err
+}
@@ -0,0 +1,253 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_EncryptKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+	rd.EncryptKeys = true
+	rd.LightStat = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	crt := path.Join("certificates", "example.com", "example.com.crt")
+	key := path.Join("certificates", "example.com", "example.com.key")
+	assert.NoError(t, rd.Store(context.TODO(), crt, []byte("crt data")))
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("key data")))
+
+	// nothing in redis reveals the domain
+	mr.Select(9)
+	for _, redisKey := range mr.Keys() {
+		assert.False(t, strings.Contains(redisKey, "example.com"), redisKey)
+	}
+	fields, err := mr.HKeys(rd.keyIndex(TestPrefix))
+	assert.NoError(t, err)
+	for _, field := range fields {
+		assert.False(t, strings.Contains(mr.HGet(rd.keyIndex(TestPrefix), field), "example.com"))
+	}
+
+	assert.True(t, rd.Exists(context.TODO(), crt))
+	content, err := rd.Load(context.TODO(), crt)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), content)
+
+	info, err := rd.Stat(context.TODO(), crt)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("crt data")), info.Size)
+
+	keys, err := rd.List(context.TODO(), "certificates", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{crt, key}, keys)
+
+	keys, err = rd.List(context.TODO(), "certificates", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join("certificates", "example.com")}, keys)
+
+	assert.NoError(t, rd.Delete(context.TODO(), crt))
+	_, err = rd.Load(context.TODO(), crt)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	keys, err = rd.List(context.TODO(), "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+}
+
+func TestRedisStorage_EncryptKeysRequiresAESKey(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.EncryptKeys = true
+	rd.GetConfigValue()
+
+	assert.Error(t, rd.BuildRedisClient())
+}
+
+func TestRedisStorage_EscapeKeySegments(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.EscapeKeySegments = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	keys := []string{
+		path.Join("certificates", "a%2Fb", "a%2Fb.crt"),
+		path.Join("certificates", "a", "b", "b.crt"),
+		path.Join("certificates", "[x]*?", "x.crt"),
+	}
+	for _, key := range keys {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	}
+
+	// segments are encoded in redis
+	mr.Select(9)
+	assert.True(t, mr.Exists(path.Join(TestPrefix, "certificates", "a%252Fb", "a%252Fb.crt")))
+	assert.True(t, mr.Exists(path.Join(TestPrefix, "certificates", "%5Bx%5D%2A%3F", "x.crt")))
+
+	found, err := rd.List(context.TODO(), "certificates", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, found)
+
+	found, err = rd.List(context.TODO(), "certificates", false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		path.Join("certificates", "a%2Fb"),
+		path.Join("certificates", "a"),
+		path.Join("certificates", "[x]*?"),
+	}, found)
+
+	// pattern characters in the prefix are matched literally
+	found, err = rd.List(context.TODO(), path.Join("certificates", "[x]*?"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join("certificates", "[x]*?", "x.crt")}, found)
+
+	content, err := rd.Load(context.TODO(), path.Join("certificates", "a%2Fb", "a%2Fb.crt"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), content)
+}
+
+// hashSlot returns the Redis Cluster slot of redisKey: the CRC16 of its hash tag,
+// or of the whole key without one, modulo 16384
+func hashSlot(redisKey string) uint16 {
+	if start := strings.Index(redisKey, "{"); start >= 0 {
+		if end := strings.Index(redisKey[start+1:], "}"); end > 0 {
+			redisKey = redisKey[start+1 : start+1+end]
+		}
+	}
+	var crc uint16
+	for i := 0; i < len(redisKey); i++ {
+		crc ^= uint16(redisKey[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc % 16384
+}
+
+func TestHashSlot(t *testing.T) {
+	// examples from the Redis Cluster specification
+	assert.Equal(t, uint16(0x31c3%16384), hashSlot("123456789"))
+	assert.Equal(t, hashSlot("user1000"), hashSlot("{user1000}.following"))
+	assert.Equal(t, hashSlot("{user1000}.following"), hashSlot("{user1000}.followers"))
+}
+
+func TestTrimListPrefix(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		key       string
+		prefix    string
+		separator string
+		rel       string
+		ok        bool
+	}{
+		{"empty prefix", "acme/example.com/example.com.crt", "", "/", "acme/example.com/example.com.crt", true},
+		{"blank prefix", "acme/example.com/example.com.crt", "   ", "/", "acme/example.com/example.com.crt", true},
+		{"wildcard", "acme/example.com/example.com.crt", "*", "/", "acme/example.com/example.com.crt", true},
+		{"direct child", "acme/example.com", "acme", "/", "example.com", true},
+		{"nested key", "caddytls/acme/example.com/example.com.crt", "caddytls", "/", "acme/example.com/example.com.crt", true},
+		{"nested prefix", "caddytls/acme/example.com/example.com.crt", "caddytls/acme", "/", "example.com/example.com.crt", true},
+		{"trailing separator", "acme/example.com", "acme/", "/", "example.com", true},
+		{"prefix itself", "acme/example.com", "acme/example.com", "/", "", false},
+		{"partial segment", "acme/example.com.crt", "acme/example", "/", "", false},
+		{"other prefix", "other/acme/example.com", "caddytls", "/", "", false},
+		{"custom separator", "caddytls:acme:example.com", "caddytls", ":", "acme:example.com", true},
+		{"custom separator mismatch", "caddytls/acme", "caddytls", ":", "", false},
+		{"multi-character separator", "caddytls::acme::example.com", "caddytls::", "::", "acme::example.com", true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rel, ok := trimListPrefix(tt.key, tt.prefix, tt.separator)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.rel, rel)
+		})
+	}
+}
+
+func TestEscapeGlob(t *testing.T) {
+	assert.Equal(t, "caddytls/acme/example.com", escapeGlob("caddytls/acme/example.com"))
+	assert.Equal(t, `caddytls/\*.example.com/\[a-z\]\?\\`, escapeGlob(`caddytls/*.example.com/[a-z]?\`))
+}
+
+func TestRedisStorage_HashTagKeys(t *testing.T) {
+	for _, encryptKeys := range []bool{false, true} {
+		mr := miniredis.RunT(t)
+		rd := new(RedisStorage)
+		rd.HashTagKeys = true
+		rd.EncryptKeys = encryptKeys
+		rd.AesKey = "redistls-01234567890-caddytls-32"
+		rd.LightStat = true
+		rd = setupRedisEnvWithStorage(t, mr, rd)
+
+		dir := path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com")
+		siblings := []string{
+			path.Join(dir, "example.com.crt"),
+			path.Join(dir, "example.com.key"),
+			path.Join(dir, "example.com.json"),
+		}
+		slot := hashSlot(rd.prefixKey(siblings[0]))
+		for _, key := range siblings {
+			assert.NoError(t, rd.Store(context.TODO(), key, []byte("data")))
+			assert.Equal(t, slot, hashSlot(rd.prefixKey(key)), key)
+			assert.Equal(t, slot, hashSlot(rd.metadataKey(key)), key)
+			assert.Equal(t, slot, hashSlot(rd.prefixKey(key)+lockKeySuffix), key)
+		}
+		other := path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.net", "example.net.crt")
+		assert.NotEqual(t, rd.hashTag(siblings[0]), rd.hashTag(other))
+
+		assert.NoError(t, rd.Lock(context.TODO(), siblings[0]))
+		keys, err := rd.List(context.TODO(), "certificates", true)
+		assert.NoError(t, err)
+		if encryptKeys {
+			assert.ElementsMatch(t, siblings, keys)
+		} else {
+			assert.ElementsMatch(t, append(siblings, siblings[0]+lockKeySuffix), keys)
+		}
+		assert.NoError(t, rd.Unlock(context.TODO(), siblings[0]))
+
+		content, err := rd.Load(context.TODO(), siblings[1])
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("data"), content)
+	}
+}
+
+func TestRedisStorage_TrailingSlash(t *testing.T) {
+	options := map[string]func(rd *RedisStorage){
+		"default":       func(rd *RedisStorage) {},
+		"encrypt keys":  func(rd *RedisStorage) { rd.EncryptKeys = true },
+		"hash tags":     func(rd *RedisStorage) { rd.HashTagKeys = true },
+		"deterministic": func(rd *RedisStorage) { rd.DeterministicEncryption = true },
+		"escape":        func(rd *RedisStorage) { rd.EscapeKeySegments = true },
+	}
+	for name, option := range options {
+		t.Run(name, func(t *testing.T) {
+			rd := new(RedisStorage)
+			rd.AesKey = "redistls-01234567890-caddytls-32"
+			option(rd)
+			rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+			for stored, read := range map[string]string{"acme/foo": "acme/foo/", "acme/bar/": "acme/bar"} {
+				assert.NoError(t, rd.Store(context.TODO(), stored, []byte(stored)))
+
+				value, err := rd.Load(context.TODO(), read)
+				assert.NoError(t, err, read)
+				assert.Equal(t, []byte(stored), value, read)
+				assert.True(t, rd.Exists(context.TODO(), read), read)
+				info, err := rd.Stat(context.TODO(), read)
+				assert.NoError(t, err, read)
+				assert.Equal(t, int64(len(stored)), info.Size, read)
+
+				assert.NoError(t, rd.Delete(context.TODO(), read), read)
+				assert.False(t, rd.Exists(context.TODO(), stored), stored)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+)
+
+// listFixture is stored in both the filesystem and Redis storage to compare their List results
+var listFixture = []string{
+	"acme/acme-v02.api.letsencrypt.org-directory/users/admin@example.com/admin.json",
+	"acme/acme-v02.api.letsencrypt.org-directory/users/admin@example.com/admin.key",
+	"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt",
+	"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.json",
+	"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.key",
+	"certificates/acme-v02.api.letsencrypt.org-directory/example.com.au/example.com.au.crt",
+	"certificates/acme-v02.api.letsencrypt.org-directory/example.com-old/example.com-old.crt",
+	"ocsp/example.com-1234",
+	"last_clean.json",
+}
+
+func TestRedisStorage_ListFilesystemOrder(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.ListOrder = ListOrderFilesystem
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+	fs := &certmagic.FileStorage{Path: t.TempDir()}
+
+	for _, key := range listFixture {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte(key)))
+		assert.NoError(t, fs.Store(context.TODO(), key, []byte(key)))
+	}
+
+	for _, prefix := range []string{"", "acme", "certificates", "certificates/acme-v02.api.letsencrypt.org-directory", "ocsp"} {
+		for _, recursive := range []bool{true, false} {
+			expected, err := fs.List(context.TODO(), prefix, recursive)
+			assert.NoError(t, err)
+
+			keys, err := rd.List(context.TODO(), prefix, recursive)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, keys, "prefix %q, recursive %v", prefix, recursive)
+		}
+	}
+}
+
+// scanWithCursors makes the SCAN command of mr reply with the given cursors in turn,
+// each along with key, then reply with the last one forever
+func scanWithCursors(mr *miniredis.Miniredis, key string, cursors ...string) {
+	var mu sync.Mutex
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "SCAN" {
+			return false
+		}
+
+		mu.Lock()
+		cursor := cursors[0]
+		if len(cursors) > 1 {
+			cursors = cursors[1:]
+		}
+		mu.Unlock()
+
+		c.WriteLen(2)
+		c.WriteBulk(cursor)
+		c.WriteStrings([]string{key})
+		return true
+	})
+}
+
+func TestRedisStorage_ListLargeCursor(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	scanWithCursors(mr, TestPrefix+"/acme/example.com", "18446744073709551615", "9223372036854775808", "0")
+
+	keys, err := rd.List(context.TODO(), "acme", true)
+	assert.NoError(t, err)
+	// returned by every SCAN call, but listed once
+	assert.Equal(t, []string{"acme/example.com"}, keys)
+}
+
+func TestRedisStorage_ListCursorNeverZero(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.MaxScanIterations = 10
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	scanWithCursors(mr, TestPrefix+"/acme/example.com", "18446744073709551615")
+
+	_, err := rd.List(context.TODO(), "acme", true)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "did not complete after 10 iterations")
+}
+
+func TestRedisStorage_ListPrefixes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	for _, key := range []string{
+		"certificates/example.com/example.com.crt",
+		"certificates/example.com/example.com.key",
+		"certificates/example.com-old/example.com-old.crt",
+		"certificates/*.example.com/*.example.com.crt",
+		"ocsp/example.com-1234",
+	} {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte(key)))
+	}
+	var scans []string
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "SCAN" {
+			scans = append(scans, args[2])
+		}
+		return false
+	})
+
+	for _, tt := range []struct {
+		prefix    string
+		recursive bool
+		keys      []string
+	}{
+		{"", true, []string{
+			"certificates/*.example.com/*.example.com.crt",
+			"certificates/example.com-old/example.com-old.crt",
+			"certificates/example.com/example.com.crt",
+			"certificates/example.com/example.com.key",
+			"ocsp/example.com-1234",
+		}},
+		{"*", false, []string{
+			"certificates/*.example.com/*.example.com.crt",
+			"certificates/example.com-old/example.com-old.crt",
+			"certificates/example.com/example.com.crt",
+			"certificates/example.com/example.com.key",
+			"ocsp/example.com-1234",
+		}},
+		{"certificates", true, []string{
+			"certificates/*.example.com/*.example.com.crt",
+			"certificates/example.com-old/example.com-old.crt",
+			"certificates/example.com/example.com.crt",
+			"certificates/example.com/example.com.key",
+		}},
+		{"certificates", false, []string{
+			"certificates/*.example.com",
+			"certificates/example.com",
+			"certificates/example.com-old",
+		}},
+		// keys only sharing the beginning of the last segment aren't under prefix
+		{"certificates/example.com", false, []string{
+			"certificates/example.com/example.com.crt",
+			"certificates/example.com/example.com.key",
+		}},
+		// pattern characters are matched literally
+		{"certificates/*.example.com", true, []string{
+			"certificates/*.example.com/*.example.com.crt",
+		}},
+	} {
+		scans = nil
+		keys, err := rd.List(context.TODO(), tt.prefix, tt.recursive)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, tt.keys, keys, "prefix %q, recursive %v", tt.prefix, tt.recursive)
+		// a single SCAN, the keys fitting in one batch, matching only keys under the prefixes
+		assert.Len(t, scans, 1, tt.prefix)
+	}
+	assert.Equal(t, []string{TestPrefix + `/certificates/\*.example.com*`}, scans)
+}
+
+func TestRedisStorage_ListEmptyBatches(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	assert.NoError(t, rd.Store(context.TODO(), "acme/example.com", []byte("acme")))
+
+	// SCAN may return no keys while the iteration isn't over yet
+	var mu sync.Mutex
+	cursors := []string{"17", "42", "0"}
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if cmd != "SCAN" || len(cursors) == 0 {
+			return false
+		}
+		c.WriteLen(2)
+		c.WriteBulk(cursors[0])
+		if cursors[0] == "0" {
+			c.WriteStrings([]string{TestPrefix + "/acme/example.com"})
+		} else {
+			c.WriteStrings(nil)
+		}
+		cursors = cursors[1:]
+		return true
+	})
+
+	keys, err := rd.List(context.TODO(), "acme", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"acme/example.com"}, keys)
+	assert.Empty(t, cursors)
+}
+
+func TestRedisStorage_ScanCount(t *testing.T) {
+	mr := miniredis.RunT(t)
+	var stored []string
+	for i := 0; i < 25; i++ {
+		stored = append(stored, fmt.Sprintf("certificates/example%d.com/example%d.com.crt", i, i))
+	}
+
+	for _, scanCount := range []int64{1, 7, 1000} {
+		rd := &RedisStorage{ScanCount: scanCount}
+		rd = setupRedisEnvWithStorage(t, mr, rd)
+		assert.Equal(t, scanCount, rd.Tunables().ScanCount)
+		for _, key := range stored {
+			assert.NoError(t, rd.Store(context.TODO(), key, []byte(key)))
+		}
+		var mu sync.Mutex
+		var scans int
+		mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+			if cmd == "SCAN" {
+				mu.Lock()
+				scans++
+				mu.Unlock()
+				assert.Equal(t, strconv.FormatInt(scanCount, 10), args[4])
+			}
+			return false
+		})
+
+		// the listing is complete whatever the size of the batches
+		keys, err := rd.List(context.TODO(), "certificates", true)
+		mr.Server().SetPreHook(nil)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, stored, keys, "scan count %d", scanCount)
+		// at least a batch per key with a count of 1
+		assert.GreaterOrEqual(t, scans, len(stored)/int(scanCount))
+	}
+
+	os.Setenv(EnvNameScanCount, "500")
+	defer os.Unsetenv(EnvNameScanCount)
+	rd := setupRedisEnvWithServer(t, mr)
+	assert.Equal(t, int64(500), rd.Tunables().ScanCount)
+
+	rd = &RedisStorage{ScanCount: -1, Address: mr.Addr()}
+	rd.GetConfigValue()
+	err := rd.BuildRedisClient()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "scan count must be positive")
+}
+
+func TestRedisStorage_ListInternalKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	key := "certificates/example.com/example.com.crt"
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	// keys the package stores for itself, now or in a later version
+	mr.Select(9)
+	for _, internal := range []string{
+		rd.metadataKey(key),
+		rd.tombstoneKey(key),
+		rd.keyIndex(TestPrefix),
+		TestPrefix + "/__tlsredis_schema",
+		TestPrefix + "/certificates/__counter",
+	} {
+		assert.NoError(t, mr.Set(internal, "internal"))
+	}
+
+	keys, err := rd.List(context.TODO(), "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	keys, err = rd.List(context.TODO(), "certificates", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"certificates/example.com"}, keys)
+
+	keys, err = rd.ListLeaves(context.TODO(), "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	keys = nil
+	assert.NoError(t, rd.ListFunc(context.TODO(), "", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{key}, keys)
+
+	keys, err = rd.ListModifiedSince(context.TODO(), "", time.Time{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+}
+
+func TestRedisStorage_ListNamespace(t *testing.T) {
+	mr := miniredis.RunT(t)
+	a := new(RedisStorage)
+	a.Namespace = "tenant-a"
+	a = setupRedisEnvWithStorage(t, mr, a)
+	b := &RedisStorage{Namespace: "tenant-b"}
+	b.GetConfigValue()
+	assert.NoError(t, b.BuildRedisClient())
+	t.Cleanup(func() {
+		b.Cleanup()
+		b.Client.Close()
+	})
+
+	assert.NoError(t, a.Store(context.TODO(), "certificates/a.example.com/a.example.com.crt", []byte("a")))
+	assert.NoError(t, b.Store(context.TODO(), "certificates/b.example.com/b.example.com.crt", []byte("b")))
+
+	for _, prefix := range []string{"", "*", "certificates"} {
+		keys, err := a.List(context.TODO(), prefix, true)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"certificates/a.example.com/a.example.com.crt"}, keys, prefix)
+	}
+	assert.False(t, a.Exists(context.TODO(), "certificates/b.example.com/b.example.com.crt"))
+
+	b.Namespace = "tenant/b"
+	assert.Error(t, b.BuildRedisClient())
+}
@@ -0,0 +1,86 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// lockTokenSize is the size of the random token redislock starts lock values with
+	lockTokenSize = 22
+
+	// lockOwnerIDSize is the size of the ID of the instance holding a lock, which
+	// follows the token, see newLockSet
+	lockOwnerIDSize = 16
+
+	// lockAcquiredSeparator ends the lock metadata, before the acquisition time
+	// recorded with LockRecordAcquired
+	lockAcquiredSeparator = "@"
+)
+
+// LockInfo describes a lock as stored in Redis
+type LockInfo struct {
+	// Owner is the LockOwner of the instance holding the lock
+	Owner string
+
+	// Acquired is when the lock was obtained, zero unless its holder has
+	// LockRecordAcquired set
+	Acquired time.Time
+
+	// TTL is how long the lock is still held for unless refreshed
+	TTL time.Duration
+}
+
+// LockInfo returns who holds the lock of key and since when, or fs.ErrNotExist
+// if key isn't locked.
+func (rd *RedisStorage) LockInfo(ctx context.Context, key string) (LockInfo, error) {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	info, err := rd.lockInfo(opCtx, key)
+	return info, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd *RedisStorage) lockInfo(ctx context.Context, key string) (LockInfo, error) {
+	lockName := rd.prefixKey(key) + lockKeySuffix
+	var value *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := rd.clientFor(lockName).Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		value = pipe.Get(ctx, lockName)
+		ttl = pipe.PTTL(ctx, lockName)
+		return nil
+	})
+	if err == redis.Nil {
+		return LockInfo{}, fs.ErrNotExist
+	} else if err != nil {
+		return LockInfo{}, fmt.Errorf("unable to obtain lock of %s: %w", key, err)
+	}
+
+	info := parseLockValue(value.Val())
+	info.TTL = ttl.Val()
+	return info, nil
+}
+
+// parseLockValue returns the owner and acquisition time recorded in the value of
+// a lock, a random token followed by the ID of the instance holding it, its
+// LockOwner and, with LockRecordAcquired, the time it was obtained. They are part
+// of the value redislock sets, so they are recorded atomically with the lock.
+func parseLockValue(value string) LockInfo {
+	if len(value) < lockTokenSize+lockOwnerIDSize {
+		return LockInfo{}
+	}
+	metadata := value[lockTokenSize+lockOwnerIDSize:]
+
+	if i := strings.LastIndex(metadata, lockAcquiredSeparator); i >= 0 {
+		if acquired, err := time.Parse(time.RFC3339Nano, metadata[i+len(lockAcquiredSeparator):]); err == nil {
+			return LockInfo{Owner: metadata[:i], Acquired: acquired}
+		}
+	}
+	return LockInfo{Owner: metadata}
+}
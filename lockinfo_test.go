@@ -0,0 +1,81 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_LockInfo(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.LockOwner = "caddy@node1"
+	rd.LockRecordAcquired = true
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+	key := path.Join("certificates", "example.com")
+
+	_, err := rd.LockInfo(context.TODO(), key)
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "%v", err)
+
+	before := time.Now()
+	assert.NoError(t, rd.Lock(context.TODO(), key))
+	info, err := rd.LockInfo(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, "caddy@node1", info.Owner)
+	assert.False(t, info.Acquired.Before(before.Truncate(time.Microsecond)), "acquired: %v", info.Acquired)
+	assert.False(t, info.Acquired.After(time.Now()), "acquired: %v", info.Acquired)
+	assert.True(t, info.TTL > 0 && info.TTL <= rd.Tunables().LockTimeout, "ttl: %v", info.TTL)
+	assert.NoError(t, rd.Unlock(context.TODO(), key))
+
+	// without the acquisition time
+	rd.LockRecordAcquired = false
+	assert.NoError(t, rd.Lock(context.TODO(), key))
+	info, err = rd.LockInfo(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, "caddy@node1", info.Owner)
+	assert.True(t, info.Acquired.IsZero())
+	assert.NoError(t, rd.Unlock(context.TODO(), key))
+}
+
+func TestRedisStorage_LockInfoAtomic(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.LockOwner = "caddy"
+	rd.LockRecordAcquired = true
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+	key := path.Join("certificates", "example.com")
+
+	// the lock is never seen without its owner and acquisition time
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			info, err := rd.LockInfo(context.TODO(), key)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, "caddy", info.Owner)
+			assert.False(t, info.Acquired.IsZero())
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, rd.Lock(context.TODO(), key))
+		assert.NoError(t, rd.Unlock(context.TODO(), key))
+	}
+	close(done)
+	wg.Wait()
+}
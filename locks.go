@@ -0,0 +1,163 @@
+package storageredis
+
+import (
+	"container/heap"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+)
+
+// lockSet holds the locks obtained by one instance, keyed by the key they lock.
+// Building the client again retires the previous set, so refresh goroutines left
+// over from before stop instead of acting on the locks of the new instance.
+type lockSet struct {
+	sync.Map
+
+	// owner uniquely identifies the instance holding these locks, it starts the
+	// metadata of their tokens in Redis
+	owner   string
+	retired int32
+
+	// fences holds the heldFence of the locks obtained with LockFencing, by key
+	fences sync.Map
+}
+
+// newLockSet returns an empty lockSet with a new unique owner
+func newLockSet() *lockSet {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return &lockSet{owner: hex.EncodeToString(id)}
+}
+
+// retire marks the locks as belonging to a previous instance
+func (l *lockSet) retire() {
+	atomic.StoreInt32(&l.retired, 1)
+}
+
+// owns reports whether lock is the lock the current instance holds for key
+func (l *lockSet) owns(key string, lock *redislock.Lock) bool {
+	if atomic.LoadInt32(&l.retired) == 1 || !l.issued(lock) {
+		return false
+	}
+	current, exists := l.Load(key)
+	return exists && current == lock
+}
+
+// issued reports whether lock was obtained by the owner of l
+func (l *lockSet) issued(lock *redislock.Lock) bool {
+	return strings.HasPrefix(lock.Metadata(), l.owner)
+}
+
+// heldLock is a lock kept fresh by a lockRefresher
+type heldLock struct {
+	locks     *lockSet
+	key       string
+	lock      *redislock.Lock
+	next      time.Time
+	refreshes int
+}
+
+// heldLocks is a min-heap of held locks ordered by their next refresh
+type heldLocks []*heldLock
+
+func (h heldLocks) Len() int            { return len(h) }
+func (h heldLocks) Less(i, j int) bool  { return h[i].next.Before(h[j].next) }
+func (h heldLocks) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *heldLocks) Push(x interface{}) { *h = append(*h, x.(*heldLock)) }
+func (h *heldLocks) Pop() interface{} {
+	old := *h
+	held := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return held
+}
+
+// lockRefresher keeps all the locks held by an instance fresh from a single
+// goroutine, refreshing each when it is due, rather than one goroutine per lock
+type lockRefresher struct {
+	mu   sync.Mutex
+	held heldLocks
+	// wake interrupts the wait for the next refresh when a lock is added
+	wake chan struct{}
+}
+
+func newLockRefresher() *lockRefresher {
+	return &lockRefresher{wake: make(chan struct{}, 1)}
+}
+
+// add schedules the refresh of lock, held for key in locks, after interval
+func (r *lockRefresher) add(locks *lockSet, key string, lock *redislock.Lock, interval time.Duration) {
+	r.mu.Lock()
+	heap.Push(&r.held, &heldLock{locks: locks, key: key, lock: lock, next: time.Now().Add(interval)})
+	r.mu.Unlock()
+
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// due removes and returns the locks whose refresh is due, and how long until the
+// next one is otherwise
+func (r *lockRefresher) due(now time.Time) ([]*heldLock, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var due []*heldLock
+	for len(r.held) > 0 && !r.held[0].next.After(now) {
+		due = append(due, heap.Pop(&r.held).(*heldLock))
+	}
+	if len(r.held) == 0 {
+		return due, time.Hour
+	}
+	return due, r.held[0].next.Sub(now)
+}
+
+// reschedule adds back held, to be refreshed again after interval
+func (r *lockRefresher) reschedule(held *heldLock, interval time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	held.next = time.Now().Add(interval)
+	heap.Push(&r.held, held)
+}
+
+// count returns the number of locks kept fresh
+func (r *lockRefresher) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.held)
+}
+
+// lockReleasedSuffix is appended to the name of a lock to get the pub/sub channel
+// its release is published on, see LockNotifications
+const lockReleasedSuffix = ".released"
+
+// subscribeLockReleased subscribes to the releases of the lock of key, returning
+// once the subscription is confirmed so no release published afterwards is missed
+func (rd *RedisStorage) subscribeLockReleased(ctx context.Context, key string) (*redis.PubSub, error) {
+	lockName := rd.prefixKey(key) + lockKeySuffix
+	sub := rd.shardFor(lockName).client.Subscribe(ctx, lockName+lockReleasedSuffix)
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+// publishLockReleased wakes up the instances waiting for the lock of key, unless
+// LockNotifications is disabled. They poll for it otherwise, so a failure is only logged.
+func (rd *RedisStorage) publishLockReleased(ctx context.Context, key string) {
+	if !rd.LockNotifications {
+		return
+	}
+	lockName := rd.prefixKey(key) + lockKeySuffix
+	if err := rd.shardFor(lockName).client.Publish(ctx, lockName+lockReleasedSuffix, key).Err(); err != nil {
+		rd.Logger.Warnf("[WARNING] Unable to publish the release of lock: %v (key: %s)", err, key)
+	}
+}
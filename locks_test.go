@@ -0,0 +1,76 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_LockRefresher(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	assert.NoError(t, rd.UpdateTunables(Tunables{
+		LockTimeout:         200 * time.Millisecond,
+		LockRefreshInterval: 20 * time.Millisecond,
+	}))
+
+	goroutines := runtime.NumGoroutine()
+	keys := make([]string, 100)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("lock%d", i)
+		assert.NoError(t, rd.Lock(context.TODO(), keys[i]))
+	}
+	// a single goroutine refreshes every lock, give or take the connections
+	// miniredis serves
+	assert.Less(t, runtime.NumGoroutine(), goroutines+len(keys)/10)
+	assert.Eventually(t, func() bool {
+		return rd.refresher.count() == len(keys)
+	}, time.Second, time.Millisecond)
+
+	// well past the lock timeout, the locks are still held
+	mr.Select(9)
+	for i := 0; i < 10; i++ {
+		time.Sleep(50 * time.Millisecond)
+		mr.FastForward(50 * time.Millisecond)
+	}
+	for _, key := range keys {
+		assert.True(t, mr.Exists(rd.prefixKey(key)+lockKeySuffix), key)
+	}
+
+	for _, key := range keys {
+		assert.NoError(t, rd.Unlock(context.TODO(), key))
+	}
+	// released locks are dropped when they come due
+	assert.Eventually(t, func() bool {
+		return rd.refresher.count() == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func BenchmarkRedisStorage_Locks(b *testing.B) {
+	rd := setupRedisEnvWithServer(b, miniredis.RunT(b))
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("lock%d", i)
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		goroutines := runtime.NumGoroutine()
+		for _, key := range keys {
+			if err := rd.Lock(context.TODO(), key); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(runtime.NumGoroutine()-goroutines), "goroutines/1000locks")
+		for _, key := range keys {
+			if err := rd.Unlock(context.TODO(), key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+// instrumentationName is the name the instruments are created under
+const instrumentationName = "github.com/webappio/caddy-tlsredis"
+
+// operationMetrics are the instruments Store, Load, Delete, List and Lock are
+// recorded with when MeterProvider is set
+type operationMetrics struct {
+	operations metric.Int64Counter
+	duration   metric.Float64Histogram
+}
+
+// newOperationMetrics creates the instruments with a meter of provider
+func newOperationMetrics(provider metric.MeterProvider) (*operationMetrics, error) {
+	meter := provider.Meter(instrumentationName)
+	operations, err := meter.Int64Counter("caddy_tlsredis.operations",
+		metric.WithDescription("Storage operations, by operation and result"))
+	if err != nil {
+		return nil, err
+	}
+	duration, err := meter.Float64Histogram("caddy_tlsredis.operation.duration",
+		metric.WithDescription("Duration of storage operations, by operation and result"),
+		metric.WithUnit("ms"))
+	if err != nil {
+		return nil, err
+	}
+	return &operationMetrics{operations: operations, duration: duration}, nil
+}
+
+// operationResult returns the result label of an operation which returned err
+func operationResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, fs.ErrNotExist):
+		return "not_found"
+	default:
+		return "error"
+	}
+}
+
+// recordOperation records the operation op, started at start, which returned
+// err. It does nothing unless MeterProvider or MetricsEnabled is set.
+func (rd RedisStorage) recordOperation(ctx context.Context, op string, start time.Time, err error) {
+	if rd.prometheus != nil {
+		rd.prometheus.record(op, start, err)
+	}
+	if rd.metrics == nil {
+		return
+	}
+	attributes := metric.WithAttributes(
+		attribute.String("operation", op),
+		attribute.String("result", operationResult(err)),
+	)
+	rd.metrics.operations.Add(ctx, 1, attributes)
+	rd.metrics.duration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond), attributes)
+}
@@ -0,0 +1,103 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestRedisStorage_Metrics(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	rd := new(RedisStorage)
+	rd.MeterProvider = sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	_, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	_, err = rd.Load(context.TODO(), path.Join("certificates", "missing"))
+	assert.Error(t, err)
+
+	var collected metricdata.ResourceMetrics
+	assert.NoError(t, reader.Collect(context.TODO(), &collected))
+	operations := make(map[string]int64)
+	durations := 0
+	for _, scope := range collected.ScopeMetrics {
+		assert.Equal(t, instrumentationName, scope.Scope.Name)
+		for _, measured := range scope.Metrics {
+			switch data := measured.Data.(type) {
+			case metricdata.Sum[int64]:
+				assert.Equal(t, "caddy_tlsredis.operations", measured.Name)
+				for _, point := range data.DataPoints {
+					operations[operationOf(point.Attributes)] += point.Value
+				}
+			case metricdata.Histogram[float64]:
+				assert.Equal(t, "caddy_tlsredis.operation.duration", measured.Name)
+				for _, point := range data.DataPoints {
+					assert.True(t, point.Sum >= 0, operationOf(point.Attributes))
+					durations += int(point.Count)
+				}
+			default:
+				t.Errorf("unexpected metric %v", measured.Name)
+			}
+		}
+	}
+	assert.Equal(t, map[string]int64{"Store ok": 1, "Load ok": 1, "Load not_found": 1}, operations)
+	assert.Equal(t, 3, durations)
+}
+
+// operationOf returns the operation and result attributes of a data point
+func operationOf(attributes attribute.Set) string {
+	op, _ := attributes.Value("operation")
+	result, _ := attributes.Value("result")
+	return op.AsString() + " " + result.AsString()
+}
+
+func TestRedisStorage_PrometheusMetrics(t *testing.T) {
+	mr := miniredis.RunT(t)
+	registry := prometheus.NewRegistry()
+	rd := new(RedisStorage)
+	rd.MetricsEnabled = true
+	rd.MetricsRegisterer = registry
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	_, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	_, err = rd.Load(context.TODO(), path.Join("certificates", "missing"))
+	assert.Error(t, err)
+	assert.NoError(t, rd.Lock(context.TODO(), key))
+	assert.NoError(t, rd.Unlock(context.TODO(), key))
+
+	metrics := rd.prometheus
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.operations.WithLabelValues("Store")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(metrics.operations.WithLabelValues("Load")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.operations.WithLabelValues("Lock")))
+	// a missing key isn't an error
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.errors.WithLabelValues("Load")))
+
+	// another instance, or building the client again, records to the same metrics
+	other := new(RedisStorage)
+	other.MetricsEnabled = true
+	other.MetricsRegisterer = registry
+	other = setupRedisEnvWithStorage(t, mr, other)
+	assert.Same(t, metrics, other.prometheus)
+
+	mr.Close()
+	assert.Error(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.errors.WithLabelValues("Store")))
+
+	count, err := testutil.GatherAndCount(registry, "caddy_tlsredis_operation_duration_seconds", "caddy_tlsredis_lock_wait_seconds")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+}
@@ -0,0 +1,42 @@
+package storageredis
+
+import (
+	"path"
+	"time"
+)
+
+// EntryPolicy is how the value of a key is stored
+type EntryPolicy struct {
+	// TTL expires the value after it is stored, 0 for no expiration
+	TTL time.Duration
+
+	// SlidingTTL resets the TTL of the value every time it is loaded, with GETEX,
+	// so only values not loaded for TTL expire. It requires Redis 6.2.
+	SlidingTTL bool
+
+	// DeterministicEncryption encrypts the value as RedisStorage.DeterministicEncryption
+	// does, when AesKey is set. Values are read whichever way they were encrypted.
+	DeterministicEncryption bool
+}
+
+// DefaultPolicy returns the policy of key set by TTLPatterns and DeterministicEncryption,
+// the one used unless PolicyFunc is set
+func (rd RedisStorage) DefaultPolicy(key string) EntryPolicy {
+	policy := EntryPolicy{DeterministicEncryption: rd.DeterministicEncryption}
+	for _, pattern := range rd.TTLPatterns {
+		if matched, _ := path.Match(pattern.Pattern, key); matched {
+			policy.TTL = time.Duration(pattern.TTL)
+			policy.SlidingTTL = pattern.Sliding
+			break
+		}
+	}
+	return policy
+}
+
+// policy returns the policy the value of key is stored with
+func (rd RedisStorage) policy(key string) EntryPolicy {
+	if rd.PolicyFunc != nil {
+		return rd.PolicyFunc(key)
+	}
+	return rd.DefaultPolicy(key)
+}
@@ -0,0 +1,85 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_PolicyFunc(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+	rd.PolicyFunc = func(key string) EntryPolicy {
+		switch {
+		case strings.HasPrefix(key, "ocsp/"):
+			return EntryPolicy{TTL: time.Hour, DeterministicEncryption: true}
+		case strings.HasSuffix(key, ".json"):
+			return EntryPolicy{TTL: 24 * time.Hour}
+		}
+		return rd.DefaultPolicy(key)
+	}
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	mr.Select(9)
+
+	staple := path.Join("ocsp", "example.com-ocsp")
+	metadata := path.Join("certificates", "acme", "example.com", "example.com.json")
+	crt := path.Join("certificates", "acme", "example.com", "example.com.crt")
+	for _, key := range []string{staple, metadata, crt} {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte(key)))
+		value, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(key), value)
+	}
+
+	assert.Equal(t, time.Hour, mr.TTL(rd.prefixKey(staple)))
+	assert.Equal(t, 24*time.Hour, mr.TTL(rd.prefixKey(metadata)))
+	assert.Equal(t, time.Duration(0), mr.TTL(rd.prefixKey(crt)))
+
+	stored, err := mr.Get(rd.prefixKey(staple))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(stored, deterministicMarker))
+	stored, err = mr.Get(rd.prefixKey(crt))
+	assert.NoError(t, err)
+	assert.False(t, strings.HasPrefix(stored, deterministicMarker))
+}
+
+func TestRedisStorage_SlidingTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.TTLPatterns = []TTLPattern{
+		{Pattern: "ocsp/*", TTL: Duration(time.Hour), Sliding: true},
+		{Pattern: "certificates/*/*", TTL: Duration(time.Hour)},
+	}
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	mr.Select(9)
+
+	staple := path.Join("ocsp", "example.com-ocsp")
+	crt := path.Join("certificates", "example.com", "example.com.crt")
+	for _, key := range []string{staple, crt} {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte(key)))
+	}
+
+	mr.FastForward(30 * time.Minute)
+	for _, key := range []string{staple, crt} {
+		value, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(key), value)
+	}
+	assert.Equal(t, time.Hour, mr.TTL(rd.prefixKey(staple)))
+	assert.Equal(t, time.Hour, mr.TTL(rd.createdKey(staple)))
+	assert.Equal(t, 30*time.Minute, mr.TTL(rd.prefixKey(crt)))
+
+	mr.FastForward(45 * time.Minute)
+	_, err := rd.Load(context.TODO(), staple)
+	assert.NoError(t, err)
+	_, err = rd.Load(context.TODO(), crt)
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "%v", err)
+}
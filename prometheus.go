@@ -0,0 +1,96 @@
+package storageredis
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// prometheusNamespace prefixes the names of the Prometheus metrics
+const prometheusNamespace = "caddy_tlsredis"
+
+// prometheusMetrics is the prometheus.Collector of the metrics recorded when
+// MetricsEnabled is set
+type prometheusMetrics struct {
+	operations *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+	duration   *prometheus.HistogramVec
+	lockWait   prometheus.Histogram
+}
+
+func newPrometheusMetrics() *prometheusMetrics {
+	return &prometheusMetrics{
+		operations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "operations_total",
+			Help:      "Storage operations, by operation.",
+		}, []string{"operation"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      "operation_errors_total",
+			Help:      "Storage operations which failed, other than with a missing key, by operation.",
+		}, []string{"operation"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of storage operations, by operation.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		lockWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      "lock_wait_seconds",
+			Help:      "Time Lock waited for locks held by others to be released.",
+			Buckets:   []float64{.01, .1, 1, 5, 10, 30, 60, 120, 300},
+		}),
+	}
+}
+
+// Describe satisfies prometheus.Collector
+func (m *prometheusMetrics) Describe(ch chan<- *prometheus.Desc) {
+	m.operations.Describe(ch)
+	m.errors.Describe(ch)
+	m.duration.Describe(ch)
+	m.lockWait.Describe(ch)
+}
+
+// Collect satisfies prometheus.Collector
+func (m *prometheusMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.operations.Collect(ch)
+	m.errors.Collect(ch)
+	m.duration.Collect(ch)
+	m.lockWait.Collect(ch)
+}
+
+// registerPrometheusMetrics registers the metrics with MetricsRegisterer, or the
+// default registerer Caddy serves metrics from. Every instance registered with
+// the same registerer records to the same metrics, which is also what building
+// the client again ends up with.
+func (rd *RedisStorage) registerPrometheusMetrics() (*prometheusMetrics, error) {
+	registerer := rd.MetricsRegisterer
+	if registerer == nil {
+		registerer = prometheus.DefaultRegisterer
+	}
+
+	metrics := newPrometheusMetrics()
+	if err := registerer.Register(metrics); err != nil {
+		registered, ok := err.(prometheus.AlreadyRegisteredError)
+		if !ok {
+			return nil, err
+		}
+		existing, ok := registered.ExistingCollector.(*prometheusMetrics)
+		if !ok {
+			return nil, err
+		}
+		metrics = existing
+	}
+	return metrics, nil
+}
+
+// record records the operation op, started at start, which returned err
+func (m *prometheusMetrics) record(op string, start time.Time, err error) {
+	m.operations.WithLabelValues(op).Inc()
+	if operationResult(err) == "error" {
+		m.errors.WithLabelValues(op).Inc()
+	}
+	m.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,109 @@
+package storageredis
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// rateLimiter is a token bucket letting through rate Redis commands per second,
+// in bursts of up to a second's worth
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens, at most a burst, and returns how long to wait before
+// they are available
+func (rl *rateLimiter) reserve(n int) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	need := float64(n)
+	if need > rl.burst {
+		// a pipeline larger than a burst would never get through otherwise
+		need = rl.burst
+	}
+	rl.tokens -= need
+	if rl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+}
+
+// cancel gives back n tokens reserved by a caller which didn't wait for them
+func (rl *rateLimiter) cancel(n int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	need := float64(n)
+	if need > rl.burst {
+		need = rl.burst
+	}
+	rl.tokens += need
+}
+
+// wait blocks until n commands may be sent to Redis, or ctx is done
+func (rl *rateLimiter) wait(ctx context.Context, n int) error {
+	delay := rl.reserve(n)
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		rl.cancel(n)
+		return ctx.Err()
+	}
+}
+
+// rateLimitHook wires a rateLimiter into the go-redis client
+type rateLimitHook struct {
+	limiter *rateLimiter
+}
+
+func (h rateLimitHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, h.limiter.wait(ctx, 1)
+}
+
+func (h rateLimitHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h rateLimitHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, h.limiter.wait(ctx, len(cmds))
+}
+
+func (h rateLimitHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
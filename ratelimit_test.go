@@ -0,0 +1,50 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_RateLimit(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.RateLimit = 20
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	// a burst of 60 loads, each at least a command, drains the bucket of 20 and
+	// waits for the 40 left, at 20 per second
+	start := time.Now()
+	for i := 0; i < 60; i++ {
+		_, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+	}
+	assert.True(t, time.Since(start) >= 1900*time.Millisecond, "took %v", time.Since(start))
+
+	// waiting gives up with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for {
+		if _, err := rd.Load(ctx, key); err != nil {
+			assert.ErrorIs(t, err, context.DeadlineExceeded)
+			break
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(10)
+	assert.Equal(t, time.Duration(0), rl.reserve(10))
+	assert.InDelta(t, float64(100*time.Millisecond), float64(rl.reserve(1)), float64(5*time.Millisecond))
+
+	// pipelines larger than a burst take a burst
+	assert.InDelta(t, float64(1100*time.Millisecond), float64(rl.reserve(50)), float64(5*time.Millisecond))
+	rl.cancel(50)
+	assert.InDelta(t, float64(100*time.Millisecond), float64(rl.reserve(0)), float64(5*time.Millisecond))
+}
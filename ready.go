@@ -0,0 +1,64 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrNotReady is returned by WaitReady when the storage didn't become ready in time
+var ErrNotReady = errors.New("redis storage not ready")
+
+// readyPollInterval is the wait between two readiness checks of WaitReady
+const readyPollInterval = 250 * time.Millisecond
+
+// WaitReady blocks until every Redis node answers and every key of ReadyKeys can be
+// loaded and decrypted, or ctx is done. Keys missing or Redis unreachable are checked
+// again, while a key that can't be decrypted fails right away, since waiting won't
+// fix the AES key.
+func (rd *RedisStorage) WaitReady(ctx context.Context) error {
+	ctx = orBackground(ctx)
+	for {
+		err := rd.checkReady(ctx)
+		if err == nil {
+			return nil
+		}
+		if errors.Is(err, ErrNotReady) {
+			return err
+		}
+
+		timer := time.NewTimer(readyPollInterval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w: %v", ErrNotReady, err)
+		}
+	}
+}
+
+// checkReady checks once whether the storage is ready. It returns an error
+// wrapping ErrNotReady when it never will be.
+func (rd *RedisStorage) checkReady(ctx context.Context) error {
+	nodes, err := rd.nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, client := range nodes {
+		if err := client.Ping(ctx).Err(); err != nil {
+			return fmt.Errorf("unable to reach %s: %v", client.Options().Addr, err)
+		}
+	}
+	for _, key := range rd.ReadyKeys {
+		key = normalizeKey(key)
+		data, err := rd.readData(ctx, key)
+		if err != nil {
+			return fmt.Errorf("unable to load %s: %v", key, err)
+		}
+		if _, err := rd.decryptStorageData(key, data); err != nil {
+			return fmt.Errorf("%w: unable to decrypt %s: %v", ErrNotReady, key, err)
+		}
+	}
+	return nil
+}
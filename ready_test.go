@@ -0,0 +1,58 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_WaitReady(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+	key := path.Join("certificates", "acme", "example.com", "example.com.crt")
+	rd.ReadyKeys = []string{key}
+
+	// not ready until the key is stored
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, rd.WaitReady(ctx), ErrNotReady)
+
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	assert.NoError(t, rd.WaitReady(ctx))
+	assert.True(t, time.Since(start) >= 300*time.Millisecond, "ready after %v", time.Since(start))
+
+	// a key that can't be decrypted fails right away
+	rd.AesKey = "redistls-01234567890-caddytls-33"
+	start = time.Now()
+	assert.ErrorIs(t, rd.WaitReady(ctx), ErrNotReady)
+	assert.True(t, time.Since(start) < readyPollInterval, "failed after %v", time.Since(start))
+}
+
+func TestRedisStorage_ReadyTimeout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	key := path.Join("certificates", "acme", "example.com", "example.com.crt")
+
+	rd.ReadyKeys = []string{key}
+	rd.ReadyTimeout = Duration(300 * time.Millisecond)
+	start := time.Now()
+	assert.ErrorIs(t, rd.BuildRedisClient(), ErrNotReady)
+	assert.True(t, time.Since(start) >= 300*time.Millisecond, "failed after %v", time.Since(start))
+
+	rd.ReadyTimeout = 0
+	assert.NoError(t, rd.BuildRedisClient())
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	rd.ReadyTimeout = Duration(time.Second)
+	assert.NoError(t, rd.BuildRedisClient())
+}
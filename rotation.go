@@ -0,0 +1,240 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// replaceValueScript replaces a value only if it wasn't changed since it was read,
+// keeping its expiration
+var replaceValueScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "KEEPTTL")
+	return 1
+end
+return 0
+`)
+
+// reencryptBatchSize is how many values a worker of reencrypt reads, and replaces,
+// in a single round trip
+const reencryptBatchSize = 50
+
+// reencryptBatch is a batch of keys stored under keyPrefix on client to re-encrypt
+type reencryptBatch struct {
+	client    redis.UniversalClient
+	keyPrefix string
+	keys      []string
+}
+
+// Reencrypt re-encrypts with AesKey the values under KeyPrefix still encrypted
+// with PreviousAesKey, as is done in the background, and returns how many were
+// re-encrypted. It uses ReencryptConcurrency workers, each pausing
+// ReencryptInterval after every value it re-encrypts.
+func (rd *RedisStorage) Reencrypt(ctx context.Context) (int, error) {
+	ctx = orBackground(ctx)
+	if rd.PreviousAesKey == "" {
+		return 0, fmt.Errorf("no previous AES key to re-encrypt values from")
+	}
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	reencrypted, err := rd.reencrypt(opCtx, []string{rd.keyPrefix()})
+	return reencrypted, classifyTimeout(ctx, opCtx, err)
+}
+
+// RotateKeys finishes rotating AesKey: it re-encrypts with AesKey every value
+// still encrypted with PreviousAesKey, under KeyPrefix like Reencrypt and also
+// under ReadPrefixes, which are rewritten in place. Once it returns without error
+// PreviousAesKey can be removed from the configuration.
+func (rd *RedisStorage) RotateKeys(ctx context.Context) (int, error) {
+	ctx = orBackground(ctx)
+	if rd.PreviousAesKey == "" {
+		return 0, fmt.Errorf("no previous AES key to re-encrypt values from")
+	}
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	reencrypted, err := rd.reencrypt(opCtx, append([]string{rd.keyPrefix()}, rd.ReadPrefixes...))
+	return reencrypted, classifyTimeout(ctx, opCtx, err)
+}
+
+// reencrypt re-encrypts with AesKey the values under keyPrefixes still encrypted
+// with PreviousAesKey, and returns how many were re-encrypted. The keys are
+// scanned in batches, handed to ReencryptConcurrency workers. The failures of
+// some batches don't stop the others, the first one is returned.
+func (rd *RedisStorage) reencrypt(ctx context.Context, keyPrefixes []string) (int, error) {
+	// reads only with the new key, to tell which values need re-encrypting
+	current := *rd
+	current.PreviousAesKey = ""
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		reencrypted int64
+		mu          sync.Mutex
+		failed      int
+		firstErr    error
+	)
+	batches := make(chan reencryptBatch)
+	var workers sync.WaitGroup
+	for i := 0; i < rd.ReencryptConcurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			defer func() {
+				if err := recover(); err != nil {
+					buf := make([]byte, stackTraceBufferSize)
+					buf = buf[:runtime.Stack(buf, false)]
+					rd.Logger.Errorf("panic: re-encrypting values: %v\n%s", err, buf)
+					cancel()
+				}
+			}()
+
+			for batch := range batches {
+				replaced, err := rd.reencryptBatch(ctx, &current, batch)
+				atomic.AddInt64(&reencrypted, int64(replaced))
+				if err != nil {
+					mu.Lock()
+					if failed++; firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+
+				select {
+				case <-time.After(time.Duration(rd.ReencryptInterval) * time.Duration(replaced)):
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	// the keys of a batch are stored on the same node, to be read in a single round trip
+	var err error
+	for _, keyPrefix := range keyPrefixes {
+		if err != nil {
+			break
+		}
+		pending := make(map[redis.UniversalClient][]string)
+		send := func(client redis.UniversalClient) error {
+			select {
+			case batches <- reencryptBatch{client: client, keyPrefix: keyPrefix, keys: pending[client]}:
+				delete(pending, client)
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		err = rd.scanKeysFunc(ctx, keyPrefix, "", func(key string) error {
+			if strings.HasSuffix(key, lockKeySuffix) {
+				return nil
+			}
+			client := rd.clientFor(rd.redisKey(keyPrefix, key))
+			pending[client] = append(pending[client], key)
+			if len(pending[client]) < reencryptBatchSize {
+				return nil
+			}
+			return send(client)
+		})
+		for client := range pending {
+			if err != nil {
+				break
+			}
+			err = send(client)
+		}
+	}
+	close(batches)
+	workers.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil && firstErr != nil {
+		err = fmt.Errorf("unable to re-encrypt %d batches of values: %w", failed, firstErr)
+	}
+	return int(reencrypted), err
+}
+
+// reencryptBatch re-encrypts the values of batch still encrypted with
+// PreviousAesKey, current being rd without it, and returns how many were replaced
+func (rd *RedisStorage) reencryptBatch(ctx context.Context, current *RedisStorage, batch reencryptBatch) (int, error) {
+	gets := make([]*redis.StringCmd, len(batch.keys))
+	_, err := batch.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range batch.keys {
+			gets[i] = pipe.Get(ctx, rd.redisKey(batch.keyPrefix, key))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return 0, fmt.Errorf("unable to read values to re-encrypt: %v", err)
+	}
+
+	pipe := batch.client.Pipeline()
+	var replaces []*redis.Cmd
+	var redisKeys []string
+	for i, key := range batch.keys {
+		stored, err := gets[i].Bytes()
+		if err == redis.Nil {
+			// deleted since the scan
+			continue
+		}
+		if _, err := current.decryptStorageData(key, stored); err == nil {
+			continue
+		}
+
+		data, err := rd.decryptStorageData(key, stored)
+		if err != nil {
+			rd.Logger.Warnf("[WARNING] Unable to decrypt value with either AES key, leaving it alone: %v (key: %s)", err, key)
+			continue
+		}
+		encrypted, err := rd.encryptStorageData(key, data)
+		if err != nil {
+			return 0, fmt.Errorf("unable to encode data for %v: %v", key, err)
+		}
+		// a value stored meanwhile is already encrypted with the new key
+		redisKey := rd.redisKey(batch.keyPrefix, key)
+		replaces = append(replaces, replaceValueScript.Eval(ctx, pipe, []string{redisKey}, stored, encrypted))
+		redisKeys = append(redisKeys, redisKey)
+	}
+	if len(replaces) == 0 {
+		return 0, nil
+	}
+
+	_, err = pipe.Exec(ctx)
+	rd.invalidateCached(redisKeys...)
+	if err != nil {
+		return 0, fmt.Errorf("unable to re-encrypt values: %v", err)
+	}
+	replaced := 0
+	for _, replace := range replaces {
+		n, _ := replace.Int()
+		replaced += n
+	}
+	return replaced, nil
+}
+
+// reencryptInBackground runs reencrypt once, until ctx is done
+func (rd *RedisStorage) reencryptInBackground(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, stackTraceBufferSize)
+			buf = buf[:runtime.Stack(buf, false)]
+			rd.Logger.Errorf("panic: re-encrypting values: %v\n%s", err, buf)
+		}
+	}()
+
+	reencrypted, err := rd.reencrypt(ctx, []string{rd.keyPrefix()})
+	if err != nil {
+		if ctx.Err() == nil {
+			rd.Logger.Errorf("[ERROR] Re-encrypting values with the new AES key: %v", err)
+		}
+		return
+	}
+	rd.Logger.Infof("[INFO] Re-encrypted %d values with the new AES key, the previous key can be removed", reencrypted)
+}
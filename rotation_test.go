@@ -0,0 +1,191 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	oldAESKey = "redistls-01234567890-caddytls-32"
+	newAESKey = "redistls-rotated-789-caddytls-32"
+)
+
+func TestRedisStorage_RotateAESKey(t *testing.T) {
+	mr := miniredis.RunT(t)
+	old := new(RedisStorage)
+	old.AesKey = oldAESKey
+	old = setupRedisEnvWithStorage(t, mr, old)
+	// the previous key is set after building, so nothing is re-encrypted in the background
+	rd := setupRedisEnvWithServer(t, mr)
+
+	var keys []string
+	for i := 0; i < 5; i++ {
+		key := path.Join("certificates", fmt.Sprintf("example%d.com", i), fmt.Sprintf("example%d.com.crt", i))
+		keys = append(keys, key)
+		assert.NoError(t, old.Store(context.TODO(), key, []byte("crt data")))
+	}
+	mr.Select(9)
+	mr.SetTTL(path.Join(TestPrefix, keys[4]), time.Hour)
+
+	rd.AesKey = newAESKey
+	assert.NoError(t, rd.Store(context.TODO(), "unrelated", []byte("data")))
+	rd.PreviousAesKey = oldAESKey
+	rd.ReencryptInterval = Duration(time.Millisecond)
+	onlyNew := *rd
+	onlyNew.PreviousAesKey = ""
+
+	// values encrypted with the old key are read
+	for _, key := range keys {
+		content, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("crt data"), content)
+		_, err = onlyNew.Load(context.TODO(), key)
+		assert.Error(t, err)
+	}
+
+	// and written with the new one
+	assert.NoError(t, rd.Store(context.TODO(), keys[0], []byte("new crt data")))
+	content, err := onlyNew.Load(context.TODO(), keys[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new crt data"), content)
+
+	// the rest is re-encrypted, keeping modified times and expirations
+	before, err := rd.Stat(context.TODO(), keys[1])
+	assert.NoError(t, err)
+	reencrypted, err := rd.reencrypt(context.TODO(), []string{rd.keyPrefix()})
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys)-1, reencrypted)
+	for _, key := range keys[1:] {
+		content, err := onlyNew.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("crt data"), content)
+	}
+	after, err := onlyNew.Stat(context.TODO(), keys[1])
+	assert.NoError(t, err)
+	assert.True(t, before.Modified.Equal(after.Modified))
+	assert.Equal(t, time.Hour, mr.TTL(path.Join(TestPrefix, keys[4])))
+
+	// nothing left to do
+	reencrypted, err = rd.reencrypt(context.TODO(), []string{rd.keyPrefix()})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, reencrypted)
+}
+
+func TestRedisStorage_RotateKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	old := new(RedisStorage)
+	old.AesKey = oldAESKey
+	old = setupRedisEnvWithStorage(t, mr, old)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	readOnly := path.Join("certificates", "old.example.com", "old.example.com.crt")
+	assert.NoError(t, old.Store(context.TODO(), key, []byte("crt data")))
+	old.KeyPrefix = "oldprefix"
+	assert.NoError(t, old.Store(context.TODO(), readOnly, []byte("old crt data")))
+
+	rd.AesKey = newAESKey
+	rd.PreviousAesKey = oldAESKey
+	rd.ReadPrefixes = []string{"oldprefix"}
+
+	reencrypted, err := rd.RotateKeys(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, reencrypted)
+
+	// the previous key can be dropped, including for the read prefixes
+	rd.PreviousAesKey = ""
+	content, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), content)
+	content, err = rd.Load(context.TODO(), readOnly)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old crt data"), content)
+
+	_, err = rd.RotateKeys(context.TODO())
+	assert.Error(t, err, "nothing to rotate from")
+}
+
+func TestRedisStorage_RotateAESKeyInBackground(t *testing.T) {
+	mr := miniredis.RunT(t)
+	old := new(RedisStorage)
+	old.AesKey = oldAESKey
+	old = setupRedisEnvWithStorage(t, mr, old)
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, old.Store(context.TODO(), key, []byte("crt data")))
+
+	rd := new(RedisStorage)
+	rd.AesKey = newAESKey
+	rd.PreviousAesKey = oldAESKey
+	rd.GetConfigValue()
+	assert.NoError(t, rd.BuildRedisClient())
+	t.Cleanup(func() {
+		rd.Cleanup()
+		rd.Client.Close()
+	})
+
+	onlyNew := *rd
+	onlyNew.PreviousAesKey = ""
+	assert.Eventually(t, func() bool {
+		_, err := onlyNew.Load(context.TODO(), key)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisStorage_RotateAESKeyEncryptKeys(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.Address = miniredis.RunT(t).Addr()
+	rd.AesKey = newAESKey
+	rd.PreviousAesKey = oldAESKey
+	rd.EncryptKeys = true
+	rd.GetConfigValue()
+
+	assert.Error(t, rd.BuildRedisClient())
+}
+
+func TestRedisStorage_ReencryptConcurrency(t *testing.T) {
+	mr := miniredis.RunT(t)
+	old := new(RedisStorage)
+	old.AesKey = oldAESKey
+	old = setupRedisEnvWithStorage(t, mr, old)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	keys := make([]string, 2000)
+	for i := range keys {
+		keys[i] = path.Join("certificates", fmt.Sprintf("example%d.com", i), fmt.Sprintf("example%d.com.crt", i))
+		assert.NoError(t, old.StoreUnsafe(context.TODO(), keys[i], []byte(keys[i])))
+	}
+
+	rd.AesKey = newAESKey
+	rd.PreviousAesKey = oldAESKey
+	rd.ReencryptConcurrency = 8
+	onlyNew := *rd
+	onlyNew.PreviousAesKey = ""
+
+	// cancelled while every worker pauses after its first batch
+	rd.ReencryptInterval = Duration(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	reencrypted, err := rd.Reencrypt(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, rd.ReencryptConcurrency*reencryptBatchSize, reencrypted)
+
+	// and resumed
+	rd.ReencryptInterval = Duration(time.Microsecond)
+	rest, err := rd.Reencrypt(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys), reencrypted+rest)
+	for _, key := range keys {
+		content, err := onlyNew.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(key), content)
+	}
+
+	_, err = onlyNew.Reencrypt(context.TODO())
+	assert.Error(t, err)
+}
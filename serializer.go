@@ -0,0 +1,88 @@
+package storageredis
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	// ValueFormatDefault stores values as ValuePrefix followed by the JSON encoded StorageData.
+	// This is the format used by gamalan/caddy-tlsredis, which this plugin is derived from.
+	ValueFormatDefault = "default"
+
+	// ValueFormatJSON stores values as the JSON encoded StorageData only, without ValuePrefix
+	ValueFormatJSON = "json"
+
+	// ValueFormatVersioned stores values as a version byte followed by the encoding
+	// of that version, see formatVersions. The latest version is written, and all
+	// versions are read.
+	ValueFormatVersioned = "versioned"
+)
+
+// Serializer encodes StorageData into the bytes stored in Redis, before encryption,
+// and decodes them back after decryption. Implement it to read and write the values
+// of other storage implementations.
+type Serializer interface {
+	Serialize(data *StorageData) ([]byte, error)
+	Deserialize(bytes []byte) (*StorageData, error)
+}
+
+// prefixedJSONSerializer implements ValueFormatDefault
+type prefixedJSONSerializer struct {
+	prefix string
+}
+
+func (s prefixedJSONSerializer) Serialize(data *StorageData) ([]byte, error) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal: %v", err)
+	}
+
+	// Prefix with simple prefix
+	return append([]byte(s.prefix), bytes...), nil
+}
+
+func (s prefixedJSONSerializer) Deserialize(bytes []byte) (*StorageData, error) {
+	// Simple sanity check of the beginning of the byte array just to check
+	if len(bytes) < len(s.prefix) || string(bytes[:len(s.prefix)]) != s.prefix {
+		return nil, fmt.Errorf("invalid data format")
+	}
+	return jsonSerializer{}.Deserialize(bytes[len(s.prefix):])
+}
+
+// jsonSerializer implements ValueFormatJSON
+type jsonSerializer struct{}
+
+func (jsonSerializer) Serialize(data *StorageData) ([]byte, error) {
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal: %v", err)
+	}
+	return bytes, nil
+}
+
+func (jsonSerializer) Deserialize(bytes []byte) (*StorageData, error) {
+	data := &StorageData{}
+	if err := json.Unmarshal(bytes, data); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal result: %v", err)
+	}
+	return data, nil
+}
+
+// serializer returns the Serializer of the configured value format
+func (rd *RedisStorage) serializer() (Serializer, error) {
+	if rd.Serializer != nil {
+		return rd.Serializer, nil
+	}
+
+	switch rd.ValueFormat {
+	case "", ValueFormatDefault:
+		return prefixedJSONSerializer{prefix: rd.ValuePrefix}, nil
+	case ValueFormatJSON:
+		return jsonSerializer{}, nil
+	case ValueFormatVersioned:
+		return versionedSerializer{version: latestFormatVersion}, nil
+	default:
+		return nil, fmt.Errorf("unknown value format %q", rd.ValueFormat)
+	}
+}
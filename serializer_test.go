@@ -0,0 +1,73 @@
+package storageredis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_ValueFormats(t *testing.T) {
+	modified := time.Date(2022, 11, 28, 10, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		format string
+		sample string
+	}{
+		{ValueFormatDefault, `caddy-storage-redis{"value":"Y3J0IGRhdGE=","modified":"2022-11-28T10:00:00Z"}`},
+		{ValueFormatJSON, `{"value":"Y3J0IGRhdGE=","modified":"2022-11-28T10:00:00Z"}`},
+	} {
+		t.Run(test.format, func(t *testing.T) {
+			rd := new(RedisStorage)
+			rd.ValueFormat = test.format
+			rd.GetConfigValue()
+
+			data, err := rd.DecryptStorageData([]byte(test.sample))
+			assert.NoError(t, err)
+			assert.Equal(t, []byte("crt data"), data.Value)
+			assert.True(t, modified.Equal(data.Modified))
+
+			encoded, err := rd.EncryptStorageData(data)
+			assert.NoError(t, err)
+			assert.Equal(t, test.sample, string(encoded))
+		})
+	}
+}
+
+func TestRedisStorage_UnknownValueFormat(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.ValueFormat = "unknown"
+	rd.GetConfigValue()
+
+	_, err := rd.EncryptStorageData(&StorageData{Value: []byte("crt data")})
+	assert.Error(t, err)
+}
+
+type reversingSerializer struct{}
+
+func (reversingSerializer) Serialize(data *StorageData) ([]byte, error) {
+	reversed := make([]byte, len(data.Value))
+	for i, b := range data.Value {
+		reversed[len(reversed)-1-i] = b
+	}
+	return reversed, nil
+}
+
+func (s reversingSerializer) Deserialize(bytes []byte) (*StorageData, error) {
+	reversed, _ := s.Serialize(&StorageData{Value: bytes})
+	return &StorageData{Value: reversed}, nil
+}
+
+func TestRedisStorage_CustomSerializer(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.Serializer = reversingSerializer{}
+	rd.GetConfigValue()
+
+	encoded, err := rd.EncryptStorageData(&StorageData{Value: []byte("crt data")})
+	assert.NoError(t, err)
+	assert.Equal(t, "atad trc", string(encoded))
+
+	data, err := rd.DecryptStorageData(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), data.Value)
+}
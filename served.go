@@ -0,0 +1,78 @@
+package storageredis
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// servedKeys remembers the keys stored or loaded through this storage, so one
+// vanishing without being deleted through it can be reported. Certmagic issues
+// a certificate again when it can't load it, so those are early warnings of
+// unexpected re-issuance.
+type servedKeys struct {
+	sync.Map
+	unexpected int64
+}
+
+// served records that key exists
+func (s *servedKeys) served(key string) {
+	s.Store(key, struct{}{})
+}
+
+// forget records that key was deleted on purpose
+func (s *servedKeys) forget(key string) {
+	s.Delete(key)
+}
+
+// missing records that key couldn't be found, and reports whether it was
+// served before, in which case it is forgotten until served again
+func (s *servedKeys) missing(key string) bool {
+	if _, served := s.LoadAndDelete(key); !served {
+		return false
+	}
+	atomic.AddInt64(&s.unexpected, 1)
+	return true
+}
+
+// undecryptable records that the value of key couldn't be decrypted
+func (s *servedKeys) undecryptable() {
+	atomic.AddInt64(&s.unexpected, 1)
+}
+
+// UnexpectedMisses returns how many times, with TrackServedKeys, a key vanished
+// without being deleted through this storage or a value couldn't be decrypted.
+func (rd RedisStorage) UnexpectedMisses() int64 {
+	if rd.servedKeys == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&rd.servedKeys.unexpected)
+}
+
+// trackServed records that key exists, unless it is expected to expire
+func (rd RedisStorage) trackServed(key string) {
+	if rd.TrackServedKeys && rd.servedKeys != nil && rd.keyTTL(key) == 0 {
+		rd.servedKeys.served(key)
+	}
+}
+
+// trackDeleted records that key was deleted through this storage
+func (rd RedisStorage) trackDeleted(key string) {
+	if rd.TrackServedKeys && rd.servedKeys != nil {
+		rd.servedKeys.forget(key)
+	}
+}
+
+// trackMissing warns when key was served before and now can't be found
+func (rd RedisStorage) trackMissing(key string) {
+	if rd.TrackServedKeys && rd.servedKeys != nil && rd.servedKeys.missing(key) {
+		rd.Logger.Warnf("[WARNING] Key disappeared from Redis without being deleted by this instance, certmagic may issue it again (key: %s)", key)
+	}
+}
+
+// trackUndecryptable warns when the value of key can't be decrypted
+func (rd RedisStorage) trackUndecryptable(key string, err error) {
+	if rd.TrackServedKeys && rd.servedKeys != nil {
+		rd.servedKeys.undecryptable()
+		rd.Logger.Warnf("[WARNING] Unable to decrypt stored value, certmagic may issue it again: %v (key: %s)", err, key)
+	}
+}
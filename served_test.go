@@ -0,0 +1,80 @@
+package storageredis
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedisStorage_TrackServedKeys(t *testing.T) {
+	mr := miniredis.RunT(t)
+	core, logs := observer.New(zap.WarnLevel)
+	rd := new(RedisStorage)
+	rd.Logger = zap.New(core).Sugar()
+	rd.TrackServedKeys = true
+	rd.TTLPatterns = []TTLPattern{{Pattern: "ocsp/*", TTL: Duration(time.Hour)}}
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	mr.Select(9)
+
+	crt := path.Join("certificates", "example.com", "example.com.crt")
+	key := path.Join("certificates", "example.com", "example.com.key")
+	ocsp := path.Join("ocsp", "example.com")
+	for _, k := range []string{crt, key, ocsp} {
+		assert.NoError(t, rd.Store(context.TODO(), k, []byte("data")))
+	}
+
+	// deleted through the storage, that's expected
+	assert.NoError(t, rd.Delete(context.TODO(), key))
+	_, err := rd.Load(context.TODO(), key)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	// expiring, that's expected too
+	mr.FastForward(2 * time.Hour)
+	_, err = rd.Load(context.TODO(), ocsp)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	// never seen, nothing to compare with
+	_, err = rd.Load(context.TODO(), "certificates/example.org/example.org.crt")
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.Equal(t, int64(0), rd.UnexpectedMisses())
+	assert.Equal(t, 0, logs.Len())
+
+	// gone behind our back
+	mr.Del(rd.prefixKey(crt))
+	_, err = rd.Load(context.TODO(), crt)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.Equal(t, int64(1), rd.UnexpectedMisses())
+	assert.Equal(t, 1, logs.FilterMessageSnippet(crt).Len())
+
+	// reported once, until it is served again
+	_, err = rd.Load(context.TODO(), crt)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.Equal(t, int64(1), rd.UnexpectedMisses())
+
+	// a value that can't be decrypted anymore
+	mr.Set(rd.prefixKey(key), "garbage")
+	_, err = rd.Load(context.TODO(), key)
+	assert.Error(t, err)
+	assert.Equal(t, int64(2), rd.UnexpectedMisses())
+}
+
+func TestRedisStorage_TrackServedKeysDisabled(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	mr.Select(9)
+
+	crt := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), crt, []byte("data")))
+	mr.Del(rd.prefixKey(crt))
+	_, err := rd.Load(context.TODO(), crt)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+	assert.Equal(t, int64(0), rd.UnexpectedMisses())
+}
@@ -0,0 +1,410 @@
+package storageredis
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// TLSRenegotiateNever refuses renegotiation requests of the Redis server
+	TLSRenegotiateNever = "never"
+
+	// TLSRenegotiateOnce accepts a single renegotiation request per connection
+	TLSRenegotiateOnce = "once"
+
+	// TLSRenegotiateFreely accepts any number of renegotiation requests
+	TLSRenegotiateFreely = "freely"
+
+	// TLSVersion12 requires TLS 1.2 or later
+	TLSVersion12 = "1.2"
+
+	// TLSVersion13 requires TLS 1.3
+	TLSVersion13 = "1.3"
+
+	// NetworkTCP connects to Redis nodes at host:port addresses
+	NetworkTCP = "tcp"
+
+	// NetworkUnix connects to Redis nodes at Unix socket paths
+	NetworkUnix = "unix"
+)
+
+// tlsRenegotiation returns the tls.RenegotiationSupport of a TlsRenegotiation setting
+func tlsRenegotiation(setting string) (tls.RenegotiationSupport, error) {
+	switch setting {
+	case "", TLSRenegotiateNever:
+		return tls.RenegotiateNever, nil
+	case TLSRenegotiateOnce:
+		return tls.RenegotiateOnceAsClient, nil
+	case TLSRenegotiateFreely:
+		return tls.RenegotiateFreelyAsClient, nil
+	default:
+		return tls.RenegotiateNever, fmt.Errorf("unknown TLS renegotiation %q", setting)
+	}
+}
+
+// tlsMinVersion returns the tls.Config.MinVersion of a TlsMinVersion setting
+func tlsMinVersion(setting string) (uint16, error) {
+	switch setting {
+	case "", TLSVersion12:
+		return tls.VersionTLS12, nil
+	case TLSVersion13:
+		return tls.VersionTLS13, nil
+	default:
+		return tls.VersionTLS12, fmt.Errorf("unknown TLS minimum version %q", setting)
+	}
+}
+
+// shard is one of the Redis nodes keys are distributed over, or a whole Redis
+// Cluster, which distributes keys over its nodes itself
+type shard struct {
+	address string
+	client  redis.UniversalClient
+	locker  *redislock.Client
+}
+
+// newClient returns a client for the Redis node at address
+func (rd *RedisStorage) newClient(address string) *redis.Client {
+	host, _, _ := net.SplitHostPort(address)
+	redisClient := redis.NewClient(&redis.Options{
+		Network:         rd.Network,
+		Addr:            address,
+		Username:        rd.Username,
+		Password:        rd.Password,
+		DB:              rd.DB,
+		DialTimeout:     time.Second * time.Duration(rd.Timeout),
+		ReadTimeout:     time.Second * time.Duration(rd.Timeout),
+		WriteTimeout:    time.Second * time.Duration(rd.Timeout),
+		MaxRetries:      rd.maxRetries(),
+		MinRetryBackoff: time.Duration(rd.MinRetryBackoff),
+		MaxRetryBackoff: time.Duration(rd.MaxRetryBackoff),
+		PoolSize:        rd.PoolSize,
+		MinIdleConns:    rd.MinIdleConns,
+		PoolTimeout:     time.Duration(rd.PoolTimeout),
+		IdleTimeout:     time.Duration(rd.ConnMaxIdleTime),
+		OnConnect:       rd.onConnect,
+		TLSConfig:       rd.tlsConfig(host),
+	})
+
+	rd.addHooks(redisClient)
+	return redisClient
+}
+
+// failoverOptions returns the options of the client of the master named MasterName,
+// found through the Redis Sentinels at SentinelAddresses
+func (rd *RedisStorage) failoverOptions() *redis.FailoverOptions {
+	return &redis.FailoverOptions{
+		MasterName:       rd.MasterName,
+		SentinelAddrs:    rd.SentinelAddresses,
+		SentinelPassword: rd.SentinelPassword,
+		Username:         rd.Username,
+		Password:         rd.Password,
+		DB:               rd.DB,
+		DialTimeout:      time.Second * time.Duration(rd.Timeout),
+		ReadTimeout:      time.Second * time.Duration(rd.Timeout),
+		WriteTimeout:     time.Second * time.Duration(rd.Timeout),
+		MaxRetries:       rd.maxRetries(),
+		MinRetryBackoff:  time.Duration(rd.MinRetryBackoff),
+		MaxRetryBackoff:  time.Duration(rd.MaxRetryBackoff),
+		PoolSize:         rd.PoolSize,
+		MinIdleConns:     rd.MinIdleConns,
+		PoolTimeout:      time.Duration(rd.PoolTimeout),
+		IdleTimeout:      time.Duration(rd.ConnMaxIdleTime),
+		OnConnect:        rd.onConnect,
+		TLSConfig:        rd.tlsConfig(""),
+	}
+}
+
+// failoverClusterOptions returns the failoverOptions of a client routing read-only
+// commands to the master or any of its replicas, see PreferReplicaReads. Such a
+// client ignores DB, so its connections select it themselves.
+func (rd *RedisStorage) failoverClusterOptions() *redis.FailoverOptions {
+	options := rd.failoverOptions()
+	options.RouteRandomly = true
+	db := rd.DB
+	options.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		if db != 0 {
+			if err := cn.Select(ctx, db).Err(); err != nil {
+				return err
+			}
+		}
+		return rd.onConnect(ctx, cn)
+	}
+	return options
+}
+
+// newFailoverClient returns a client for the master named MasterName, following it
+// when the Redis Sentinels fail over to another node
+func (rd *RedisStorage) newFailoverClient() redis.UniversalClient {
+	var redisClient redis.UniversalClient
+	if rd.PreferReplicaReads {
+		redisClient = redis.NewFailoverClusterClient(rd.failoverClusterOptions())
+	} else {
+		redisClient = redis.NewFailoverClient(rd.failoverOptions())
+	}
+	rd.addHooks(redisClient)
+	return redisClient
+}
+
+// onConnect names every new connection to Redis ConnectionName, then calls OnConnect
+func (rd *RedisStorage) onConnect(ctx context.Context, cn *redis.Conn) error {
+	if rd.ConnectionName != "" {
+		if err := cn.ClientSetName(ctx, replaceHostname(rd.ConnectionName)).Err(); err != nil {
+			// the name only helps debugging, a server refusing it can still be used
+			rd.Logger.Warnf("[WARNING] Unable to set the name of the connection to Redis: %v", err)
+		}
+	}
+	if rd.OnConnect != nil {
+		return rd.OnConnect(ctx, cn)
+	}
+	return nil
+}
+
+// maxRetries returns MaxRetries as expected by go-redis, which only disables
+// retries with -1 and retries 3 times on 0
+func (rd *RedisStorage) maxRetries() int {
+	if rd.MaxRetries < 0 {
+		return -1
+	}
+	return rd.MaxRetries
+}
+
+// tlsConfig returns the TLS configuration of the connections to Redis, nil unless
+// TlsEnabled. The certificate of the server is checked against TlsServerName,
+// otherwise serverName, or the host of each address dialed when empty, unless
+// TlsInsecure and no TlsCaCertFile is set.
+func (rd *RedisStorage) tlsConfig(serverName string) *tls.Config {
+	if !rd.TlsEnabled {
+		return nil
+	}
+	// validated by BuildRedisClient
+	renegotiation, _ := tlsRenegotiation(rd.TlsRenegotiation)
+	minVersion, _ := tlsMinVersion(rd.TlsMinVersion)
+	// TlsInsecure defaults to true and can't be unset in JSON, so a CA to check the
+	// server certificate against is taken as asking for it to be checked
+	insecure := rd.TlsInsecure && rd.TlsCaCertFile == ""
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+		Renegotiation:      renegotiation,
+		MinVersion:         minVersion,
+		RootCAs:            rd.tlsRootCAs,
+		Certificates:       rd.tlsCertificates,
+	}
+	if rd.TlsServerName != "" {
+		config.ServerName = rd.TlsServerName
+	} else if !insecure {
+		config.ServerName = serverName
+	}
+	if rd.TlsSessionCacheSize > 0 {
+		config.ClientSessionCache = tls.NewLRUClientSessionCache(rd.TlsSessionCacheSize)
+	}
+	return config
+}
+
+// loadTLSFiles loads TlsCaCertFile, TlsClientCertFile and TlsClientKeyFile, when set
+func (rd *RedisStorage) loadTLSFiles() error {
+	rd.tlsRootCAs = nil
+	rd.tlsCertificates = nil
+
+	if rd.TlsCaCertFile != "" {
+		pem, err := os.ReadFile(rd.TlsCaCertFile)
+		if err != nil {
+			return fmt.Errorf("unable to read TLS CA certificate: %w", err)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no PEM certificate found in TLS CA certificate file %s", rd.TlsCaCertFile)
+		}
+		rd.tlsRootCAs = rootCAs
+	}
+
+	if (rd.TlsClientCertFile == "") != (rd.TlsClientKeyFile == "") {
+		return fmt.Errorf("TLS client certificate and key files must be set together")
+	}
+	if rd.TlsClientCertFile != "" {
+		certificate, err := tls.LoadX509KeyPair(rd.TlsClientCertFile, rd.TlsClientKeyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load TLS client certificate: %w", err)
+		}
+		rd.tlsCertificates = []tls.Certificate{certificate}
+	}
+	return nil
+}
+
+// newClusterClient returns a client for the Redis Cluster whose nodes include addresses
+func (rd *RedisStorage) newClusterClient(addresses []string) *redis.ClusterClient {
+	options := &redis.ClusterOptions{
+		Addrs:           addresses,
+		Username:        rd.Username,
+		Password:        rd.Password,
+		DialTimeout:     time.Second * time.Duration(rd.Timeout),
+		ReadTimeout:     time.Second * time.Duration(rd.Timeout),
+		WriteTimeout:    time.Second * time.Duration(rd.Timeout),
+		MaxRetries:      rd.maxRetries(),
+		MinRetryBackoff: time.Duration(rd.MinRetryBackoff),
+		MaxRetryBackoff: time.Duration(rd.MaxRetryBackoff),
+		PoolSize:        rd.PoolSize,
+		MinIdleConns:    rd.MinIdleConns,
+		PoolTimeout:     time.Duration(rd.PoolTimeout),
+		IdleTimeout:     time.Duration(rd.ConnMaxIdleTime),
+		OnConnect:       rd.onConnect,
+		TLSConfig:       rd.tlsConfig(""),
+		ReadOnly:        rd.PreferReplicaReads,
+	}
+
+	clusterClient := redis.NewClusterClient(options)
+	rd.addHooks(clusterClient)
+	return clusterClient
+}
+
+// addHooks adds the rate limiter and the circuit breaker to redisClient
+func (rd *RedisStorage) addHooks(redisClient redis.UniversalClient) {
+	// the limit is on this instance, so every node shares the limiter
+	if rd.limiter != nil {
+		redisClient.AddHook(rateLimitHook{limiter: rd.limiter})
+	}
+
+	// every node fails independently, so each gets its own breaker
+	if rd.CircuitBreakerThreshold > 0 {
+		redisClient.AddHook(circuitBreakerHook{
+			breaker: newCircuitBreaker(rd.CircuitBreakerThreshold, time.Duration(rd.CircuitBreakerWindow), time.Duration(rd.CircuitBreakerCooldown)),
+		})
+	}
+}
+
+// connectShard connects to the Redis node at address and checks it can be used
+func (rd *RedisStorage) connectShard(address string) (shard, error) {
+	if rd.Network == NetworkUnix {
+		// fail with the path rather than a dial error
+		if _, err := os.Stat(address); err != nil {
+			return shard{}, fmt.Errorf("unable to find redis unix socket: %w", err)
+		}
+	}
+	return rd.checkShard(address, rd.newClient(address))
+}
+
+// connectSentinel connects to the master named MasterName through the Redis Sentinels
+// and checks it can be used
+func (rd *RedisStorage) connectSentinel() (shard, error) {
+	return rd.checkShard(rd.MasterName, rd.newFailoverClient())
+}
+
+// connectCluster connects to the Redis Cluster whose nodes include addresses and
+// checks it can be used
+func (rd *RedisStorage) connectCluster(addresses []string) (shard, error) {
+	return rd.checkShard(strings.Join(addresses, ","), rd.newClusterClient(addresses))
+}
+
+// checkShard checks redisClient, connected to address, can be used
+func (rd *RedisStorage) checkShard(address string, redisClient redis.UniversalClient) (shard, error) {
+	if err := rd.ping(redisClient, address); err != nil {
+		return shard{}, rd.classifyConnectError(redisClient, err)
+	}
+	if err := rd.checkPermissions(rd.ctx, redisClient); err != nil {
+		return shard{}, err
+	}
+	if err := rd.checkClusterID(rd.ctx, redisClient, address); err != nil {
+		return shard{}, err
+	}
+	return shard{
+		address: address,
+		client:  redisClient,
+		locker:  redislock.New(redisClient),
+	}, nil
+}
+
+// trimKeySuffixes returns the Redis key of the value a lock, fencing token, metadata,
+// creation time or tombstone key belongs to
+func trimKeySuffixes(redisKey string) string {
+	redisKey = strings.TrimSuffix(redisKey, lockKeySuffix)
+	redisKey = strings.TrimSuffix(redisKey, fenceKeySuffix)
+	redisKey = strings.TrimSuffix(redisKey, metadataKeySuffix)
+	redisKey = strings.TrimSuffix(redisKey, createdKeySuffix)
+	return strings.TrimSuffix(redisKey, tombstoneKeySuffix)
+}
+
+// shardFor returns the shard storing redisKey. The lock, metadata and tombstone keys of a
+// value are stored on the same shard as the value itself.
+func (rd *RedisStorage) shardFor(redisKey string) shard {
+	if rd.accounts != nil && rd.isAccountRedisKey(redisKey) {
+		return *rd.accounts
+	}
+	if len(rd.shards) == 0 {
+		// client set up by hand rather than by BuildRedisClient
+		return shard{address: rd.Address, client: rd.Client, locker: rd.ClientLocker}
+	}
+	if len(rd.shards) == 1 {
+		return rd.shards[0]
+	}
+
+	redisKey = trimKeySuffixes(redisKey)
+
+	// rendezvous hashing, so adding a node only moves the keys ending up on it
+	var best shard
+	var bestWeight uint64
+	for i, candidate := range rd.shards {
+		h := fnv.New64a()
+		h.Write([]byte(candidate.address))
+		h.Write([]byte{0})
+		h.Write([]byte(redisKey))
+		if weight := h.Sum64(); i == 0 || weight > bestWeight {
+			best, bestWeight = candidate, weight
+		}
+	}
+	return best
+}
+
+// clientFor returns the client of the shard storing redisKey
+func (rd *RedisStorage) clientFor(redisKey string) redis.UniversalClient {
+	return rd.shardFor(redisKey).client
+}
+
+// clients returns the clients of all shards, and of the account storage
+func (rd *RedisStorage) clients() []redis.UniversalClient {
+	if len(rd.shards) == 0 {
+		return []redis.UniversalClient{rd.Client}
+	}
+	clients := make([]redis.UniversalClient, 0, len(rd.shards)+1)
+	for _, s := range rd.shards {
+		clients = append(clients, s.client)
+	}
+	if rd.accounts != nil {
+		clients = append(clients, rd.accounts.client)
+	}
+	return clients
+}
+
+// nodes returns a client for every Redis node, the masters of a Redis Cluster, for
+// the commands which apply to a single node, such as SCAN
+func (rd *RedisStorage) nodes(ctx context.Context) ([]*redis.Client, error) {
+	var nodes []*redis.Client
+	for _, client := range rd.clients() {
+		switch client := client.(type) {
+		case *redis.Client:
+			nodes = append(nodes, client)
+		case *redis.ClusterClient:
+			// fn is called concurrently, the masters are collected to be used in turn
+			var mu sync.Mutex
+			err := client.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+				mu.Lock()
+				defer mu.Unlock()
+				nodes = append(nodes, master)
+				return nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("unable to find the masters of the Redis Cluster: %v", err)
+			}
+		}
+	}
+	return nodes, nil
+}
@@ -0,0 +1,473 @@
+package storageredis
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_Shards(t *testing.T) {
+	nodes := []*miniredis.Miniredis{miniredis.RunT(t), miniredis.RunT(t)}
+	addresses := []string{nodes[0].Addr(), nodes[1].Addr()}
+
+	rd := new(RedisStorage)
+	rd.ShardAddresses = addresses
+	rd = setupRedisEnvWithStorage(t, nodes[0], rd)
+	t.Cleanup(func() { rd.shards[1].client.Close() })
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := path.Join("certificates", fmt.Sprintf("example%d.com", i), fmt.Sprintf("example%d.com.crt", i))
+		keys = append(keys, key)
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	}
+
+	// every key is on exactly one node, the same node for an instance listing the nodes in another order
+	other := &RedisStorage{shards: []shard{{address: addresses[1]}, {address: addresses[0]}}}
+	perNode := make([]int, len(nodes))
+	for _, key := range keys {
+		found := -1
+		for i, node := range nodes {
+			node.Select(9)
+			if node.Exists(rd.prefixKey(key)) {
+				assert.Equal(t, -1, found, "%s stored twice", key)
+				found = i
+			}
+		}
+		assert.NotEqual(t, -1, found, "%s not stored", key)
+		perNode[found]++
+		assert.Equal(t, addresses[found], other.shardFor(rd.prefixKey(key)).address)
+
+		content, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("crt data"), content)
+	}
+	assert.NotZero(t, perNode[0])
+	assert.NotZero(t, perNode[1])
+
+	// locks are taken on the node of their key
+	assert.NoError(t, rd.Lock(context.TODO(), keys[0]))
+	defer rd.Unlock(context.TODO(), keys[0])
+	assert.Equal(t, rd.shardFor(rd.prefixKey(keys[0])).address, rd.shardFor(rd.prefixKey(keys[0])+lockKeySuffix).address)
+
+	found, err := rd.ListLeaves(context.TODO(), "certificates")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, found)
+
+	found, err = rd.List(context.TODO(), "certificates", false)
+	assert.NoError(t, err)
+	assert.Len(t, found, len(keys))
+
+	deleted, err := rd.DeletePrefix(context.TODO(), "certificates")
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys), deleted)
+	found, err = rd.ListLeaves(context.TODO(), "certificates")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func TestRedisStorage_TLSSettings(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.TlsEnabled = true
+	tlsConfig := rd.newClient("127.0.0.1:6379").Options().TLSConfig
+	assert.Nil(t, tlsConfig.ClientSessionCache)
+	assert.Equal(t, tls.RenegotiateNever, tlsConfig.Renegotiation)
+
+	rd.TlsSessionCacheSize = 32
+	rd.TlsRenegotiation = TLSRenegotiateOnce
+	tlsConfig = rd.newClient("127.0.0.1:6379").Options().TLSConfig
+	assert.NotNil(t, tlsConfig.ClientSessionCache)
+	assert.Equal(t, tls.RenegotiateOnceAsClient, tlsConfig.Renegotiation)
+}
+
+// issueTestCertificate returns a certificate for template signed by parent, or
+// self-signed when parent is nil
+func issueTestCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, interface{}(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeTestCertificate writes certificate and its key as PEM files in dir
+func writeTestCertificate(t *testing.T, dir string, name string, certificate tls.Certificate) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	der, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+	return certFile, keyFile
+}
+
+func TestRedisStorage_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issueTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Redis CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := issueTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "redis"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+	client := issueTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "caddy"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+	caFile, _ := writeTestCertificate(t, dir, "ca", ca)
+	clientCertFile, clientKeyFile := writeTestCertificate(t, dir, "client", client)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+	mr, err := miniredis.RunTLS(&tls.Config{
+		Certificates: []tls.Certificate{server},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	assert.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	rd := new(RedisStorage)
+	rd.TlsEnabled = true
+	rd.TlsCaCertFile = caFile
+	rd.TlsClientCertFile = clientCertFile
+	rd.TlsClientKeyFile = clientKeyFile
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	tlsConfig := rd.Client.(*redis.Client).Options().TLSConfig
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.Equal(t, "127.0.0.1", tlsConfig.ServerName)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	content, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), content)
+}
+
+func TestRedisStorage_TLSFilesError(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0600))
+
+	for name, setup := range map[string]func(rd *RedisStorage){
+		"missing CA":          func(rd *RedisStorage) { rd.TlsCaCertFile = filepath.Join(dir, "missing.crt") },
+		"invalid CA":          func(rd *RedisStorage) { rd.TlsCaCertFile = notPEM },
+		"missing client cert": func(rd *RedisStorage) { rd.TlsClientCertFile, rd.TlsClientKeyFile = notPEM, notPEM },
+		"client key only":     func(rd *RedisStorage) { rd.TlsClientKeyFile = notPEM },
+	} {
+		t.Run(name, func(t *testing.T) {
+			rd := new(RedisStorage)
+			rd.Address = miniredis.RunT(t).Addr()
+			rd.TlsEnabled = true
+			setup(rd)
+			rd.GetConfigValue()
+			assert.Error(t, rd.BuildRedisClient())
+		})
+	}
+	rd := new(RedisStorage)
+	rd.TlsCaCertFile = filepath.Join(dir, "missing.crt")
+	assert.ErrorIs(t, rd.loadTLSFiles(), fs.ErrNotExist)
+}
+
+func TestRedisStorage_TLSServerNameAndVersion(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.TlsEnabled = true
+	tlsConfig := rd.newClient("10.0.0.1:6379").Options().TLSConfig
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+
+	rd.TlsServerName = "redis.example.com"
+	rd.TlsMinVersion = TLSVersion13
+	tlsConfig = rd.newClient("10.0.0.1:6379").Options().TLSConfig
+	assert.Equal(t, "redis.example.com", tlsConfig.ServerName)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+	tlsConfig = rd.newClusterClient([]string{"10.0.0.1:6379", "10.0.0.2:6379"}).Options().TLSConfig
+	assert.Equal(t, "redis.example.com", tlsConfig.ServerName)
+	assert.Equal(t, "redis.example.com", rd.failoverOptions().TLSConfig.ServerName)
+
+	// only with TLS
+	rd.TlsEnabled = false
+	assert.Nil(t, rd.newClient("10.0.0.1:6379").Options().TLSConfig)
+
+	unknown := new(RedisStorage)
+	unknown.Address = miniredis.RunT(t).Addr()
+	unknown.TlsMinVersion = "1.1"
+	unknown.GetConfigValue()
+	err := unknown.BuildRedisClient()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown TLS minimum version")
+}
+
+func TestRedisStorage_UnixSocket(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	// miniredis only listens on TCP, so forward a socket to it
+	socket := filepath.Join(t.TempDir(), "redis.sock")
+	listener, err := net.Listen(NetworkUnix, socket)
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			upstream, err := net.Dial(NetworkTCP, mr.Addr())
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go func() { io.Copy(upstream, conn); upstream.Close() }()
+			go func() { io.Copy(conn, upstream); conn.Close() }()
+		}
+	}()
+
+	rd := new(RedisStorage)
+	rd.Network = NetworkUnix
+	rd.Address = socket
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	options := rd.Client.(*redis.Client).Options()
+	assert.Equal(t, NetworkUnix, options.Network)
+	assert.Equal(t, socket, options.Addr)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	mr.Select(9)
+	assert.True(t, mr.Exists(rd.prefixKey(key)))
+
+	missing := new(RedisStorage)
+	missing.Network = NetworkUnix
+	missing.Address = filepath.Join(t.TempDir(), "missing.sock")
+	missing.GetConfigValue()
+	err = missing.BuildRedisClient()
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Contains(t, err.Error(), "unable to find redis unix socket")
+
+	unknown := new(RedisStorage)
+	unknown.Network = "udp"
+	unknown.GetConfigValue()
+	assert.Error(t, unknown.BuildRedisClient())
+}
+
+func TestRedisStorage_TLSRenegotiationUnknown(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.Address = miniredis.RunT(t).Addr()
+	rd.TlsRenegotiation = "sometimes"
+	rd.GetConfigValue()
+
+	assert.Error(t, rd.BuildRedisClient())
+}
+
+func TestRedisStorage_Cluster(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	// the first reachable address is enough to discover the nodes of the cluster
+	rd := new(RedisStorage)
+	rd.ClusterEnabled = true
+	rd.Addresses = []string{"127.0.0.1:1", mr.Addr()}
+	rd.HashTagKeys = true
+	rd.KeyPrefix = TestPrefix
+	rd.ValuePrefix = DefaultValuePrefix
+	rd.Timeout = DefaultRedisTimeout
+	assert.NoError(t, rd.BuildRedisClient())
+	t.Cleanup(func() {
+		rd.Cleanup()
+		rd.Client.Close()
+	})
+	_, ok := rd.Client.(*redis.ClusterClient)
+	assert.True(t, ok)
+
+	var keys []string
+	for i := 0; i < 20; i++ {
+		key := path.Join("certificates", fmt.Sprintf("example%d.com", i), fmt.Sprintf("example%d.com.crt", i))
+		keys = append(keys, key)
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+		assert.True(t, mr.Exists(rd.prefixKey(key)))
+
+		content, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("crt data"), content)
+	}
+
+	assert.NoError(t, rd.Lock(context.TODO(), keys[0]))
+	assert.NoError(t, rd.Unlock(context.TODO(), keys[0]))
+
+	found, err := rd.ListLeaves(context.TODO(), "certificates")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, found)
+
+	deleted, err := rd.DeletePrefix(context.TODO(), "certificates")
+	assert.NoError(t, err)
+	assert.Equal(t, len(keys), deleted)
+	found, err = rd.ListLeaves(context.TODO(), "certificates")
+	assert.NoError(t, err)
+	assert.Empty(t, found)
+}
+
+func TestRedisStorage_ClusterRequiresHashTags(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.ClusterEnabled = true
+	rd.Addresses = []string{miniredis.RunT(t).Addr()}
+
+	assert.Error(t, rd.BuildRedisClient())
+}
+
+func TestRedisStorage_SentinelOptions(t *testing.T) {
+	t.Run("from JSON", func(t *testing.T) {
+		rd := new(RedisStorage)
+		err := json.Unmarshal([]byte(`{
+			"sentinel_enabled": true,
+			"master_name": "caddy",
+			"sentinel_addresses": ["sentinel1:26379", "sentinel2:26379"],
+			"sentinel_password": "sentinel secret",
+			"password": "master secret",
+			"db": 2
+		}`), rd)
+		assert.NoError(t, err)
+		rd.GetConfigValue()
+
+		assert.True(t, rd.SentinelEnabled)
+		options := rd.failoverOptions()
+		assert.Equal(t, "caddy", options.MasterName)
+		assert.Equal(t, []string{"sentinel1:26379", "sentinel2:26379"}, options.SentinelAddrs)
+		assert.Equal(t, "sentinel secret", options.SentinelPassword)
+		assert.Equal(t, "master secret", options.Password)
+		assert.Equal(t, 2, options.DB)
+	})
+
+	t.Run("from env", func(t *testing.T) {
+		for name, value := range map[string]string{
+			EnvNameRedisSentinel:          "true",
+			EnvNameRedisMasterName:        "caddy",
+			EnvNameRedisSentinelAddresses: "sentinel1:26379, sentinel2:26379",
+			EnvNameRedisSentinelPassword:  "sentinel secret",
+		} {
+			os.Setenv(name, value)
+			defer os.Unsetenv(name)
+		}
+		rd := new(RedisStorage)
+		rd.GetConfigValue()
+
+		assert.True(t, rd.SentinelEnabled)
+		options := rd.failoverOptions()
+		assert.Equal(t, "caddy", options.MasterName)
+		assert.Equal(t, []string{"sentinel1:26379", "sentinel2:26379"}, options.SentinelAddrs)
+		assert.Equal(t, "sentinel secret", options.SentinelPassword)
+	})
+
+	t.Run("requires a master name", func(t *testing.T) {
+		rd := new(RedisStorage)
+		rd.SentinelEnabled = true
+		rd.SentinelAddresses = []string{"sentinel1:26379"}
+		assert.EqualError(t, rd.BuildRedisClient(), "redis sentinel requires the name of the master")
+	})
+}
+
+func TestRedisStorage_PreferReplicaReads(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	t.Run("cluster", func(t *testing.T) {
+		// connections to the nodes accept reads with READONLY, unknown to miniredis
+		var readOnly int32
+		mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+			if cmd != "READONLY" {
+				return false
+			}
+			atomic.AddInt32(&readOnly, 1)
+			c.WriteOK()
+			return true
+		})
+		defer mr.Server().SetPreHook(nil)
+
+		rd := new(RedisStorage)
+		rd.ClusterEnabled = true
+		rd.PreferReplicaReads = true
+		rd.Addresses = []string{mr.Addr()}
+		rd.HashTagKeys = true
+		rd.KeyPrefix = TestPrefix
+		rd.ValuePrefix = DefaultValuePrefix
+		rd.Timeout = DefaultRedisTimeout
+		assert.NoError(t, rd.BuildRedisClient())
+		t.Cleanup(func() {
+			rd.Cleanup()
+			rd.Client.Close()
+		})
+		assert.True(t, rd.Client.(*redis.ClusterClient).Options().ReadOnly)
+
+		// without replicas, reads fall back to the master
+		key := path.Join("certificates", "example.com", "example.com.crt")
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+		content, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("crt data"), content)
+		assert.NotZero(t, atomic.LoadInt32(&readOnly))
+	})
+
+	t.Run("sentinel", func(t *testing.T) {
+		rd := new(RedisStorage)
+		rd.SentinelEnabled = true
+		rd.PreferReplicaReads = true
+		rd.MasterName = "caddy"
+		rd.SentinelAddresses = []string{"sentinel1:26379"}
+		rd.DB = 2
+		options := rd.failoverClusterOptions()
+		assert.True(t, options.RouteRandomly)
+		assert.False(t, rd.failoverOptions().RouteRandomly)
+
+		// the cluster client ignores db, its connections select it
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		defer client.Close()
+		conn := client.Conn(context.TODO())
+		defer conn.Close()
+		assert.NoError(t, options.OnConnect(context.TODO(), conn))
+		assert.NoError(t, conn.Set(context.TODO(), "replica-reads", "db 2", 0).Err())
+		mr.Select(2)
+		assert.True(t, mr.Exists("replica-reads"))
+	})
+
+	t.Run("requires cluster or sentinel", func(t *testing.T) {
+		rd := new(RedisStorage)
+		rd.PreferReplicaReads = true
+		rd.Address = mr.Addr()
+		assert.EqualError(t, rd.BuildRedisClient(), "replica reads require redis cluster or sentinel")
+	})
+}
@@ -0,0 +1,16 @@
+package storageredis
+
+import (
+	"time"
+)
+
+// logSlow logs a warning when the operation op on key, started at start, took
+// longer than SlowOpThreshold. It is meant to be deferred.
+func (rd RedisStorage) logSlow(op string, key string, start time.Time) {
+	if rd.SlowOpThreshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed > time.Duration(rd.SlowOpThreshold) {
+		rd.Logger.Warnf("[WARNING] Slow Redis operation %s under %s took %v (key: %s)", op, rd.keyPrefix(), elapsed, key)
+	}
+}
@@ -0,0 +1,44 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRedisStorage_SlowOpThreshold(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.Logger = zap.New(core).Sugar()
+	rd.SlowOpThreshold = Duration(100 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	_, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, logs.FilterMessageSnippet("Slow Redis operation").Len())
+
+	// a slow redis
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "GET" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return false
+	})
+
+	_, err = rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	slow := logs.FilterMessageSnippet("Slow Redis operation Load")
+	assert.Equal(t, 1, slow.Len())
+	assert.Contains(t, slow.All()[0].Message, TestPrefix)
+	assert.Contains(t, slow.All()[0].Message, key)
+}
@@ -1,22 +1,31 @@
 package storageredis
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/fs"
+	"net"
+	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
+	"go.opentelemetry.io/otel/metric"
 	"go.uber.org/zap"
 
 	"github.com/bsm/redislock"
 	"github.com/caddyserver/certmagic"
 	"github.com/go-redis/redis/v8"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
@@ -31,12 +40,56 @@ const (
 	// LockPollInterval is how frequently to check the existence of a lock
 	LockPollInterval = 1 * time.Second
 
+	// lockKeySuffix is appended to a key to get the name of its lock
+	lockKeySuffix = ".lock"
+
+	// metadataKeySuffix is appended to a key to store its cleartext metadata
+	metadataKeySuffix = ".__meta"
+
+	// tombstoneKeySuffix is appended to a key deleted while ReadPrefixes are set,
+	// so it isn't read back from them
+	tombstoneKeySuffix = ".__deleted"
+
+	// createdKeySuffix is appended to a key to store the time it was first stored at
+	createdKeySuffix = ".__created"
+
+	// fenceKeySuffix is appended to a key to store the fencing token of its lock,
+	// see LockFencing
+	fenceKeySuffix = ".__fence"
+
 	// Maximum size for the stack trace when recovering from panics.
 	stackTraceBufferSize = 1024 * 128
 
 	// ScanCount is how many scan command might return
 	ScanCount int64 = 100
 
+	// ListOrderFilesystem lists keys in the order and shape of certmagic.FileStorage
+	ListOrderFilesystem = "filesystem"
+
+	// ListConsistencyScan lists keys with SCAN, which doesn't block Redis but may
+	// miss keys added or removed while listing
+	ListConsistencyScan = "scan"
+
+	// ListConsistencyKeys lists keys with KEYS, which returns a consistent snapshot
+	// but blocks Redis while it walks the entire keyspace
+	ListConsistencyKeys = "keys"
+
+	// KeyDerivationRaw uses the AES key as it is, which must then be 16, 24 or 32 bytes long
+	KeyDerivationRaw = "raw"
+
+	// KeyDerivationScrypt derives the AES key from a passphrase of any length with scrypt
+	KeyDerivationScrypt = "scrypt"
+
+	// EncryptionNone stores values in the clear, the default without an AES key
+	EncryptionNone = "none"
+
+	// EncryptionAESGCM encrypts values with AES-GCM, the default with an AES key
+	EncryptionAESGCM = "aes-gcm"
+
+	// EncryptionChaCha20Poly1305 encrypts values with ChaCha20-Poly1305, faster than
+	// AES-GCM on CPUs without AES instructions, with a 32 bytes key
+	EncryptionChaCha20Poly1305 = "chacha20-poly1305"
+
 	// Default Values
 
 	// DefaultAESKey needs to be 32 bytes long
@@ -72,6 +125,60 @@ const (
 	// DefaultRedisTLSInsecure define the Redis TLS connection
 	DefaultRedisTLSInsecure = true
 
+	// DefaultLockHeldWarnRefreshes define after how many refreshes of a lock a warning is logged
+	DefaultLockHeldWarnRefreshes = 5
+
+	// DefaultConnectionName defines the default name of the connections to Redis
+	DefaultConnectionName = "caddy-tlsredis-{hostname}"
+
+	// DefaultReencryptInterval define the pause between re-encrypting two values when rotating AES keys
+	DefaultReencryptInterval = 100 * time.Millisecond
+
+	// DefaultReencryptConcurrency define how many workers re-encrypt values at once when rotating AES keys
+	DefaultReencryptConcurrency = 1
+
+	// DefaultAbandonedSweepInterval define how often abandoned certificates are looked for
+	DefaultAbandonedSweepInterval = 24 * time.Hour
+
+	// DefaultMaxScanIterations define how many SCAN commands a single listing may issue
+	DefaultMaxScanIterations = 1000000
+
+	// DefaultDeleteBatchSize define how many keys DeletePrefix deletes per command
+	DefaultDeleteBatchSize = 500
+
+	// DefaultClientSideCacheSize define how many values the client-side cache holds
+	DefaultClientSideCacheSize = 10000
+
+	// DefaultConnectRetries define how many times the initial Ping is retried
+	DefaultConnectRetries = 3
+
+	// DefaultConnectBackoff define the wait before the first retry of the initial Ping, doubled on every retry
+	DefaultConnectBackoff = 500 * time.Millisecond
+
+	// DefaultMaxRetries define how many times a command failing with a transient error is retried
+	DefaultMaxRetries = 3
+
+	// DefaultMinRetryBackoff define the shortest wait before retrying a command
+	DefaultMinRetryBackoff = 8 * time.Millisecond
+
+	// DefaultMaxRetryBackoff define the longest wait before retrying a command
+	DefaultMaxRetryBackoff = 512 * time.Millisecond
+
+	// DefaultPoolSizePerCPU define how many connections to every Redis node are pooled per available CPU
+	DefaultPoolSizePerCPU = 10
+
+	// DefaultConnMaxIdleTime define how long a pooled connection can stay idle before being closed
+	DefaultConnMaxIdleTime = 5 * time.Minute
+
+	// maxConnectBackoff bounds the wait between retries of the initial Ping
+	maxConnectBackoff = 5 * time.Second
+
+	// DefaultCircuitBreakerWindow define the window in which consecutive failures open the circuit breaker
+	DefaultCircuitBreakerWindow = 10 * time.Second
+
+	// DefaultCircuitBreakerCooldown define how long the circuit breaker stays open before probing Redis again
+	DefaultCircuitBreakerCooldown = 5 * time.Second
+
 	// Environment Name
 
 	// EnvNameRedisHost defines the env variable name to override Redis host
@@ -89,12 +196,27 @@ const (
 	// EnvNameRedisPassword defines the env variable name to override Redis password
 	EnvNameRedisPassword = "CADDY_CLUSTERING_REDIS_PASSWORD"
 
+	// EnvNameRedisNetwork defines the env variable name to override the network of Redis addresses, tcp or unix
+	EnvNameRedisNetwork = "CADDY_CLUSTERING_REDIS_NETWORK"
+
 	// EnvNameRedisTimeout defines the env variable name to override Redis wait timeout for dial, read, write
 	EnvNameRedisTimeout = "CADDY_CLUSTERING_REDIS_TIMEOUT"
 
+	// EnvNameRedisMaxRetries defines the env variable name to override how many times failed commands are retried
+	EnvNameRedisMaxRetries = "CADDY_CLUSTERING_REDIS_MAX_RETRIES"
+
+	// EnvNameScanCount defines the env variable name to override the COUNT hint of SCAN commands
+	EnvNameScanCount = "CADDY_CLUSTERING_REDIS_SCANCOUNT"
+
 	// EnvNameAESKey defines the env variable name to override AES key
 	EnvNameAESKey = "CADDY_CLUSTERING_REDIS_AESKEY"
 
+	// EnvNameRedisPasswordFile defines the env variable name to override the file the Redis password is read from
+	EnvNameRedisPasswordFile = "CADDY_CLUSTERING_REDIS_PASSWORD_FILE"
+
+	// EnvNameAESKeyFile defines the env variable name to override the file the AES key is read from
+	EnvNameAESKeyFile = "CADDY_CLUSTERING_REDIS_AESKEY_FILE"
+
 	// EnvNameKeyPrefix defines the env variable name to override KV key prefix
 	EnvNameKeyPrefix = "CADDY_CLUSTERING_REDIS_KEYPREFIX"
 
@@ -106,11 +228,35 @@ const (
 
 	// EnvNameTLSInsecure defines the env variable name to whether verify Redis TLS Connection or not
 	EnvNameTLSInsecure = "CADDY_CLUSTERING_REDIS_TLS_INSECURE"
+
+	// EnvNameLockOwner defines the env variable name to override the lock owner metadata
+	EnvNameLockOwner = "CADDY_CLUSTERING_REDIS_LOCK_OWNER"
+
+	// EnvNameConnectionName defines the env variable name to override the name of the connections to Redis
+	EnvNameConnectionName = "CADDY_CLUSTERING_REDIS_CONNECTION_NAME"
+
+	// EnvNameRedisCluster defines the env variable name to whether connect to a Redis Cluster or not
+	EnvNameRedisCluster = "CADDY_CLUSTERING_REDIS_CLUSTER"
+
+	// EnvNameRedisAddresses defines the env variable name to override the comma-separated Redis Cluster addresses
+	EnvNameRedisAddresses = "CADDY_CLUSTERING_REDIS_ADDRESSES"
+
+	// EnvNameRedisSentinel defines the env variable name to whether connect through Redis Sentinel or not
+	EnvNameRedisSentinel = "CADDY_CLUSTERING_REDIS_SENTINEL"
+
+	// EnvNameRedisMasterName defines the env variable name to override the name of the master monitored by Redis Sentinel
+	EnvNameRedisMasterName = "CADDY_CLUSTERING_REDIS_MASTER_NAME"
+
+	// EnvNameRedisSentinelAddresses defines the env variable name to override the comma-separated Redis Sentinel addresses
+	EnvNameRedisSentinelAddresses = "CADDY_CLUSTERING_REDIS_SENTINEL_ADDRESSES"
+
+	// EnvNameRedisSentinelPassword defines the env variable name to override the Redis Sentinel password
+	EnvNameRedisSentinelPassword = "CADDY_CLUSTERING_REDIS_SENTINEL_PASSWORD"
 )
 
 // RedisStorage contain Redis client, and plugin option
 type RedisStorage struct {
-	Client       *redis.Client
+	Client       redis.UniversalClient
 	ClientLocker *redislock.Client
 	Logger       *zap.SugaredLogger
 	ctx          context.Context
@@ -128,177 +274,1767 @@ type RedisStorage struct {
 	TlsEnabled  bool   `json:"tls_enabled"`
 	TlsInsecure bool   `json:"tls_insecure"`
 
-	locks *sync.Map
-}
+	// Network is NetworkTCP, the default, or NetworkUnix for Address, ShardAddresses
+	// and AccountStorageAddress to be Unix socket paths, which must exist.
+	Network string `json:"network"`
+
+	// PasswordFile and AesKeyFile are files Password and AesKey are read from when
+	// building the client, taking precedence over them, so the secrets can be kept
+	// out of the configuration, for example mounted as Docker or Kubernetes secrets.
+	// Trailing newlines are trimmed.
+	PasswordFile string `json:"password_file"`
+	AesKeyFile   string `json:"aes_key_file"`
+
+	// TlsSessionCacheSize enables TLS session resumption with a cache of this many
+	// sessions, so reconnecting to Redis skips the full handshake. Disabled when 0.
+	TlsSessionCacheSize int `json:"tls_session_cache_size"`
+
+	// TlsCaCertFile is a PEM file of the CAs trusted to sign the certificate of the
+	// Redis server, instead of the system ones. Setting it checks the certificate
+	// of the server even when TlsInsecure is set. TlsClientCertFile and
+	// TlsClientKeyFile are the PEM certificate and key presented to servers
+	// requiring client certificates.
+	TlsCaCertFile     string `json:"tls_ca_cert_file"`
+	TlsClientCertFile string `json:"tls_client_cert_file"`
+	TlsClientKeyFile  string `json:"tls_client_key_file"`
+
+	// TlsServerName is the name the certificate of the Redis server is checked
+	// against, and sent with SNI, when it differs from the host dialed, as behind
+	// a load balancer. TlsMinVersion is the lowest TLS version accepted,
+	// TLSVersion12, the default, or TLSVersion13.
+	TlsServerName string `json:"tls_server_name"`
+	TlsMinVersion string `json:"tls_min_version"`
+
+	// TlsRenegotiation is whether the Redis server may renegotiate TLS:
+	// TLSRenegotiateNever, the default, TLSRenegotiateOnce or TLSRenegotiateFreely.
+	TlsRenegotiation string `json:"tls_renegotiation"`
+
+	// KeyDerivation is how the key used for encryption is obtained from AesKey and
+	// PreviousAesKey: KeyDerivationRaw, the default, or KeyDerivationScrypt.
+	// KeyDerivationSalt is the scrypt salt, defaulting to KeyPrefix, and must stay
+	// the same for stored values to remain readable, including when changing
+	// KeyPrefix.
+	KeyDerivation     string `json:"key_derivation"`
+	KeyDerivationSalt string `json:"key_derivation_salt"`
+
+	// EncryptionAlgorithm is how values are encrypted with the key of AesKey:
+	// EncryptionAESGCM, EncryptionChaCha20Poly1305, or EncryptionNone to store
+	// them in the clear, for Redis deployments already encrypted at rest. It
+	// defaults to EncryptionAESGCM with an AES key, EncryptionNone without.
+	// Values stored with another algorithm, or before it was set, remain readable
+	// as long as the key is. Deterministic encryption always uses AES-GCM.
+	EncryptionAlgorithm string `json:"encryption_algorithm"`
+
+	// PreviousAesKey is the AES key used before AesKey, while rotating keys.
+	// Values encrypted with either key are read, values are always written with
+	// AesKey, and the values still encrypted with PreviousAesKey are re-encrypted
+	// in the background, one every ReencryptInterval. Can't be combined with
+	// EncryptKeys, whose key names are derived from the AES key.
+	PreviousAesKey string `json:"previous_aes_key"`
+
+	// ReencryptInterval is the pause between re-encrypting two values with AesKey
+	// when PreviousAesKey is set. Defaults to DefaultReencryptInterval.
+	ReencryptInterval Duration `json:"reencrypt_interval"`
+
+	// ReencryptConcurrency is how many workers re-encrypt values at once, each
+	// pausing ReencryptInterval after every value. Defaults to
+	// DefaultReencryptConcurrency.
+	ReencryptConcurrency int `json:"reencrypt_concurrency"`
+
+	// OnConnect is called on every new connection to Redis, to run the commands
+	// some deployments require before a connection can be used.
+	OnConnect func(ctx context.Context, cn *redis.Conn) error `json:"-"`
+
+	// AddressResolver returns the address of Redis, for deployments discovering it
+	// at runtime. It is called every time the client is built, and replaces Address
+	// along with Host and Port. ShardAddresses still take precedence.
+	AddressResolver func(ctx context.Context) (string, error) `json:"-"`
+
+	// ValueFormat is the format values are serialized in before encryption,
+	// ValueFormatDefault unless set. Serializer takes precedence when set.
+	ValueFormat string     `json:"value_format"`
+	Serializer  Serializer `json:"-"`
+
+	// Compression compresses values before they are serialized and encrypted:
+	// CompressionNone, the default, or CompressionGzip. Compressed values are
+	// read whatever the setting, so it can be changed at any time.
+	Compression string `json:"compression"`
+
+	// MeterProvider records the count and duration of Store, Load, Delete, List
+	// and Lock, by result, with OpenTelemetry metrics. Nothing is recorded when
+	// nil. Set it to otel.GetMeterProvider() to use the global one.
+	MeterProvider metric.MeterProvider `json:"-"`
+
+	// MetricsEnabled records the count, errors and duration of Store, Load,
+	// Delete, List and Lock, by operation, and the time Lock waits for locks,
+	// with Prometheus metrics registered with MetricsRegisterer, defaulting to
+	// the registerer Caddy serves metrics from.
+	MetricsEnabled    bool                  `json:"metrics_enabled"`
+	MetricsRegisterer prometheus.Registerer `json:"-"`
+
+	// EncryptKeys stores values under opaque key names, derived from the key with
+	// an HMAC, so domain names don't show up in Redis. Key names are kept
+	// encrypted in an index so List can still return them, at the cost of
+	// List reading and decrypting the entire index. Requires AesKey.
+	EncryptKeys bool `json:"encrypt_keys"`
+
+	// ShardAddresses distributes keys over several standalone Redis nodes, each key
+	// being stored on the node picked by hashing its name. Address is ignored when
+	// set. Changing the list of nodes makes the keys hashed to another node unreachable.
+	ShardAddresses []string `json:"shard_addresses"`
+
+	// ClusterEnabled connects to a Redis Cluster through Addresses, some of its nodes,
+	// instead of a standalone node. The value, metadata and lock of a key must be in
+	// the same slot, so it requires HashTagKeys. Address is ignored, and db must be 0.
+	ClusterEnabled bool     `json:"cluster_enabled"`
+	Addresses      []string `json:"addresses"`
+
+	// SentinelEnabled connects to the master named MasterName, found through the
+	// Redis Sentinels at SentinelAddresses, and follows it when they fail over to
+	// another node. Address is ignored. SentinelPassword authenticates with the
+	// Sentinels, Password with the master.
+	SentinelEnabled   bool     `json:"sentinel_enabled"`
+	MasterName        string   `json:"master_name"`
+	SentinelAddresses []string `json:"sentinel_addresses"`
+	SentinelPassword  string   `json:"sentinel_password"`
+
+	// PreferReplicaReads sends read-only commands, such as those of Load, Exists
+	// and Stat, to replicas, taking load off the primary, which still serves every
+	// write, such as those of Store, Delete and Lock. With ClusterEnabled reads go
+	// to a replica of the node serving the key, and with SentinelEnabled to the
+	// master or any of its replicas at random. Replication is asynchronous, so a
+	// read may miss what was just written, even by this instance, until the
+	// replica catches up. SCAN still runs on the masters, where every key is.
+	// Requires ClusterEnabled or SentinelEnabled.
+	PreferReplicaReads bool `json:"prefer_replica_reads"`
+
+	// AccountStorageAddress stores ACME account keys, the keys under
+	// acme/<issuer>/users/, on a separate Redis node, so they can be kept on a
+	// more durable one than certificates. Account keys stored there never expire
+	// and are always read back after writing, as with VerifyWrites. Can't be
+	// combined with EncryptKeys, which hides which keys are account keys.
+	AccountStorageAddress string `json:"account_storage_address"`
+
+	// EscapeKeySegments percent-encodes every segment of a key before using it as
+	// a Redis key, so a segment can't be confused with the separator or SCAN
+	// pattern characters. Keys stored without it enabled are no longer found.
+	EscapeKeySegments bool `json:"escape_key_segments"`
+
+	// HashTagKeys appends a Redis Cluster hash tag, derived from the directory of
+	// the key, to every Redis key, so the certificate, private key and metadata of
+	// a site, which certmagic stores side by side, and their locks hash to the same
+	// slot. Keys stored without it enabled are no longer found.
+	HashTagKeys bool `json:"hash_tag_keys"`
+
+	// DeterministicEncryption derives the nonce from the key and value instead of
+	// generating a random one, so the same value stored under the same key
+	// always encrypts to the same bytes. Only the value is encrypted this way;
+	// the modified time is stored next to it unencrypted. This leaks whether
+	// a value changed, so it is opt-in.
+	DeterministicEncryption bool `json:"deterministic_encryption"`
+
+	// CircuitBreakerThreshold is the number of consecutive failed Redis commands,
+	// within CircuitBreakerWindow, after which commands fail fast with
+	// ErrCircuitOpen for CircuitBreakerCooldown. 0 disables the circuit breaker.
+	CircuitBreakerThreshold int      `json:"circuit_breaker_threshold"`
+	CircuitBreakerWindow    Duration `json:"circuit_breaker_window"`
+	CircuitBreakerCooldown  Duration `json:"circuit_breaker_cooldown"`
+
+	// RateLimit caps the Redis commands sent by this instance, over all the nodes, to
+	// that many per second, in bursts of up to a second's worth. Commands over the
+	// limit wait, until their context is done. 0 doesn't limit them.
+	RateLimit float64 `json:"rate_limit"`
+
+	// ReadPrefixes are additional, read-only key prefixes. Load, Exists and Stat
+	// fall back to them, in order, when a key is missing under KeyPrefix, while
+	// Store always writes under KeyPrefix. This allows migrating to a new
+	// KeyPrefix without downtime. Delete leaves a tombstone under KeyPrefix
+	// instead of touching them, so deleted keys aren't read back from them.
+	ReadPrefixes []string `json:"read_prefixes"`
+
+	// ListOrder is the order and shape of List results. By default keys are
+	// returned in no particular order. ListOrderFilesystem matches
+	// certmagic.FileStorage, see filesystemList.
+	ListOrder string `json:"list_order"`
+
+	// ListConsistency is how keys are listed, ListConsistencyScan unless set.
+	// ListConsistencyKeys is only suitable for small keyspaces, see README.
+	ListConsistency string `json:"list_consistency"`
+
+	// ListReadPrefixes makes List include the keys stored under ReadPrefixes
+	ListReadPrefixes bool `json:"list_read_prefixes"`
+
+	// MaxScanIterations is how many SCAN commands a single listing may issue
+	// before giving up with an error, protecting against servers whose cursor
+	// never returns to 0. Defaults to DefaultMaxScanIterations.
+	MaxScanIterations int `json:"max_scan_iterations"`
+
+	// ScanCount is the COUNT hint of the SCAN commands issued by List, trading
+	// round trips for the size of every reply. It defaults to ScanCount, and can
+	// be changed at runtime with UpdateTunables.
+	ScanCount int64 `json:"scan_count"`
+
+	// DeleteBatchSize is how many keys DeletePrefix deletes per DEL command, so
+	// large deletions don't block Redis. Defaults to DefaultDeleteBatchSize.
+	DeleteBatchSize int `json:"delete_batch_size"`
+
+	// TTLPatterns expire the keys matching one of the patterns after its TTL.
+	// Keys matching none of them, which should include all certificates, never expire.
+	TTLPatterns []TTLPattern `json:"ttl_patterns"`
+
+	// PolicyFunc returns the policy the value of a key is stored with, its
+	// expiration and encryption, instead of DefaultPolicy, which follows
+	// TTLPatterns and DeterministicEncryption. Keys stored on the account
+	// storage never expire, whatever it returns.
+	PolicyFunc func(key string) EntryPolicy `json:"-"`
+
+	// Namespace separates the keys of several tenants sharing a Redis database
+	// and KeyPrefix: keys are stored under KeyPrefix/Namespace, and List, the
+	// sweepers and every other operation only ever see those of their own
+	// namespace. It must not contain a separator or SCAN pattern characters.
+	Namespace string `json:"namespace"`
+
+	// ClusterID identifies the cluster of instances sharing KeyPrefix. When set,
+	// it is recorded next to the keys on every Redis node, and BuildRedisClient
+	// fails with ErrClusterMismatch when another cluster recorded its own, so two
+	// clusters misconfigured with the same db and KeyPrefix can't overwrite each
+	// other's certificates.
+	ClusterID string `json:"cluster_id"`
+
+	// LockOwner is appended to the random token of every lock we obtain, after
+	// the ID unique to this instance, so the holder of a lock can be identified
+	// when inspecting Redis. "{hostname}" is replaced with the hostname of the machine.
+	LockOwner string `json:"lock_owner"`
+
+	// ConnectionName is set with CLIENT SETNAME on every connection to Redis, so
+	// the connections of this instance can be told apart in CLIENT LIST. "{hostname}"
+	// is replaced with the hostname of the machine. Defaults to DefaultConnectionName.
+	ConnectionName string `json:"connection_name"`
+
+	// LockRecordAcquired also appends the time a lock is obtained to its token,
+	// after LockOwner, so LockInfo can tell how long it has been held. As part of
+	// the token, it is set with the lock, by the same command.
+	LockRecordAcquired bool `json:"lock_record_acquired"`
+
+	// LockNotifications publishes the release of locks with Redis pub/sub, and makes
+	// Lock wait for them rather than only polling every LockPollInterval, so a
+	// contended lock is obtained as soon as it is released. Polling still catches
+	// locks which expire, and instances without this setting. Enable it on every
+	// instance for them to be woken up by each other.
+	LockNotifications bool `json:"lock_notifications"`
+
+	// LockFencing gives every lock obtained a fencing token, from a counter
+	// incremented each time the lock of a key is obtained, see FencingToken. A
+	// Store whose context carries a token, see WithFencingToken, fails with
+	// ErrFencedOut once the lock was obtained again since, so an instance which
+	// stalled past the expiration of its lock can't overwrite what the new holder
+	// wrote. The token is checked in the transaction writing the value, which
+	// requires the lock and the value on the same node: it can't be combined with
+	// ClusterEnabled, several ShardAddresses or AccountStorageAddress.
+	LockFencing bool `json:"lock_fencing"`
+
+	// DeleteLocks makes Delete also remove the lock key of the deleted key, if it
+	// was left without expiration. The check and the deletion are atomic, so locks
+	// that may still be held are always left alone.
+	DeleteLocks bool `json:"delete_locks"`
+
+	// LockTimeout is the TTL of the locks we obtain, after which the lock of an
+	// instance which stopped refreshing it can be obtained by another one.
+	// LockRefreshInterval is how often the locks we hold are refreshed, and
+	// LockPollInterval how often Lock checks whether a lock got released. They
+	// default to LockDuration, LockFreshnessInterval and LockPollInterval, and can
+	// be changed at runtime with UpdateTunables.
+	LockTimeout         Duration `json:"lock_timeout"`
+	LockRefreshInterval Duration `json:"lock_refresh_interval"`
+	LockPollInterval    Duration `json:"lock_poll_interval"`
+
+	// LockSweepInterval is how often lock keys without expiration are removed,
+	// see SweepLocks. 0 disables the sweeper.
+	LockSweepInterval Duration `json:"lock_sweep_interval"`
+
+	// AbandonedAfter is how long after their last modification values under
+	// certificates/ are considered abandoned, see SweepAbandoned. Certmagic
+	// rewrites the certificates it renews, so this should be well above their
+	// lifetime. Those are looked for every AbandonedSweepInterval, defaulting
+	// to DefaultAbandonedSweepInterval, and only logged unless DeleteAbandoned
+	// is set. 0 disables it.
+	AbandonedAfter         Duration `json:"abandoned_after"`
+	AbandonedSweepInterval Duration `json:"abandoned_sweep_interval"`
+	DeleteAbandoned        bool     `json:"delete_abandoned"`
+
+	// LockHeldWarnRefreshes is the number of times a held lock can be refreshed
+	// before a warning is logged, and logged again every so many refreshes.
+	// Defaults to DefaultLockHeldWarnRefreshes, a negative value disables it.
+	LockHeldWarnRefreshes int `json:"lock_held_warn_refreshes"`
+
+	// ConnectRetries is the number of times the initial Ping is retried when Redis
+	// isn't reachable yet. Defaults to DefaultConnectRetries, a negative value disables it.
+	ConnectRetries int `json:"connect_retries"`
+
+	// ConnectBackoff is the wait before the first retry of the initial Ping, doubled
+	// on every following retry. Defaults to DefaultConnectBackoff.
+	ConnectBackoff Duration `json:"connect_backoff"`
+
+	// MaxRetries is the number of times a command is retried when it fails with a
+	// transient error, such as the connection dropping during a failover, waiting
+	// between MinRetryBackoff and MaxRetryBackoff before each retry. Defaults to
+	// DefaultMaxRetries, a negative value disables it.
+	MaxRetries      int      `json:"max_retries"`
+	MinRetryBackoff Duration `json:"min_retry_backoff"`
+	MaxRetryBackoff Duration `json:"max_retry_backoff"`
+
+	// PoolSize is the maximum number of connections to every Redis node, defaulting
+	// to DefaultPoolSizePerCPU per GOMAXPROCS. MinIdleConns connections are kept
+	// open even when idle, others are closed once idle for ConnMaxIdleTime, which
+	// defaults to DefaultConnMaxIdleTime. When all the connections are busy, a
+	// command waits up to PoolTimeout for one, which defaults to Timeout plus a
+	// second.
+	PoolSize        int      `json:"pool_size"`
+	MinIdleConns    int      `json:"min_idle_conns"`
+	PoolTimeout     Duration `json:"pool_timeout"`
+	ConnMaxIdleTime Duration `json:"conn_max_idle_time"`
+
+	// WarmupConnections is the number of connections to every Redis node opened
+	// when building the client, see Warmup, so the first requests don't wait for
+	// them. Disabled when 0.
+	WarmupConnections int `json:"warmup_connections"`
+
+	// ReadyTimeout makes building the client wait up to this long for the storage
+	// to be ready, see WaitReady, and fail with ErrNotReady otherwise, so Caddy
+	// doesn't start without the certificates it expects. Disabled when 0.
+	ReadyTimeout Duration `json:"ready_timeout"`
+
+	// ReadyKeys are keys which must be loaded and decrypted for the storage to be
+	// ready, such as the certificate of the main site.
+	ReadyKeys []string `json:"ready_keys"`
+
+	// SlowOpThreshold logs a warning when a single Store, Load, Delete, List or
+	// Lock takes longer than this, including the time Lock waits for the lock to
+	// be released. Disabled when 0.
+	SlowOpThreshold Duration `json:"slow_op_threshold"`
+
+	// DeadlineMargin makes Redis operations give up this long before the deadline
+	// of the context they are called with, and fail with ErrTimeout, so the caller
+	// gets a storage error rather than its own deadline expiring mid-operation.
+	// Disabled when 0.
+	DeadlineMargin Duration `json:"deadline_margin"`
+
+	// ClockSkewWarnThreshold logs a warning when building the client if the local
+	// clock is off from the Redis server clock by more than this. 0 disables the check.
+	ClockSkewWarnThreshold Duration `json:"clock_skew_warn_threshold"`
+
+	// HealthCheckInterval is how often every Redis node is pinged in the background,
+	// logging when they stop answering and when they answer again, so an outage is
+	// noticed before certmagic fails to load or store. 0 disables it.
+	HealthCheckInterval Duration `json:"health_check_interval"`
+
+	// UseServerTime records the Redis server time as modified time of stored
+	// values, instead of the local time, so clock skew between instances doesn't
+	// matter. It costs an additional round trip per Store.
+	UseServerTime bool `json:"use_server_time"`
+
+	// LightStat stores the modified time and size of every value in a cleartext
+	// metadata key next to it, so Stat can read those without fetching and
+	// decrypting the value. Values stored without metadata fall back to a full read.
+	LightStat bool `json:"light_stat"`
+
+	// VerifyWrites reads every value back after storing it, and fails Store if it
+	// can't be read or decrypted, or doesn't match. This doubles the round-trips of Store.
+	VerifyWrites bool `json:"verify_writes"`
+
+	// StoreIfNewer makes Store only overwrite a value modified before the one being
+	// stored, failing with ErrStaleWrite otherwise, so an instance whose clock is
+	// behind can't replace a certificate renewed by another one. The stored value
+	// is read and the new one written in a single WATCH/MULTI transaction, which
+	// costs Store an extra round-trip.
+	StoreIfNewer bool `json:"store_if_newer"`
+
+	// ValidateCertData rejects storing certificates and private keys under
+	// certmagic's certificates/ path that don't parse as PEM, to catch corrupt
+	// data when it is written rather than at the next handshake.
+	ValidateCertData bool `json:"validate_cert_data"`
+
+	// ClientSideCache keeps the values read from Redis in memory, and serves them
+	// from there until Redis reports they changed, with CLIENT TRACKING, which
+	// requires Redis 6. A connection to every node is dedicated to receiving
+	// those reports, and values are read from Redis while it is down. Values
+	// written by other instances may still be served for the short time the
+	// report takes to arrive.
+	ClientSideCache bool `json:"client_side_cache"`
+
+	// ClientSideCacheSize is the most values the client-side cache holds, the
+	// least recently used being evicted first. Defaults to DefaultClientSideCacheSize.
+	ClientSideCacheSize int `json:"client_side_cache_size"`
+
+	// TrackServedKeys remembers the keys stored or loaded, and logs a warning and
+	// counts it in UnexpectedMisses when one can later no longer be found without
+	// having been deleted through this storage, or when a value can't be decrypted.
+	// Certmagic issues certificates again in both cases, so this warns before rate
+	// limits are hit. Keys matching TTLPatterns aren't tracked, keys deleted by
+	// other instances are reported too. The keys are kept in memory.
+	TrackServedKeys bool `json:"track_served_keys"`
+
+	locks      *lockSet
+	refresher  *lockRefresher
+	tunables   *tunables
+	servedKeys *servedKeys
+	cache      *clientCache
+	metrics    *operationMetrics
+	prometheus *prometheusMetrics
+	limiter    *rateLimiter
+
+	// shards are the Redis nodes keys are distributed over, Client is the first one
+	shards []shard
+	// accounts is the node at AccountStorageAddress, nil if unset
+	accounts *shard
+
+	// tlsRootCAs and tlsCertificates are loaded from the TLS files when building
+	// the client, nil when unset
+	tlsRootCAs      *x509.CertPool
+	tlsCertificates []tls.Certificate
+	// cancel cancels ctx, stopping the background goroutines tracked by background
+	cancel     context.CancelFunc
+	background *sync.WaitGroup
+}
+
+// StorageData describe the data that is stored in KV storage
+type StorageData struct {
+	Value    []byte    `json:"value"`
+	Modified time.Time `json:"modified"`
+}
+
+// TTLPattern expires the keys matching Pattern after TTL
+type TTLPattern struct {
+	// Pattern is matched against keys with path.Match, so * doesn't match the / separator
+	Pattern string   `json:"pattern"`
+	TTL     Duration `json:"ttl"`
+	// Sliding resets the TTL of the keys every time they are loaded, so only
+	// those not loaded for TTL expire
+	Sliding bool `json:"sliding"`
+}
+
+// StorageMetadata describe the cleartext metadata stored next to a value when LightStat is enabled
+type StorageMetadata struct {
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+}
+
+// CertMagicStorage converts s to a certmagic.Storage instance.
+func (rd *RedisStorage) CertMagicStorage() (certmagic.Storage, error) {
+	return rd, nil
+}
+
+// keyPrefix returns the prefix of the Redis keys of this instance, KeyPrefix
+// followed by Namespace when set
+func (rd *RedisStorage) keyPrefix() string {
+	if rd.Namespace == "" {
+		return rd.KeyPrefix
+	}
+	return path.Join(rd.KeyPrefix, rd.Namespace)
+}
+
+// helper function to prefix key
+func (rd *RedisStorage) prefixKey(key string) string {
+	return rd.redisKey(rd.keyPrefix(), key)
+}
+
+// helper function to get the metadata key of key
+func (rd *RedisStorage) metadataKey(key string) string {
+	return rd.prefixKey(key) + metadataKeySuffix
+}
+
+// helper function to get the tombstone key of key
+func (rd *RedisStorage) tombstoneKey(key string) string {
+	return rd.prefixKey(key) + tombstoneKeySuffix
+}
+
+// helper function to get the creation time key of key
+func (rd *RedisStorage) createdKey(key string) string {
+	return rd.prefixKey(key) + createdKeySuffix
+}
+
+// Validate checks the configuration without connecting to Redis, and returns an
+// error naming the first invalid setting. It reads PasswordFile and AesKeyFile,
+// and builds Address from Host and Port when it isn't set. BuildRedisClient
+// calls it first, so misconfigurations fail before any connection is attempted.
+func (rd *RedisStorage) Validate() error {
+	if rd.Address == "" && rd.AddressResolver == nil && len(rd.ShardAddresses) == 0 && !rd.ClusterEnabled && !rd.SentinelEnabled {
+		if rd.Host == "" || rd.Port == "" {
+			return fmt.Errorf("redis address requires either address, or host and port, got host %q and port %q", rd.Host, rd.Port)
+		}
+		rd.Address = net.JoinHostPort(rd.Host, rd.Port)
+	}
+	if rd.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative, got %d", rd.Timeout)
+	}
+	if rd.DB < 0 {
+		return fmt.Errorf("db must not be negative, got %d", rd.DB)
+	}
+	if err := checkKeyPrefix("key prefix", rd.KeyPrefix); err != nil {
+		return err
+	}
+	for _, prefix := range rd.ReadPrefixes {
+		if err := checkKeyPrefix("read prefix", prefix); err != nil {
+			return err
+		}
+	}
+	for _, pattern := range rd.TTLPatterns {
+		if _, err := path.Match(pattern.Pattern, ""); err != nil {
+			return fmt.Errorf("ttl pattern %q: %v", pattern.Pattern, err)
+		}
+		if pattern.TTL <= 0 {
+			return fmt.Errorf("ttl pattern %q requires a positive ttl, got %v", pattern.Pattern, time.Duration(pattern.TTL))
+		}
+	}
+
+	if err := rd.readSecretFiles(); err != nil {
+		return err
+	}
+	if err := rd.deriveAESKeys(); err != nil {
+		return err
+	}
+	if err := rd.checkEncryption(); err != nil {
+		return err
+	}
+	if rd.EncryptKeys && rd.encryptionAlgorithm() == EncryptionNone {
+		return fmt.Errorf("encrypting keys requires an AES key")
+	}
+	if _, err := tlsRenegotiation(rd.TlsRenegotiation); err != nil {
+		return err
+	}
+	if _, err := tlsMinVersion(rd.TlsMinVersion); err != nil {
+		return err
+	}
+	if err := rd.loadTLSFiles(); err != nil {
+		return err
+	}
+	if rd.EncryptKeys && rd.PreviousAesKey != "" {
+		return fmt.Errorf("rotating the AES key can't be combined with encrypting keys")
+	}
+	if rd.EncryptKeys && rd.AccountStorageAddress != "" {
+		return fmt.Errorf("account storage can't be combined with encrypting keys")
+	}
+	if rd.SentinelEnabled {
+		switch {
+		case rd.MasterName == "":
+			return fmt.Errorf("redis sentinel requires the name of the master")
+		case len(rd.SentinelAddresses) == 0:
+			return fmt.Errorf("redis sentinel requires at least one sentinel address")
+		case rd.ClusterEnabled:
+			return fmt.Errorf("redis sentinel can't be combined with redis cluster")
+		case len(rd.ShardAddresses) > 0:
+			return fmt.Errorf("redis sentinel can't be combined with shard addresses")
+		case rd.ClientSideCache:
+			return fmt.Errorf("redis sentinel can't be combined with the client-side cache")
+		}
+	}
+	if rd.LockFencing && (rd.ClusterEnabled || len(rd.ShardAddresses) > 1 || rd.AccountStorageAddress != "") {
+		return fmt.Errorf("lock fencing can't be combined with redis cluster, several shard addresses or account storage")
+	}
+	if rd.PreferReplicaReads && !rd.ClusterEnabled && !rd.SentinelEnabled {
+		return fmt.Errorf("replica reads require redis cluster or sentinel")
+	}
+	switch rd.Network {
+	case "", NetworkTCP:
+	case NetworkUnix:
+		if rd.SentinelEnabled || rd.ClusterEnabled {
+			return fmt.Errorf("unix sockets can't be combined with redis sentinel or cluster")
+		}
+	default:
+		return fmt.Errorf("unknown network %q", rd.Network)
+	}
+	if rd.ClusterEnabled {
+		switch {
+		case len(rd.Addresses) == 0:
+			return fmt.Errorf("redis cluster requires at least one address")
+		case !rd.HashTagKeys:
+			return fmt.Errorf("redis cluster requires hash tag keys, so the keys of a value are in the same slot")
+		case rd.DB != 0:
+			return fmt.Errorf("redis cluster only has db 0, got db %d", rd.DB)
+		case len(rd.ShardAddresses) > 0:
+			return fmt.Errorf("redis cluster can't be combined with shard addresses")
+		case rd.EncryptKeys:
+			return fmt.Errorf("redis cluster can't be combined with encrypting keys, the key index is in another slot")
+		case rd.ClientSideCache:
+			return fmt.Errorf("redis cluster can't be combined with the client-side cache")
+		}
+	}
+	if strings.ContainsAny(rd.Namespace, "/*?[]\\") {
+		return fmt.Errorf("namespace %q must not contain a separator or pattern characters", rd.Namespace)
+	}
+	if rd.ListConsistency != "" && rd.ListConsistency != ListConsistencyScan && rd.ListConsistency != ListConsistencyKeys {
+		return fmt.Errorf("unknown list consistency %q", rd.ListConsistency)
+	}
+	if err := rd.checkCompression(); err != nil {
+		return err
+	}
+
+	configuredTunables := rd.configuredTunables()
+	if err := configuredTunables.validate(); err != nil {
+		return fmt.Errorf("invalid tunables: %v", err)
+	}
+	return nil
+}
+
+// checkKeyPrefix checks prefix, the setting named name, doesn't begin or end with
+// a separator and has no empty, . or .. segment, so keys are stored under the
+// prefix as written rather than the one path.Join cleans it to
+func checkKeyPrefix(name, prefix string) error {
+	if prefix != "" && (strings.HasPrefix(prefix, "/") || path.Clean(prefix) != prefix) {
+		return fmt.Errorf("%s %q must not begin or end with a separator, or contain empty, . or .. segments", name, prefix)
+	}
+	return nil
+}
+
+// GetRedisStorage build RedisStorage with it's client
+func (rd *RedisStorage) BuildRedisClient() error {
+	// stop the refreshers and the sweeper of a previous build, so they don't
+	// outlive the clients they use
+	rd.stopBackground()
+	rd.ctx, rd.cancel = context.WithCancel(context.Background())
+	rd.background = &sync.WaitGroup{}
+	if rd.Logger == nil {
+		rd.Logger = zap.NewNop().Sugar()
+	}
+
+	if err := rd.Validate(); err != nil {
+		return err
+	}
+	configuredTunables := rd.configuredTunables()
+
+	if rd.DeleteBatchSize <= 0 {
+		rd.DeleteBatchSize = DefaultDeleteBatchSize
+	}
+	if rd.ClientSideCacheSize <= 0 {
+		rd.ClientSideCacheSize = DefaultClientSideCacheSize
+	}
+	if rd.LockHeldWarnRefreshes == 0 {
+		rd.LockHeldWarnRefreshes = DefaultLockHeldWarnRefreshes
+	}
+
+	if rd.CircuitBreakerThreshold > 0 {
+		if rd.CircuitBreakerWindow == 0 {
+			rd.CircuitBreakerWindow = Duration(DefaultCircuitBreakerWindow)
+		}
+		if rd.CircuitBreakerCooldown == 0 {
+			rd.CircuitBreakerCooldown = Duration(DefaultCircuitBreakerCooldown)
+		}
+	}
+
+	if rd.AbandonedSweepInterval == 0 {
+		rd.AbandonedSweepInterval = Duration(DefaultAbandonedSweepInterval)
+	}
+	if rd.ReencryptInterval == 0 {
+		rd.ReencryptInterval = Duration(DefaultReencryptInterval)
+	}
+	if rd.ReencryptConcurrency <= 0 {
+		rd.ReencryptConcurrency = DefaultReencryptConcurrency
+	}
+	if rd.ConnectRetries == 0 {
+		rd.ConnectRetries = DefaultConnectRetries
+	}
+	if rd.ConnectBackoff == 0 {
+		rd.ConnectBackoff = Duration(DefaultConnectBackoff)
+	}
+	if rd.MinRetryBackoff == 0 {
+		rd.MinRetryBackoff = Duration(DefaultMinRetryBackoff)
+	}
+	if rd.MaxRetryBackoff == 0 {
+		rd.MaxRetryBackoff = Duration(DefaultMaxRetryBackoff)
+	}
+	if rd.PoolSize < 0 || rd.MinIdleConns < 0 || rd.PoolTimeout < 0 || rd.ConnMaxIdleTime < 0 {
+		return fmt.Errorf("connection pool settings must not be negative")
+	}
+	if rd.PoolSize == 0 {
+		rd.PoolSize = DefaultPoolSizePerCPU * runtime.GOMAXPROCS(0)
+	}
+	if rd.PoolTimeout == 0 {
+		rd.PoolTimeout = Duration(time.Second*time.Duration(rd.Timeout) + time.Second)
+	}
+	if rd.ConnMaxIdleTime == 0 {
+		rd.ConnMaxIdleTime = Duration(DefaultConnMaxIdleTime)
+	}
+	if rd.MinRetryBackoff < 0 || rd.MaxRetryBackoff < rd.MinRetryBackoff {
+		return fmt.Errorf("retry backoffs must be positive, with the maximum not below the minimum, got %v and %v",
+			time.Duration(rd.MinRetryBackoff), time.Duration(rd.MaxRetryBackoff))
+	}
+
+	if rd.RateLimit < 0 {
+		return fmt.Errorf("rate limit must not be negative, got %v", rd.RateLimit)
+	}
+	rd.limiter = nil
+	if rd.RateLimit > 0 {
+		rd.limiter = newRateLimiter(rd.RateLimit)
+	}
+
+	rd.prometheus = nil
+	if rd.MetricsEnabled {
+		metrics, err := rd.registerPrometheusMetrics()
+		if err != nil {
+			return fmt.Errorf("unable to register metrics: %v", err)
+		}
+		rd.prometheus = metrics
+	}
+	rd.metrics = nil
+	if rd.MeterProvider != nil {
+		metrics, err := newOperationMetrics(rd.MeterProvider)
+		if err != nil {
+			return fmt.Errorf("unable to create metric instruments: %v", err)
+		}
+		rd.metrics = metrics
+	}
+
+	if rd.AddressResolver != nil && len(rd.ShardAddresses) == 0 && !rd.ClusterEnabled && !rd.SentinelEnabled {
+		address, err := rd.resolveAddress()
+		if err != nil {
+			return err
+		}
+		rd.Address = address
+	}
+
+	addresses := rd.ShardAddresses
+	if len(addresses) == 0 {
+		addresses = []string{rd.Address}
+	}
+
+	shards := make([]shard, 0, len(addresses))
+	if rd.SentinelEnabled {
+		s, err := rd.connectSentinel()
+		if err != nil {
+			return err
+		}
+		shards = append(shards, s)
+	} else if rd.ClusterEnabled {
+		s, err := rd.connectCluster(rd.Addresses)
+		if err != nil {
+			return err
+		}
+		shards = append(shards, s)
+	} else {
+		for _, address := range addresses {
+			s, err := rd.connectShard(address)
+			if err != nil {
+				return err
+			}
+			shards = append(shards, s)
+		}
+	}
+
+	rd.accounts = nil
+	if rd.AccountStorageAddress != "" {
+		accounts, err := rd.connectShard(rd.AccountStorageAddress)
+		if err != nil {
+			return fmt.Errorf("unable to connect to account storage: %w", err)
+		}
+		rd.accounts = &accounts
+	}
+
+	rd.shards = shards
+	rd.Client = shards[0].client
+	rd.ClientLocker = shards[0].locker
+	// locks obtained before building the client again belong to a previous instance
+	if rd.locks != nil {
+		rd.locks.retire()
+	}
+	rd.locks = newLockSet()
+	rd.refresher = newLockRefresher()
+	if rd.tunables == nil {
+		rd.tunables = &tunables{current: configuredTunables}
+	}
+	if rd.servedKeys == nil {
+		rd.servedKeys = &servedKeys{}
+	}
+	rd.cache = nil
+	if rd.ClientSideCache {
+		rd.cache = newClientCache(rd.clients(), rd.ClientSideCacheSize)
+	}
+
+	rd.checkClockSkew(rd.ctx)
+
+	if rd.WarmupConnections > 0 {
+		// only a head start, the connections are opened on demand otherwise
+		if err := rd.Warmup(rd.ctx, rd.WarmupConnections); err != nil {
+			rd.Logger.Warnf("[WARNING] Unable to warm up Redis connections: %v", err)
+		}
+	}
+
+	if rd.ReadyTimeout > 0 {
+		ctx, cancel := context.WithTimeout(rd.ctx, time.Duration(rd.ReadyTimeout))
+		err := rd.WaitReady(ctx)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, refresher := rd.ctx, rd.refresher
+	rd.goBackground(func() { rd.keepRedisLocksFresh(ctx, refresher) })
+	if rd.HealthCheckInterval > 0 {
+		ctx := rd.ctx
+		rd.goBackground(func() { rd.checkHealthPeriodically(ctx) })
+	}
+	if rd.LockSweepInterval > 0 {
+		ctx := rd.ctx
+		rd.goBackground(func() { rd.sweepLocksPeriodically(ctx) })
+	}
+	if rd.ClientSideCache {
+		// refused along with ClusterEnabled and SentinelEnabled, so every client is a single node
+		for _, client := range rd.clients() {
+			ctx, client := rd.ctx, client.(*redis.Client)
+			rd.goBackground(func() { rd.trackInvalidations(ctx, client) })
+		}
+	}
+	if rd.AbandonedAfter > 0 {
+		ctx := rd.ctx
+		rd.goBackground(func() { rd.sweepAbandonedPeriodically(ctx) })
+	}
+	if rd.PreviousAesKey != "" {
+		ctx := rd.ctx
+		rd.goBackground(func() { rd.reencryptInBackground(ctx) })
+	}
+	return nil
+}
+
+// resolveAddress returns the address returned by AddressResolver, within Timeout
+func (rd *RedisStorage) resolveAddress() (string, error) {
+	ctx, cancel := context.WithTimeout(rd.ctx, time.Second*time.Duration(rd.Timeout))
+	defer cancel()
+	address, err := rd.AddressResolver(ctx)
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve Redis address: %w", err)
+	}
+	if address == "" {
+		return "", fmt.Errorf("unable to resolve Redis address: resolver returned no address")
+	}
+	return address, nil
+}
+
+// goBackground runs fn in a goroutine that stopBackground waits for. fn must return once rd.ctx is done.
+func (rd *RedisStorage) goBackground(fn func()) {
+	background := rd.background
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		fn()
+	}()
+}
+
+// Cleanup stops all background goroutines and waits for them to exit, releases the
+// locks still held, so the next instance doesn't wait for them to expire, and closes
+// the clients. The storage can't be used anymore afterwards.
+func (rd *RedisStorage) Cleanup() error {
+	if rd.cancel == nil {
+		// client never built, or already cleaned up
+		return nil
+	}
+	rd.stopBackground()
+	rd.cancel = nil
+
+	err := rd.releaseLocks()
+	for _, client := range rd.clients() {
+		if client == nil {
+			// the build failed before connecting
+			continue
+		}
+		if closeErr := client.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("unable to close Redis client: %v", closeErr)
+		}
+	}
+	return err
+}
+
+// stopBackground stops all background goroutines and waits for them to exit
+func (rd *RedisStorage) stopBackground() {
+	if rd.cancel == nil {
+		return
+	}
+	rd.cancel()
+	rd.background.Wait()
+}
+
+// releaseLocks releases all the locks held, and returns the first error releasing
+// one, after trying to release the others. Locks which expired meanwhile are skipped.
+func (rd *RedisStorage) releaseLocks() error {
+	if rd.locks == nil {
+		return nil
+	}
+	// rd.ctx is done, the storage is being cleaned up
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(rd.Timeout))
+	defer cancel()
+
+	var firstErr error
+	rd.locks.Range(func(keyI, lockI interface{}) bool {
+		key := keyI.(string)
+		if lock, ok := lockI.(*redislock.Lock); ok && rd.locks.owns(key, lock) {
+			err := lock.Release(ctx)
+			if err == nil {
+				rd.publishLockReleased(ctx, key)
+			} else if err != redislock.ErrLockNotHeld && firstErr == nil {
+				firstErr = fmt.Errorf("unable to release lock %s: %v", key, err)
+			}
+		}
+		rd.locks.Delete(key)
+		rd.locks.fences.Delete(key)
+		return true
+	})
+	rd.locks.retire()
+	return firstErr
+}
+
+// ping checks the connection to Redis, retrying with an exponential backoff
+// as Redis may be started after us, until the storage is stopped
+func (rd *RedisStorage) ping(redisClient redis.UniversalClient, address string) error {
+	backoff := time.Duration(rd.ConnectBackoff)
+	for attempt := 0; ; attempt++ {
+		err := redisClient.Ping(rd.ctx).Err()
+		// a wrong password or DB won't fix itself
+		if err == nil || attempt >= rd.ConnectRetries || hasErrorPrefix(err, "NOAUTH") || hasErrorPrefix(err, "WRONGPASS") || isDBOutOfRange(err) {
+			return err
+		}
+
+		rd.Logger.Warnf("[WARNING] Unable to reach Redis at %s, retrying in %v: %v", address, backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-rd.ctx.Done():
+			timer.Stop()
+			return err
+		}
+		if backoff *= 2; backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// Store values at key
+func (rd RedisStorage) Store(ctx context.Context, key string, value []byte) error {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	start := time.Now()
+	defer rd.logSlow("Store", key, start)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	err := rd.store(opCtx, key, value)
+	if err == nil && (rd.VerifyWrites || rd.storesAccount(key)) {
+		err = rd.verifyWrite(opCtx, key, value)
+	}
+	if err == nil {
+		rd.trackServed(key)
+	}
+	err = classifyTimeout(ctx, opCtx, err)
+	rd.recordOperation(ctx, "Store", start, err)
+	return err
+}
+
+// StoreUnsafe stores value at key like Store, without any coordination: it
+// takes no lock and, unlike Store, doesn't read the value back even with
+// VerifyWrites. It is meant for tooling that writes many values, such as a bulk
+// import, and makes sure by itself that no one else writes the same keys.
+// Certmagic never calls it.
+func (rd RedisStorage) StoreUnsafe(ctx context.Context, key string, value []byte) error {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	err := rd.store(opCtx, key, value)
+	if err == nil {
+		rd.trackServed(key)
+	}
+	return classifyTimeout(ctx, opCtx, err)
+}
+
+// verifyWrite checks that the value stored at key is value
+func (rd RedisStorage) verifyWrite(ctx context.Context, key string, value []byte) error {
+	stored, err := rd.load(ctx, key)
+	if err != nil {
+		return fmt.Errorf("%w for %v: %v", ErrWriteVerification, key, err)
+	}
+	if !bytes.Equal(stored, value) {
+		return fmt.Errorf("%w for %v: value read back differs", ErrWriteVerification, key)
+	}
+	return nil
+}
+
+func (rd RedisStorage) store(ctx context.Context, key string, value []byte) error {
+	modified, err := rd.now(ctx)
+	if err != nil {
+		return fmt.Errorf("unable to get time for %v: %v", key, err)
+	}
+	return rd.storeModified(ctx, key, value, modified)
+}
+
+// storeModified stores value at key with modified as its modified time
+func (rd RedisStorage) storeModified(ctx context.Context, key string, value []byte, modified time.Time) error {
+	if rd.ValidateCertData {
+		if err := validateCertData(key, value); err != nil {
+			rd.Logger.Errorf("[ERROR] Refusing to store invalid certificate data: %v (key: %s)", err, key)
+			return fmt.Errorf("unable to store data for %v: %w", key, err)
+		}
+	}
+
+	data := &StorageData{
+		Value:    value,
+		Modified: modified,
+	}
+
+	encryptedValue, err := rd.encryptStorageData(key, data)
+	if err != nil {
+		return fmt.Errorf("unable to encode data for %v: %v", key, err)
+	}
+
+	// the expiration is set by the SET itself, so the key never exists without it
+	ttl := rd.keyTTL(key)
+
+	client := rd.clientFor(rd.prefixKey(key))
+
+	var metadata []byte
+	if rd.LightStat {
+		metadata, err = json.Marshal(&StorageMetadata{
+			Modified: data.Modified,
+			Size:     int64(len(value)),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to encode metadata for %v: %v", key, err)
+		}
+	}
+
+	var encryptedKey string
+	if rd.EncryptKeys {
+		encryptedKey, err = rd.encryptKeyName(key)
+		if err != nil {
+			return fmt.Errorf("unable to encrypt key name for %v: %v", key, err)
+		}
+	}
+
+	// write creation time, value, metadata and key index together, so they never disagree,
+	// unless the key index lives on another shard
+	indexClient := rd.clientFor(rd.keyIndex(rd.keyPrefix()))
+	commands := [][]interface{}{
+		rd.setCreatedCommand(key, modified, ttl),
+		setCommand(rd.prefixKey(key), encryptedValue, ttl),
+	}
+	if rd.LightStat {
+		commands = append(commands, setCommand(rd.metadataKey(key), metadata, ttl))
+	} else {
+		// metadata left from when LightStat was enabled would be stale, and
+		// used again if it ever is
+		commands = append(commands, []interface{}{"del", rd.metadataKey(key)})
+	}
+	if len(rd.ReadPrefixes) > 0 {
+		commands = append(commands, []interface{}{"del", rd.tombstoneKey(key)})
+	}
+	if rd.EncryptKeys && indexClient == client {
+		commands = append(commands, []interface{}{"hset", rd.keyIndex(rd.keyPrefix()), rd.opaqueKeyName(key), encryptedKey})
+	}
+	var watched []string
+	var checks []txCheck
+	if rd.StoreIfNewer {
+		watched = append(watched, rd.prefixKey(key))
+		checks = append(checks, rd.newerCheck(ctx, key, modified))
+	}
+	if fence, ok := fencingTokenFrom(ctx); ok && rd.LockFencing {
+		watched = append(watched, rd.fenceKey(fence.key))
+		checks = append(checks, rd.fenceCheck(ctx, fence))
+	}
+	if len(checks) > 0 {
+		err = execChecked(ctx, client, watched, checks, commands)
+	} else {
+		_, err = execTx(ctx, client, commands)
+	}
+	rd.invalidateCached(rd.prefixKey(key))
+	if errors.Is(err, ErrStaleWrite) || errors.Is(err, ErrFencedOut) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("unable to store data for %v: %w", key, classifyWriteError(err))
+	}
+	if rd.EncryptKeys && indexClient != client {
+		if err := indexClient.HSet(ctx, rd.keyIndex(rd.keyPrefix()), rd.opaqueKeyName(key), encryptedKey).Err(); err != nil {
+			return fmt.Errorf("unable to store key index entry for %v: %w", key, classifyWriteError(err))
+		}
+	}
+
+	return nil
+}
+
+// keyTTL returns the expiration of key set by its policy, or 0 for no expiration.
+// Keys stored on the account storage never expire.
+func (rd RedisStorage) keyTTL(key string) time.Duration {
+	if rd.storesAccount(key) {
+		return 0
+	}
+	return rd.policy(key).TTL
+}
+
+// Load retrieves the value at key. Like every method, it reports a missing key
+// with an error matching fs.ErrNotExist, which is how certmagic tells misses apart.
+func (rd RedisStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	start := time.Now()
+	defer rd.logSlow("Load", key, start)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	value, err := rd.load(opCtx, key)
+	if err == nil {
+		rd.trackServed(key)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		rd.trackMissing(key)
+	}
+	err = classifyTimeout(ctx, opCtx, err)
+	rd.recordOperation(ctx, "Load", start, err)
+	return value, err
+}
+
+func (rd RedisStorage) load(ctx context.Context, key string) ([]byte, error) {
+	var data *StorageData
+	var err error
+	if ttl := rd.keyTTL(key); ttl > 0 && rd.policy(key).SlidingTTL {
+		data, err = rd.getDataSliding(ctx, key, ttl)
+	} else {
+		data, err = rd.getDataDecrypted(ctx, key)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data.Value, nil
+}
+
+// Delete deletes key.
+func (rd RedisStorage) Delete(ctx context.Context, key string) error {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	start := time.Now()
+	defer rd.logSlow("Delete", key, start)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	err := rd.delete(opCtx, key)
+	if err == nil {
+		rd.trackDeleted(key)
+	}
+	err = classifyTimeout(ctx, opCtx, err)
+	rd.recordOperation(ctx, "Delete", start, err)
+	return err
+}
+
+func (rd RedisStorage) delete(ctx context.Context, key string) error {
+	if len(rd.ReadPrefixes) > 0 {
+		// the key may only exist under a read prefix
+		if _, err := rd.readData(ctx, key); err != nil {
+			return err
+		}
+	}
+
+	// the value, its metadata, its key index entry and its stale lock go
+	// together, in a single round trip, unless the key index lives on another shard
+	client := rd.clientFor(rd.prefixKey(key))
+	indexClient := rd.clientFor(rd.keyIndex(rd.keyPrefix()))
+	commands := [][]interface{}{
+		{"del", rd.prefixKey(key)},
+		{"del", rd.metadataKey(key)},
+		{"del", rd.createdKey(key)},
+	}
+	if len(rd.ReadPrefixes) > 0 {
+		// the read prefixes are left alone, the tombstone hides the key in them
+		commands = append(commands, []interface{}{"set", rd.tombstoneKey(key), ""})
+	}
+	if rd.EncryptKeys && indexClient == client {
+		commands = append(commands, []interface{}{"hdel", rd.keyIndex(rd.keyPrefix()), rd.opaqueKeyName(key)})
+	}
+	lockKey := rd.prefixKey(key) + lockKeySuffix
+	if rd.DeleteLocks {
+		commands = append(commands, []interface{}{"eval", deleteStaleLockSource, 1, lockKey})
+	}
+	results, err := execTx(ctx, client, commands)
+	rd.invalidateCached(rd.prefixKey(key))
+	if err != nil {
+		return fmt.Errorf("unable to delete data for key %s: %w", key, err)
+	}
+	if deleted, _ := results[0].(int64); deleted == 0 && len(rd.ReadPrefixes) == 0 {
+		return fs.ErrNotExist
+	}
+	if rd.DeleteLocks {
+		if deleted, _ := results[len(results)-1].(int64); deleted == 1 {
+			rd.Logger.Infof("[INFO] Removed lock without expiration (lock: %s)", lockKey)
+		}
+	}
+
+	if rd.EncryptKeys && indexClient != client {
+		if err := indexClient.HDel(ctx, rd.keyIndex(rd.keyPrefix()), rd.opaqueKeyName(key)).Err(); err != nil {
+			return fmt.Errorf("unable to delete key index entry for key %s: %v", key, err)
+		}
+	}
+
+	// a lock we hold on the key would otherwise be kept fresh, and found by the
+	// next Lock, long after the key is gone
+	if _, held := rd.locks.Load(key); held {
+		if err := rd.unlock(ctx, key); err != nil {
+			rd.Logger.Warnf("[WARNING] Unable to release the lock of a deleted key: %v (key: %s)", err, key)
+		}
+	}
+
+	return nil
+}
+
+// DeletePrefix deletes all keys under prefix, in batches of DeleteBatchSize keys,
+// and returns how many values were deleted, not counting those deleted by someone
+// else since they were scanned. Locks are left alone.
+func (rd RedisStorage) DeletePrefix(ctx context.Context, prefix string) (int, error) {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	deleted, err := rd.deletePrefix(opCtx, prefix)
+	return deleted, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd RedisStorage) deletePrefix(ctx context.Context, prefix string) (int, error) {
+	keys, err := rd.scanKeys(ctx, rd.keyPrefix(), prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for start := 0; start < len(keys); start += rd.DeleteBatchSize {
+		// let other clients' commands through between batches
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+
+		end := start + rd.DeleteBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		values := make(map[redis.UniversalClient][]string)
+		metadata := make(map[redis.UniversalClient][]string)
+		indexFields := make([]string, 0, end-start)
+		for _, key := range keys[start:end] {
+			if strings.HasSuffix(key, lockKeySuffix) {
+				continue
+			}
+			client := rd.clientFor(rd.prefixKey(key))
+			values[client] = append(values[client], rd.prefixKey(key))
+			metadata[client] = append(metadata[client], rd.metadataKey(key), rd.createdKey(key))
+			indexFields = append(indexFields, rd.opaqueKeyName(key))
+		}
+		if len(indexFields) == 0 {
+			continue
+		}
+
+		for client, batch := range values {
+			// values and metadata, with creation times, are deleted separately, so only values
+			// that still existed are counted
+			var deletedValues []*redis.IntCmd
+			_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				if _, cluster := client.(*redis.ClusterClient); cluster {
+					// the keys of a batch are in different slots, each is deleted on its own
+					for _, redisKey := range batch {
+						deletedValues = append(deletedValues, pipe.Del(ctx, redisKey))
+					}
+					for _, redisKey := range metadata[client] {
+						pipe.Del(ctx, redisKey)
+					}
+					return nil
+				}
+				deletedValues = append(deletedValues, pipe.Del(ctx, batch...))
+				pipe.Del(ctx, metadata[client]...)
+				return nil
+			})
+			if err != nil {
+				return deleted, fmt.Errorf("unable to delete keys under %s: %v", prefix, err)
+			}
+			for _, deletedValue := range deletedValues {
+				deleted += int(deletedValue.Val())
+			}
+			rd.invalidateCached(batch...)
+		}
+		for _, key := range keys[start:end] {
+			rd.trackDeleted(key)
+		}
+		if rd.EncryptKeys {
+			if err := rd.clientFor(rd.keyIndex(rd.keyPrefix())).HDel(ctx, rd.keyIndex(rd.keyPrefix()), indexFields...).Err(); err != nil {
+				return deleted, fmt.Errorf("unable to delete key index entries under %s: %v", prefix, err)
+			}
+		}
+	}
+
+	return deleted, nil
+}
+
+// Exists returns true if the key exists
+func (rd RedisStorage) Exists(ctx context.Context, key string) bool {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	ctx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	_, err := rd.readData(ctx, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		// Exists can't return the error, so a key which can't be read is only
+		// reported missing once the failure is logged
+		rd.Logger.Errorf("[ERROR] Unable to check whether key exists: %v (key: %s)", err, key)
+	}
+	return err == nil
+}
+
+// List returns all keys that match prefix.
+func (rd RedisStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	ctx = orBackground(ctx)
+	start := time.Now()
+	defer rd.logSlow("List", prefix, start)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	keys, err := rd.list(opCtx, prefix, recursive)
+	err = classifyTimeout(ctx, opCtx, err)
+	rd.recordOperation(ctx, "List", start, err)
+	return keys, err
+}
+
+func (rd RedisStorage) list(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	keysFound, err := rd.scanKeys(ctx, rd.keyPrefix(), prefix)
+	if err != nil {
+		return keysFound, err
+	}
+
+	// SCAN may return a key more than once, and with ListReadPrefixes the same
+	// key may be stored under several prefixes, the primary one listed first
+	seen := make(map[string]bool, len(keysFound))
+	keysFound = uniqueKeys(keysFound, seen)
+	if rd.ListReadPrefixes {
+		keys, err := rd.readPrefixKeys(ctx, prefix, seen)
+		if err != nil {
+			return keysFound, err
+		}
+		keysFound = append(keysFound, keys...)
+	}
+
+	if rd.ListOrder == ListOrderFilesystem {
+		return filesystemList(keysFound, prefix, recursive), nil
+	}
 
-// StorageData describe the data that is stored in KV storage
-type StorageData struct {
-	Value    []byte    `json:"value"`
-	Modified time.Time `json:"modified"`
-}
+	// if recursive wanted, or wildcard/empty prefix, just return all keys prefix is empty
+	if recursive || prefix == "*" || len(strings.TrimSpace(prefix)) == 0 {
+		return keysFound, nil
+	}
 
-// CertMagicStorage converts s to a certmagic.Storage instance.
-func (rd *RedisStorage) CertMagicStorage() (certmagic.Storage, error) {
-	return rd, nil
-}
+	// for non-recursive split path and look for unique keys just under given prefix
+	keysMap := make(map[string]bool)
+	for _, key := range keysFound {
+		rel, ok := trimListPrefix(key, prefix, "/")
+		if !ok {
+			continue
+		}
+		dir := strings.Split(rel, "/")
+		keysMap[dir[0]] = true
+	}
 
-// helper function to prefix key
-func (rd *RedisStorage) prefixKey(key string) string {
-	return path.Join(rd.KeyPrefix, key)
+	keysFound = make([]string, 0)
+	for key := range keysMap {
+		keysFound = append(keysFound, path.Join(prefix, key))
+	}
+
+	return keysFound, nil
 }
 
-// GetRedisStorage build RedisStorage with it's client
-func (rd *RedisStorage) BuildRedisClient() error {
-	rd.ctx = context.Background()
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:         rd.Address,
-		Username:     rd.Username,
-		Password:     rd.Password,
-		DB:           rd.DB,
-		DialTimeout:  time.Second * time.Duration(rd.Timeout),
-		ReadTimeout:  time.Second * time.Duration(rd.Timeout),
-		WriteTimeout: time.Second * time.Duration(rd.Timeout),
-	})
+// ListFunc calls fn with the key of every value stored under prefix as they are
+// scanned, without collecting them first. Lock keys are skipped. If fn returns an
+// error, scanning stops and that error is returned.
+//
+// Keys are only streamed with SCAN: with EncryptKeys they are all read from the key
+// index, and with ListConsistencyKeys from a single KEYS reply, before fn is called.
+// With ListReadPrefixes every key seen is remembered, so keys stored under several
+// prefixes are only passed to fn once.
+func (rd RedisStorage) ListFunc(ctx context.Context, prefix string, fn func(key string) error) error {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+
+	var seen map[string]bool
+	if rd.ListReadPrefixes && len(rd.ReadPrefixes) > 0 {
+		seen = make(map[string]bool)
+	}
 
-	if rd.TlsEnabled {
-		redisClient.Options().TLSConfig = &tls.Config{
-			InsecureSkipVerify: rd.TlsInsecure,
+	err := rd.scanKeysFunc(opCtx, rd.keyPrefix(), prefix, func(key string) error {
+		if strings.HasSuffix(key, lockKeySuffix) {
+			return nil
 		}
+		if seen != nil {
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		return fn(key)
+	})
+	if err != nil || seen == nil {
+		return classifyTimeout(ctx, opCtx, err)
 	}
 
-	_, err := redisClient.Ping(rd.ctx).Result()
-	if err != nil {
-		return err
+	for _, readPrefix := range rd.ReadPrefixes {
+		err := rd.scanKeysFunc(opCtx, readPrefix, prefix, func(key string) error {
+			if strings.HasSuffix(key, lockKeySuffix) || seen[key] {
+				return nil
+			}
+			seen[key] = true
+			deleted, err := rd.deleted(opCtx, key)
+			if err != nil || deleted {
+				return err
+			}
+			return fn(key)
+		})
+		if err != nil {
+			return classifyTimeout(ctx, opCtx, err)
+		}
 	}
-
-	rd.Client = redisClient
-	rd.ClientLocker = redislock.New(rd.Client)
-	rd.locks = &sync.Map{}
 	return nil
 }
 
-// Store values at key
-func (rd RedisStorage) Store(ctx context.Context, key string, value []byte) error {
-	data := &StorageData{
-		Value:    value,
-		Modified: time.Now(),
-	}
+// ListLeaves returns the keys of all values stored under prefix. Unlike List it
+// never returns directories, nor lock keys.
+func (rd RedisStorage) ListLeaves(ctx context.Context, prefix string) ([]string, error) {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
 
-	encryptedValue, err := rd.EncryptStorageData(data)
+	keys, err := rd.scanKeys(opCtx, rd.keyPrefix(), prefix)
 	if err != nil {
-		return fmt.Errorf("unable to encode data for %v: %v", key, err)
+		return nil, classifyTimeout(ctx, opCtx, err)
 	}
 
-	if err := rd.Client.Set(rd.ctx, rd.prefixKey(key), encryptedValue, 0).Err(); err != nil {
-		return fmt.Errorf("unable to store data for %v: %v", key, err)
+	seen := make(map[string]bool, len(keys))
+	keys = uniqueKeys(keys, seen)
+	if rd.ListReadPrefixes {
+		readKeys, err := rd.readPrefixKeys(opCtx, prefix, seen)
+		if err != nil {
+			return nil, classifyTimeout(ctx, opCtx, err)
+		}
+		keys = append(keys, readKeys...)
 	}
 
-	return nil
+	leaves := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if !strings.HasSuffix(key, lockKeySuffix) {
+			leaves = append(leaves, key)
+		}
+	}
+
+	return leaves, nil
 }
 
-// Load retrieves the value at key.
-func (rd RedisStorage) Load(ctx context.Context, key string) ([]byte, error) {
-	data, err := rd.getDataDecrypted(key)
+// uniqueKeys removes from keys, in place, the keys in seen and the repeated ones,
+// and adds the others to seen
+func uniqueKeys(keys []string, seen map[string]bool) []string {
+	unique := keys[:0]
+	for _, key := range keys {
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+	return unique
+}
+
+// readPrefixKeys returns the keys stored under ReadPrefixes that match prefix, skipping
+// those in seen and those deleted under KeyPrefix. Returned keys are added to seen.
+func (rd RedisStorage) readPrefixKeys(ctx context.Context, prefix string, seen map[string]bool) ([]string, error) {
+	var keysFound []string
+	for _, readPrefix := range rd.ReadPrefixes {
+		keys, err := rd.scanKeys(ctx, readPrefix, prefix)
+		if err != nil {
+			return keysFound, err
+		}
+		for _, key := range keys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			deleted, err := rd.deleted(ctx, key)
+			if err != nil {
+				return keysFound, err
+			}
+			if !deleted {
+				keysFound = append(keysFound, key)
+			}
+		}
+	}
+	return keysFound, nil
+}
+
+// ListModifiedSince returns all keys that match prefix and were modified at or after since.
+// With LightStat the modified time is read from the metadata, otherwise every value
+// has to be loaded and decrypted.
+func (rd RedisStorage) ListModifiedSince(ctx context.Context, prefix string, since time.Time) ([]string, error) {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	keys, err := rd.listModifiedSince(opCtx, prefix, since)
+	return keys, classifyTimeout(ctx, opCtx, err)
+}
 
+func (rd RedisStorage) listModifiedSince(ctx context.Context, prefix string, since time.Time) ([]string, error) {
+	keys, err := rd.scanKeys(ctx, rd.keyPrefix(), prefix)
 	if err != nil {
 		return nil, err
 	}
 
-	return data.Value, nil
+	keysFound := make([]string, 0)
+	for _, key := range keys {
+		if strings.HasSuffix(key, lockKeySuffix) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return keysFound, err
+		}
+
+		info, err := rd.stat(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			// deleted since the scan
+			continue
+		}
+		if err != nil {
+			return keysFound, fmt.Errorf("unable to stat %s: %v", key, err)
+		}
+		if !info.Modified.Before(since) {
+			keysFound = append(keysFound, key)
+		}
+	}
+
+	return keysFound, nil
 }
 
-// Delete deletes key.
-func (rd RedisStorage) Delete(ctx context.Context, key string) error {
-	_, err := rd.getData(key)
+// scanKeys returns all keys stored under keyPrefix that match prefix, with keyPrefix removed
+func (rd RedisStorage) scanKeys(ctx context.Context, keyPrefix string, prefix string) ([]string, error) {
+	var keysFound []string
+	err := rd.scanKeysFunc(ctx, keyPrefix, prefix, func(key string) error {
+		keysFound = append(keysFound, key)
+		return nil
+	})
+	return keysFound, err
+}
 
-	if err != nil {
-		return err
+// scanKeysFunc calls fn with every key stored under keyPrefix that matches prefix, with
+// keyPrefix removed, as they are scanned. It stops at the first error returned by fn.
+func (rd RedisStorage) scanKeysFunc(ctx context.Context, keyPrefix string, prefix string, fn func(key string) error) error {
+	// the index holds the keys as they were given to Store
+	matchPrefix := prefix
+	if !rd.EncryptKeys {
+		matchPrefix = rd.escapeKey(prefix)
 	}
 
-	if err := rd.Client.Del(rd.ctx, rd.prefixKey(key)).Err(); err != nil {
-		return fmt.Errorf("unable to delete data for key %s: %v", key, err)
+	// every key under keyPrefix when listing all keys, otherwise those starting
+	// with prefix, which includes keys only sharing the beginning of its last
+	// segment, skipped by trimListPrefix later on
+	filter := path.Clean(keyPrefix) + "/"
+	if prefix != "*" && len(strings.TrimSpace(prefix)) > 0 {
+		filter = path.Join(keyPrefix, matchPrefix)
 	}
+	// SCAN and KEYS match filter literally, so only the key index needs filtering
+	search := escapeGlob(filter) + "*"
 
-	return nil
-}
+	// remove default prefix from keys
+	visit := func(keys []string) error {
+		for _, key := range keys {
+			if !strings.HasPrefix(key, filter) || isInternalKey(key) {
+				continue
+			}
+			// skip anything a foreign writer put under our prefix that we can't make sense of
+			rel, ok := trimListPrefix(key, keyPrefix, "/")
+			if !ok || !isWellFormedKey(rel) {
+				rd.Logger.Debugf("skipping malformed key %q while listing %s", key, keyPrefix)
+				continue
+			}
+			key = rel
+			if !rd.EncryptKeys {
+				unescaped, err := rd.unescapeKey(rd.trimHashTag(key))
+				if err != nil {
+					rd.Logger.Debugf("skipping malformed key %q while listing %s: %v", key, keyPrefix, err)
+					continue
+				}
+				key = unescaped
+			}
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-// Exists returns true if the key exists
-func (rd RedisStorage) Exists(ctx context.Context, key string) bool {
-	_, err := rd.getData(key)
-	if err == nil {
-		return true
+	if rd.EncryptKeys {
+		// key names are opaque, the index is the only place to find them
+		keys, err := rd.scanKeyIndex(ctx, keyPrefix)
+		if err != nil {
+			return err
+		}
+		return visit(keys)
+	}
+	if rd.ListConsistency == ListConsistencyKeys {
+		keys, err := rd.keys(ctx, search)
+		if err != nil {
+			return err
+		}
+		return visit(keys)
 	}
-	return false
+	return rd.scan(ctx, search, visit)
 }
 
-// List returns all keys that match prefix.
-func (rd RedisStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
-	var keysFound []string
-	var tempKeys []string
-	var firstPointer uint64 = 0
-	var pointer uint64 = 0
-	var search string
-
-	// assuming we want to list all keys
+// filesystemList shapes and orders keys like certmagic.FileStorage lists the same files:
+// directories are listed along with their contents, entries are sorted lexically within
+// each directory, and a non-recursive listing only returns the direct children of prefix.
+func filesystemList(keys []string, prefix string, recursive bool) []string {
+	prefix = strings.Trim(strings.TrimSpace(prefix), "/")
 	if prefix == "*" {
-		search = rd.prefixKey(prefix)
-	} else if len(strings.TrimSpace(prefix)) == 0 {
-		search = rd.prefixKey("*")
-	} else {
-		search = rd.prefixKey(prefix) + "*"
+		prefix = ""
 	}
 
-	// first SCAN command
-	keys, pointer, err := rd.Client.Scan(rd.ctx, pointer, search, ScanCount).Result()
-	if err != nil {
-		return keysFound, err
+	entries := make(map[string]bool)
+	for _, key := range keys {
+		rel, ok := trimListPrefix(key, prefix, "/")
+		if !ok {
+			continue
+		}
+
+		segments := strings.Split(rel, "/")
+		if !recursive {
+			segments = segments[:1]
+		}
+		for i := range segments {
+			entries[path.Join(prefix, path.Join(segments[:i+1]...))] = true
+		}
 	}
-	// store it temporarily
-	tempKeys = append(tempKeys, keys...)
-	// because SCAN command doesn't always return all possible, keep searching until pointer is equal to the firstPointer
-	for pointer != firstPointer {
-		keys, nextPointer, _ := rd.Client.Scan(rd.ctx, pointer, search, ScanCount).Result()
-		tempKeys = append(tempKeys, keys...)
-		pointer = nextPointer
+
+	listed := make([]string, 0, len(entries))
+	for entry := range entries {
+		listed = append(listed, entry)
 	}
+	sort.Slice(listed, func(i, j int) bool {
+		return lessBySegments(listed[i], listed[j])
+	})
+	return listed
+}
 
-	if prefix == "*" || len(strings.TrimSpace(prefix)) == 0 {
-		search = rd.KeyPrefix
-	} else {
-		search = rd.prefixKey(prefix)
+// lessBySegments compares keys segment by segment, the order of a depth-first directory walk
+func lessBySegments(a, b string) bool {
+	aSegments, bSegments := strings.Split(a, "/"), strings.Split(b, "/")
+	for i := 0; i < len(aSegments) && i < len(bSegments); i++ {
+		if aSegments[i] != bSegments[i] {
+			return aSegments[i] < bSegments[i]
+		}
 	}
+	return len(aSegments) < len(bSegments)
+}
 
-	// remove default prefix from keys
-	for _, key := range tempKeys {
-		if strings.HasPrefix(key, search) {
-			key = strings.TrimPrefix(key, rd.KeyPrefix+"/")
-			keysFound = append(keysFound, key)
+// scan calls fn with every batch of keys matching match, until the SCAN cursor
+// returns to 0, fn returns an error, or the caller's context is done
+func (rd RedisStorage) scan(ctx context.Context, match string, fn func(keys []string) error) error {
+	scanCount := rd.Tunables().ScanCount
+	nodes, err := rd.nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, client := range nodes {
+		client := client
+		err := rd.iterateCursor(ctx, "scan of "+match, func(cursor uint64) ([]string, uint64, error) {
+			return client.Scan(ctx, cursor, match, scanCount).Result()
+		}, fn)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// if recursive wanted, or wildcard/empty prefix, just return all keys prefix is empty
-	if recursive || prefix == "*" || len(strings.TrimSpace(prefix)) == 0 {
-		return keysFound, nil
+// keys returns all keys matching match with a single KEYS command per node
+func (rd RedisStorage) keys(ctx context.Context, match string) ([]string, error) {
+	nodes, err := rd.nodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	for _, client := range nodes {
+		found, err := client.Keys(ctx, match).Result()
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, found...)
 	}
+	return keys, nil
+}
 
-	// for non-recursive split path and look for unique keys just under given prefix
-	keysMap := make(map[string]bool)
-	for _, key := range keysFound {
-		dir := strings.Split(strings.TrimPrefix(key, prefix+"/"), "/")
-		keysMap[dir[0]] = true
+// iterateCursor drives a SCAN-like command, calling fn with every batch of results
+// returned by next, until the cursor returns to 0, fn returns an error, or the
+// caller's context is done
+func (rd RedisStorage) iterateCursor(ctx context.Context, description string, next func(cursor uint64) ([]string, uint64, error), fn func(results []string) error) error {
+	var cursor uint64
+	maxIterations := rd.MaxScanIterations
+	if maxIterations <= 0 {
+		maxIterations = DefaultMaxScanIterations
 	}
 
-	keysFound = make([]string, 0)
-	for key := range keysMap {
-		keysFound = append(keysFound, path.Join(prefix, key))
+	for iteration := 0; ; iteration++ {
+		// a server that never returns a 0 cursor would keep us here forever
+		if iteration >= maxIterations {
+			return fmt.Errorf("%s did not complete after %d iterations", description, maxIterations)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		results, nextCursor, err := next(cursor)
+		if err != nil {
+			return err
+		}
+		if err := fn(results); err != nil {
+			return err
+		}
+
+		// the iteration is done once the cursor is 0 again, whatever the previous cursors looked like
+		cursor = nextCursor
+		if cursor == 0 {
+			return nil
+		}
 	}
+}
 
-	return keysFound, nil
+// isWellFormedKey reports whether key looks like a key certmagic could have stored:
+// valid UTF-8 without NUL bytes, made of non-empty path segments
+func isWellFormedKey(key string) bool {
+	if !utf8.ValidString(key) || strings.ContainsRune(key, 0) {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" {
+			return false
+		}
+	}
+	return true
 }
 
 // Stat returns information about key.
 func (rd RedisStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
-	data, err := rd.getDataDecrypted(key)
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	info, err := rd.stat(opCtx, key)
+	return info, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd RedisStorage) stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	if rd.LightStat {
+		metadata, err := rd.getMetadata(ctx, key)
+		if err == nil {
+			return certmagic.KeyInfo{
+				Key:        key,
+				Modified:   metadata.Modified,
+				Size:       metadata.Size,
+				IsTerminal: false,
+			}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return certmagic.KeyInfo{}, err
+		}
+	}
+
+	data, err := rd.getDataDecrypted(ctx, key)
 
 	if err != nil {
 		return certmagic.KeyInfo{}, err
@@ -313,11 +2049,57 @@ func (rd RedisStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo,
 }
 
 // getData return data from redis by key as it is
-func (rd RedisStorage) getData(key string) ([]byte, error) {
-	data, err := rd.Client.Get(rd.ctx, rd.prefixKey(key)).Bytes()
+func (rd RedisStorage) getData(ctx context.Context, key string) ([]byte, error) {
+	return rd.getDataFromPrefix(ctx, rd.keyPrefix(), key)
+}
 
+// readData return data from redis by key as it is, falling back to the read prefixes
+// when key doesn't exist under the primary prefix
+func (rd RedisStorage) readData(ctx context.Context, key string) ([]byte, error) {
+	data, err := rd.getData(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) && len(rd.ReadPrefixes) > 0 {
+		deleted, deletedErr := rd.deleted(ctx, key)
+		if deletedErr != nil {
+			return nil, deletedErr
+		}
+		if deleted {
+			return nil, err
+		}
+	}
+	for _, readPrefix := range rd.ReadPrefixes {
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		data, err = rd.getDataFromPrefix(ctx, readPrefix, key)
+	}
+	return data, err
+}
+
+// deleted returns whether key was deleted under KeyPrefix, so it must not be read
+// from the ReadPrefixes
+func (rd RedisStorage) deleted(ctx context.Context, key string) (bool, error) {
+	n, err := rd.clientFor(rd.tombstoneKey(key)).Exists(ctx, rd.tombstoneKey(key)).Result()
 	if err != nil {
-		return nil, fmt.Errorf("unable to obtain data for %s: %v", key, err)
+		return false, fmt.Errorf("unable to check whether %s was deleted: %w", key, err)
+	}
+	return n > 0, nil
+}
+
+// getDataFromPrefix return data from redis by key under keyPrefix as it is
+func (rd RedisStorage) getDataFromPrefix(ctx context.Context, keyPrefix string, key string) ([]byte, error) {
+	redisKey := rd.redisKey(keyPrefix, key)
+	var data []byte
+	var err error
+	if rd.cache != nil {
+		data, err = rd.cache.get(ctx, rd.clientFor(redisKey), redisKey)
+	} else {
+		data, err = rd.clientFor(redisKey).Get(ctx, redisKey).Bytes()
+	}
+
+	if err == redis.Nil {
+		return nil, fs.ErrNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to obtain data for %s: %w", key, err)
 	} else if data == nil {
 		return nil, fs.ErrNotExist
 	}
@@ -325,17 +2107,63 @@ func (rd RedisStorage) getData(key string) ([]byte, error) {
 	return data, nil
 }
 
+// getMetadata return the cleartext StorageMetadata of key
+func (rd RedisStorage) getMetadata(ctx context.Context, key string) (*StorageMetadata, error) {
+	data, err := rd.clientFor(rd.metadataKey(key)).Get(ctx, rd.metadataKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, fs.ErrNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to obtain metadata for %s: %w", key, err)
+	}
+
+	metadata := &StorageMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("unable to decode metadata for %s: %v", key, err)
+	}
+	return metadata, nil
+}
+
 // getDataDecrypted return StorageData by key
-func (rd RedisStorage) getDataDecrypted(key string) (*StorageData, error) {
-	data, err := rd.getData(key)
+func (rd RedisStorage) getDataDecrypted(ctx context.Context, key string) (*StorageData, error) {
+	data, err := rd.readData(ctx, key)
 
 	if err != nil {
 		return nil, err
 	}
 
-	decryptedData, err := rd.DecryptStorageData(data)
+	return rd.decryptData(key, data)
+}
+
+// getDataSliding return StorageData by key like getDataDecrypted, resetting the
+// expiration of the value and the keys stored next to it to ttl, with GETEX. Values
+// found under ReadPrefixes are left alone.
+func (rd RedisStorage) getDataSliding(ctx context.Context, key string, ttl time.Duration) (*StorageData, error) {
+	var value *redis.StringCmd
+	_, err := rd.clientFor(rd.prefixKey(key)).Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		value = redis.NewStringCmd(ctx, "getex", rd.prefixKey(key), "px", ttl.Milliseconds())
+		_ = pipe.Process(ctx, value)
+		pipe.PExpire(ctx, rd.metadataKey(key), ttl)
+		pipe.PExpire(ctx, rd.createdKey(key), ttl)
+		return nil
+	})
+	rd.invalidateCached(rd.prefixKey(key))
+	if err == redis.Nil && len(rd.ReadPrefixes) > 0 {
+		return rd.getDataDecrypted(ctx, key)
+	} else if err == redis.Nil {
+		return nil, fs.ErrNotExist
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to obtain data for %s: %w", key, err)
+	}
+
+	return rd.decryptData(key, []byte(value.Val()))
+}
+
+// decryptData returns the StorageData of key from data, as stored
+func (rd RedisStorage) decryptData(key string, data []byte) (*StorageData, error) {
+	decryptedData, err := rd.decryptStorageData(key, data)
 
 	if err != nil {
+		rd.trackUndecryptable(key, err)
 		return nil, fmt.Errorf("unable to decrypt data for %s: %v", key, err)
 	}
 
@@ -344,41 +2172,98 @@ func (rd RedisStorage) getDataDecrypted(key string) (*StorageData, error) {
 
 // Lock is to lock value
 func (rd *RedisStorage) Lock(ctx context.Context, key string) error {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	start := time.Now()
+	defer rd.logSlow("Lock", key, start)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	err := classifyTimeout(ctx, opCtx, rd.lock(opCtx, key))
+	if err == nil && rd.prometheus != nil {
+		rd.prometheus.lockWait.Observe(time.Since(start).Seconds())
+	}
+	rd.recordOperation(ctx, "Lock", start, err)
+	return err
+}
+
+func (rd *RedisStorage) lock(ctx context.Context, key string) error {
+	// releases of the lock, nil until subscribed to, which blocks forever
+	var released <-chan *redis.Message
 	for {
-		_, err := rd.obtainLock(key)
+		_, err := rd.obtainLock(ctx, key)
 		if err == nil {
 			// got the lock, yay
 			return nil
 		}
 		if err != redislock.ErrNotObtained {
 			// unexpected error
-			return fmt.Errorf("creating redis lock: %v", err)
+			return fmt.Errorf("creating redis lock: %w", classifyWriteError(err))
+		}
+
+		if rd.LockNotifications && released == nil {
+			sub, err := rd.subscribeLockReleased(ctx, key)
+			if err == nil {
+				defer sub.Close()
+				released = sub.Channel()
+				// the lock may have been released before subscribing
+				continue
+			}
+			rd.Logger.Warnf("[WARNING] Unable to subscribe to the release of lock, polling for it: %v (key: %s)", err, key)
+			released = make(chan *redis.Message)
 		}
 
 		// lock exists and is not stale;
-		// just wait a moment and try again,
-		// or return if context cancelled
+		// just wait until it is released, for a moment when it expires,
+		// and try again, or return if context cancelled
 		select {
-		case <-time.After(LockPollInterval):
+		case <-released:
+		case <-time.After(rd.Tunables().LockPollInterval):
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
+}
 
-	return nil
+// TryLock makes a single attempt to obtain the lock for key. Unlike Lock it
+// doesn't poll, it returns false if the lock is currently held by someone else.
+func (rd *RedisStorage) TryLock(ctx context.Context, key string) (bool, error) {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	obtained, err := rd.tryLock(opCtx, key)
+	return obtained, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd *RedisStorage) tryLock(ctx context.Context, key string) (bool, error) {
+	_, err := rd.obtainLock(ctx, key)
+	if err == nil {
+		return true, nil
+	}
+	if err != redislock.ErrNotObtained {
+		return false, fmt.Errorf("creating redis lock: %w", classifyWriteError(err))
+	}
+	return false, nil
 }
 
-func (rd *RedisStorage) obtainLock(key string) (*redislock.Lock, error) {
-	lockName := rd.prefixKey(key) + ".lock"
+// obtainLock makes a single attempt to obtain the lock for key. ctx only bounds the
+// attempt, the lock is kept fresh until it is released or the storage cleaned up.
+func (rd *RedisStorage) obtainLock(ctx context.Context, key string) (*redislock.Lock, error) {
+	lockName := rd.prefixKey(key) + lockKeySuffix
 
 	if lockI, exists := rd.locks.Load(key); exists {
 		// check if the lock is stale and cleanup if needed
 		if lock, ok := lockI.(*redislock.Lock); ok {
-			if ttl, err := lock.TTL(rd.ctx); err != nil {
+			if !rd.locks.owns(key, lock) {
+				// obtained by another instance, never ours to release
+				rd.locks.Delete(key)
+				return nil, redislock.ErrNotObtained
+			}
+			if ttl, err := lock.TTL(ctx); err != nil {
 				return nil, err
 			} else if ttl == 0 {
 				// lock is dead, clean it up from locks data
-				_ = lock.Release(rd.ctx)
+				_ = lock.Release(ctx)
 				rd.locks.Delete(key)
 			}
 		}
@@ -386,26 +2271,54 @@ func (rd *RedisStorage) obtainLock(key string) (*redislock.Lock, error) {
 		return nil, redislock.ErrNotObtained
 	} else {
 		// obtain new lock
-		lock, err := rd.ClientLocker.Obtain(rd.ctx, lockName, LockDuration, &redislock.Options{})
+		lock, err := rd.shardFor(lockName).locker.Obtain(ctx, lockName, rd.Tunables().LockTimeout, &redislock.Options{
+			Metadata: rd.locks.owner + rd.lockMetadata(),
+		})
 		if err != nil {
 			return nil, err
 		}
+		if rd.LockFencing {
+			token, err := rd.incrementFence(ctx, key, lock)
+			if err != nil {
+				_ = lock.Release(ctx)
+				return nil, err
+			}
+			rd.locks.fences.Store(key, heldFence{lock: lock, token: token})
+		}
 
 		// save it
 		rd.locks.Store(key, lock)
 
 		// keep the lock fresh as long as we hold it
-		go rd.keepRedisLockFresh(key)
+		rd.refresher.add(rd.locks, key, lock, rd.Tunables().LockRefreshInterval)
 
 		return lock, nil
 	}
 }
 
-// keepRedisLockFresh continuously updates the lock TTL. It stops when
-// the lock disappears from rd.locks. Since it pools every
-// LockFreshnessInterval, this function might not terminate until up to
-// LockFreshnessInterval after the lock is released.
-func (rd *RedisStorage) keepRedisLockFresh(key string) {
+// replaceHostname replaces "{hostname}" in s with the hostname of the machine
+func replaceHostname(s string) string {
+	if !strings.Contains(s, "{hostname}") {
+		return s
+	}
+	hostname, _ := os.Hostname()
+	return strings.ReplaceAll(s, "{hostname}", hostname)
+}
+
+// lockMetadata returns the metadata appended to our lock tokens, see parseLockValue
+func (rd *RedisStorage) lockMetadata() string {
+	owner := replaceHostname(rd.LockOwner)
+	if rd.LockRecordAcquired {
+		owner += lockAcquiredSeparator + time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	return owner
+}
+
+// keepRedisLocksFresh refreshes the TTL of the locks held by this instance every
+// LockRefreshInterval, until ctx is done. A single goroutine refreshes them all,
+// in turn, as they come due. A lock is no longer refreshed once it isn't owned by
+// its lockSet anymore, which might take up to LockRefreshInterval after it is released.
+func (rd *RedisStorage) keepRedisLocksFresh(ctx context.Context, refresher *lockRefresher) {
 	defer func() {
 		if err := recover(); err != nil {
 			buf := make([]byte, stackTraceBufferSize)
@@ -415,34 +2328,61 @@ func (rd *RedisStorage) keepRedisLockFresh(key string) {
 	}()
 
 	for {
-		time.Sleep(LockFreshnessInterval)
-		done, err := rd.updateRedisLockFreshness(key)
-		if err != nil {
-			rd.Logger.Errorf("[ERROR] Keeping redis lock fresh: %v - terminating lock maintenance (lock: %s)", err, key)
-			return
+		due, wait := refresher.due(time.Now())
+		for _, held := range due {
+			done, err := rd.updateRedisLockFreshness(ctx, held.locks, held.key, held.lock)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				rd.Logger.Errorf("[ERROR] Keeping redis lock fresh: %v - terminating lock maintenance (lock: %s)", err, held.key)
+				continue
+			}
+			if done {
+				continue
+			}
+
+			// a lock needing many refreshes means the critical section is unusually slow
+			held.refreshes++
+			if rd.LockHeldWarnRefreshes > 0 && held.refreshes%rd.LockHeldWarnRefreshes == 0 {
+				rd.Logger.Warnf("[WARNING] Redis lock held longer than expected: refreshed %d times (lock: %s)", held.refreshes, held.key)
+			}
+			refresher.reschedule(held, rd.Tunables().LockRefreshInterval)
 		}
-		if done {
+		if len(due) > 0 {
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-refresher.wake:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
 			return
 		}
 	}
 }
 
-func (rd *RedisStorage) updateRedisLockFreshness(key string) (bool, error) {
-	l, exists := rd.locks.Load(key)
-	if !exists {
-		// lock released
+func (rd *RedisStorage) updateRedisLockFreshness(ctx context.Context, locks *lockSet, key string, lock *redislock.Lock) (bool, error) {
+	if !locks.owns(key, lock) {
+		// lock released, or held by another instance since the client was built again
 		return true, nil
 	}
 
-	lock, ok := l.(*redislock.Lock)
-	if !ok {
-		return true, fmt.Errorf("uable to cast to redislock")
-	}
-
-	// refresh the lock's TTL every LockFreshnessInterval
-	err := lock.Refresh(rd.ctx, LockDuration, nil)
-	if err != nil {
-		rd.Logger.Errorf("[ERROR] Keeping redis lock fresh: %v - terminating lock maintenance (lock: %s)", err, key)
+	// refresh the lock's TTL every LockRefreshInterval
+	err := lock.Refresh(ctx, rd.Tunables().LockTimeout, nil)
+	if err == redislock.ErrNotObtained {
+		// expired, and maybe obtained by another instance since, which happens under
+		// contention: the lock is forgotten so it isn't released or refreshed again
+		rd.Logger.Warnf("[WARNING] Redis lock expired before being released - terminating lock maintenance (lock: %s, owner: %s)", key, locks.owner)
+		if locks.owns(key, lock) {
+			locks.Delete(key)
+		}
+		return true, nil
+	} else if err != nil {
+		rd.Logger.Errorf("[ERROR] Keeping redis lock fresh: %v - terminating lock maintenance (lock: %s, owner: %s)", err, key, locks.owner)
 		return true, err
 	}
 
@@ -451,20 +2391,43 @@ func (rd *RedisStorage) updateRedisLockFreshness(key string) (bool, error) {
 
 // Unlock is to unlock value
 func (rd *RedisStorage) Unlock(ctx context.Context, key string) error {
+	ctx = orBackground(ctx)
+	key = normalizeKey(key)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	return classifyTimeout(ctx, opCtx, rd.unlock(opCtx, key))
+}
+
+func (rd *RedisStorage) unlock(ctx context.Context, key string) error {
 	if lockI, exists := rd.locks.Load(key); exists {
 		if lock, ok := lockI.(*redislock.Lock); ok {
-			err := lock.Release(rd.ctx)
+			if !rd.locks.owns(key, lock) {
+				rd.locks.Delete(key)
+				return fmt.Errorf("lock %s is not owned by this instance (owner: %s)", key, rd.locks.owner)
+			}
+			// redislock only releases the lock if it still carries our token, so
+			// a lock obtained by another instance since ours expired is left alone
+			err := lock.Release(ctx)
 			rd.locks.Delete(key)
-			if err != nil {
-				return fmt.Errorf("we don't have this lock anymore, %v", err)
+			rd.locks.fences.Delete(key)
+			if err == redislock.ErrLockNotHeld {
+				rd.Logger.Warnf("[WARNING] Lock expired before being released (key: %s)", key)
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("unable to release lock: %w", err)
 			}
+			rd.publishLockReleased(ctx, key)
 		}
 	}
 	return nil
 }
 
+// GetAESKeyByte returns the key values are encrypted with, derived from AesKey
+// according to KeyDerivation
 func (rd *RedisStorage) GetAESKeyByte() []byte {
-	return []byte(rd.AesKey)
+	// validated by BuildRedisClient
+	key, _ := rd.deriveAESKey(rd.AesKey)
+	return key
 }
 
 func (rd RedisStorage) String() string {
@@ -472,9 +2435,15 @@ func (rd RedisStorage) String() string {
 	if rd.Password != "" {
 		rd.Password = redacted
 	}
+	if rd.SentinelPassword != "" {
+		rd.SentinelPassword = redacted
+	}
 	if rd.AesKey != "" {
 		rd.AesKey = redacted
 	}
+	if rd.PreviousAesKey != "" {
+		rd.PreviousAesKey = redacted
+	}
 	strVal, _ := json.Marshal(rd)
 	return string(strVal)
 }
@@ -3,23 +3,44 @@ package storageredis
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
-	"github.com/caddyserver/certmagic"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/bsm/redislock"
+	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 const TestPrefix = "redistlstest"
 
-// these tests needs a running Redis server
-func setupRedisEnv(t *testing.T) *RedisStorage {
+// these tests run against an in-memory miniredis server
+func setupRedisEnv(t testing.TB) *RedisStorage {
+	return setupRedisEnvWithServer(t, miniredis.RunT(t))
+}
+
+func setupRedisEnvWithServer(t testing.TB, mr *miniredis.Miniredis) *RedisStorage {
+	return setupRedisEnvWithStorage(t, mr, new(RedisStorage))
+}
+
+func setupRedisEnvWithStorage(t testing.TB, mr *miniredis.Miniredis, rd *RedisStorage) *RedisStorage {
 	os.Setenv(EnvNameKeyPrefix, TestPrefix)
 	os.Setenv(EnvNameRedisDB, "9")
+	os.Setenv(EnvNameRedisHost, mr.Host())
+	os.Setenv(EnvNameRedisPort, mr.Port())
 
-	rd := new(RedisStorage)
 	rd.GetConfigValue()
 	err := rd.BuildRedisClient()
 
@@ -35,26 +56,455 @@ func setupRedisEnv(t *testing.T) *RedisStorage {
 
 	_, err = rd.Client.FlushAll(rd.ctx).Result()
 	assert.NoError(t, err)
+	t.Cleanup(func() {
+		rd.Cleanup()
+		rd.Client.Close()
+	})
 	return rd
 }
 
+// commandCounter is a hook counting the commands sent to Redis, by name, and the
+// round trips they were sent in
+type commandCounter struct {
+	mu         sync.Mutex
+	counts     map[string]int
+	roundTrips int
+}
+
+func (c *commandCounter) record(cmds ...redis.Cmder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int)
+	}
+	c.roundTrips++
+	for _, cmd := range cmds {
+		c.counts[cmd.Name()]++
+	}
+}
+
+func (c *commandCounter) count(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[name]
+}
+
+func (c *commandCounter) trips() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.roundTrips
+}
+
+func (c *commandCounter) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	c.record(cmd)
+	return ctx, nil
+}
+
+func (c *commandCounter) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (c *commandCounter) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	c.record(cmds...)
+	return ctx, nil
+}
+
+func (c *commandCounter) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestRedisStorage_OnConnect(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	connections := 0
+	rd := new(RedisStorage)
+	rd.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		connections++
+		return cn.ClientSetName(ctx, "caddy").Err()
+	}
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	assert.Equal(t, 1, connections)
+	name, err := rd.Client.ClientGetName(context.TODO()).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "caddy", name)
+}
+
+func TestRedisStorage_ConnectionName(t *testing.T) {
+	mr := miniredis.RunT(t)
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+
+	rd := setupRedisEnvWithServer(t, mr)
+	assert.Equal(t, DefaultConnectionName, rd.ConnectionName)
+	name, err := rd.Client.ClientGetName(context.TODO()).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "caddy-tlsredis-"+hostname, name)
+
+	os.Setenv(EnvNameConnectionName, "edge-{hostname}")
+	defer os.Unsetenv(EnvNameConnectionName)
+	rd = setupRedisEnvWithServer(t, mr)
+	name, err = rd.Client.ClientGetName(context.TODO()).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, "edge-"+hostname, name)
+
+	// OnConnect runs after the connection is named
+	rd = new(RedisStorage)
+	rd.ConnectionName = "caddy-a"
+	var named string
+	rd.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		named = cn.ClientGetName(ctx).Val()
+		return nil
+	}
+	setupRedisEnvWithStorage(t, mr, rd)
+	assert.Equal(t, "caddy-a", named)
+}
+
+func TestRedisStorage_PoolOptions(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	rd := new(RedisStorage)
+	rd.PoolSize = 4
+	rd.MinIdleConns = 2
+	rd.PoolTimeout = Duration(3 * time.Second)
+	rd.ConnMaxIdleTime = Duration(time.Minute)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	options := rd.Client.(*redis.Client).Options()
+	assert.Equal(t, 4, options.PoolSize)
+	assert.Equal(t, 2, options.MinIdleConns)
+	assert.Equal(t, 3*time.Second, options.PoolTimeout)
+	assert.Equal(t, time.Minute, options.IdleTimeout)
+
+	defaults := setupRedisEnvWithStorage(t, mr, new(RedisStorage))
+	options = defaults.Client.(*redis.Client).Options()
+	assert.Equal(t, DefaultPoolSizePerCPU*runtime.GOMAXPROCS(0), options.PoolSize)
+	assert.Equal(t, 0, options.MinIdleConns)
+	assert.Equal(t, time.Duration(DefaultRedisTimeout+1)*time.Second, options.PoolTimeout)
+	assert.Equal(t, DefaultConnMaxIdleTime, options.IdleTimeout)
+
+	negative := new(RedisStorage)
+	negative.Address = mr.Addr()
+	negative.MinIdleConns = -1
+	negative.GetConfigValue()
+	assert.Error(t, negative.BuildRedisClient())
+}
+
+func TestRedisStorage_AddressResolver(t *testing.T) {
+	static := miniredis.RunT(t)
+	discovered := miniredis.RunT(t)
+
+	resolved := 0
+	rd := new(RedisStorage)
+	rd.AddressResolver = func(ctx context.Context) (string, error) {
+		resolved++
+		return discovered.Addr(), nil
+	}
+	rd = setupRedisEnvWithStorage(t, static, rd)
+	assert.Equal(t, 1, resolved)
+	assert.Equal(t, discovered.Addr(), rd.Address)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	discovered.Select(9)
+	assert.True(t, discovered.Exists(rd.prefixKey(key)))
+	static.Select(9)
+	assert.False(t, static.Exists(rd.prefixKey(key)))
+
+	// resolved again when the client is built again
+	assert.NoError(t, rd.BuildRedisClient())
+	assert.Equal(t, 2, resolved)
+}
+
+func TestRedisStorage_AddressResolverError(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.Address = miniredis.RunT(t).Addr()
+	rd.AddressResolver = func(ctx context.Context) (string, error) {
+		return "", errors.New("no healthy redis instance")
+	}
+	rd.GetConfigValue()
+
+	assert.Error(t, rd.BuildRedisClient())
+}
+
+func TestRedisStorage_Validate(t *testing.T) {
+	invalid := map[string]struct {
+		configure func(rd *RedisStorage)
+		err       string
+	}{
+		"no address": {
+			func(rd *RedisStorage) { rd.Address, rd.Host = "", "" },
+			`redis address requires either address, or host and port, got host "" and port "6379"`,
+		},
+		"negative timeout": {
+			func(rd *RedisStorage) { rd.Timeout = -1 },
+			"timeout must not be negative, got -1",
+		},
+		"negative db": {
+			func(rd *RedisStorage) { rd.DB = -1 },
+			"db must not be negative, got -1",
+		},
+		"leading slash": {
+			func(rd *RedisStorage) { rd.KeyPrefix = "/caddytls" },
+			`key prefix "/caddytls" must not begin or end with a separator, or contain empty, . or .. segments`,
+		},
+		"trailing slash": {
+			func(rd *RedisStorage) { rd.KeyPrefix = "caddytls/" },
+			`key prefix "caddytls/" must not begin or end with a separator, or contain empty, . or .. segments`,
+		},
+		"empty segment": {
+			func(rd *RedisStorage) { rd.ReadPrefixes = []string{"old//caddytls"} },
+			`read prefix "old//caddytls" must not begin or end with a separator, or contain empty, . or .. segments`,
+		},
+		"malformed ttl pattern": {
+			func(rd *RedisStorage) { rd.TTLPatterns = []TTLPattern{{Pattern: "ocsp/[", TTL: Duration(time.Hour)}} },
+			`ttl pattern "ocsp/[": syntax error in pattern`,
+		},
+		"ttl pattern without ttl": {
+			func(rd *RedisStorage) { rd.TTLPatterns = []TTLPattern{{Pattern: "ocsp/*"}} },
+			`ttl pattern "ocsp/*" requires a positive ttl, got 0s`,
+		},
+		"short aes key": {
+			func(rd *RedisStorage) { rd.AesKey = "redistls-01234567890" },
+			`aes-gcm encryption requires a 16, 24 or 32 byte AES key, got 20 bytes, use key_derivation "scrypt" for passphrases`,
+		},
+		"short previous aes key": {
+			func(rd *RedisStorage) {
+				rd.AesKey = "redistls-01234567890-caddytls-32"
+				rd.PreviousAesKey = "redistls-01234567890"
+			},
+			`aes-gcm encryption requires a 16, 24 or 32 byte previous AES key, got 20 bytes, use key_derivation "scrypt" for passphrases`,
+		},
+	}
+	for name, test := range invalid {
+		t.Run(name, func(t *testing.T) {
+			rd := new(RedisStorage)
+			rd.Host = "127.0.0.1"
+			rd.Port = "6379"
+			rd.Address = "127.0.0.1:6379"
+			test.configure(rd)
+			assert.EqualError(t, rd.Validate(), test.err)
+			// building fails the same way, before connecting
+			assert.EqualError(t, rd.BuildRedisClient(), test.err)
+		})
+	}
+
+	// the address is built from host and port when unset
+	rd := new(RedisStorage)
+	rd.Host = "redis.example.com"
+	rd.Port = "6380"
+	rd.KeyPrefix = "caddy/tls"
+	assert.NoError(t, rd.Validate())
+	assert.Equal(t, "redis.example.com:6380", rd.Address)
+
+	rd = new(RedisStorage)
+	rd.Host = "::1"
+	rd.Port = "6379"
+	assert.NoError(t, rd.Validate())
+	assert.Equal(t, "[::1]:6379", rd.Address)
+
+	rd.Address = "redis:6379"
+	assert.NoError(t, rd.Validate())
+	assert.Equal(t, "redis:6379", rd.Address)
+
+	// shards, clusters and sentinels don't use it
+	rd = new(RedisStorage)
+	rd.ShardAddresses = []string{"redis1:6379", "redis2:6379"}
+	assert.NoError(t, rd.Validate())
+	assert.Empty(t, rd.Address)
+}
+
+func TestRedisStorage_SecretFiles(t *testing.T) {
+	mr := miniredis.RunT(t)
+	mr.RequireAuth("secret")
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	aesKeyFile := filepath.Join(dir, "aes_key")
+	assert.NoError(t, os.WriteFile(passwordFile, []byte("secret\n"), 0600))
+	assert.NoError(t, os.WriteFile(aesKeyFile, []byte("redistls-01234567890-caddytls-32\r\n"), 0600))
+
+	// the files win over the inline values, without their trailing newlines
+	rd := new(RedisStorage)
+	rd.Password = "inline"
+	rd.AesKey = "inline"
+	rd.PasswordFile = passwordFile
+	rd.AesKeyFile = aesKeyFile
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	assert.Equal(t, "secret", rd.Password)
+	assert.Equal(t, "redistls-01234567890-caddytls-32", rd.AesKey)
+
+	missing := new(RedisStorage)
+	missing.Address = mr.Addr()
+	missing.PasswordFile = filepath.Join(dir, "missing")
+	missing.GetConfigValue()
+	err := missing.BuildRedisClient()
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Contains(t, err.Error(), "unable to read redis password")
+	assert.Contains(t, err.Error(), missing.PasswordFile)
+}
+
 func TestRedisStorage_Store(t *testing.T) {
 	rd := setupRedisEnv(t)
 
-	err := rd.Store(path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"), []byte("crt data"))
+	err := rd.Store(context.TODO(), path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"), []byte("crt data"))
 	assert.NoError(t, err)
 }
 
+func TestRedisStorage_VerifyWrites(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.VerifyWrites = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+
+	// the write is acknowledged, but something else lands
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "GET" {
+			mr.Select(9)
+			mr.Set(args[0], "corrupted")
+		}
+		return false
+	})
+
+	err := rd.Store(context.TODO(), key, []byte("new crt data"))
+	assert.True(t, errors.Is(err, ErrWriteVerification), "%v", err)
+}
+
+func TestRedisStorage_StoreIfNewer(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.StoreIfNewer = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	// an instance whose clock is an hour behind
+	late := &RedisStorage{StoreIfNewer: true, UseServerTime: true}
+	late.GetConfigValue()
+	assert.NoError(t, late.BuildRedisClient())
+	t.Cleanup(func() { late.Cleanup() })
+	mr.SetTime(time.Now().Add(-time.Hour))
+	key := path.Join("certificates", "example.com", "example.com.crt")
+
+	// an absent key is stored, a newer value replaces an older one
+	assert.NoError(t, late.Store(context.TODO(), key, []byte("old crt")))
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("new crt")))
+
+	// while the older value is rejected, even when both are stored concurrently
+	for i := 0; i < 10; i++ {
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for j, storage := range []*RedisStorage{rd, late} {
+			j, storage := j, storage
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errs[j] = storage.Store(context.TODO(), key, []byte(fmt.Sprintf("crt %d", j)))
+			}()
+		}
+		wg.Wait()
+		assert.NoError(t, errs[0])
+		assert.True(t, errors.Is(errs[1], ErrStaleWrite), "%v", errs[1])
+		value, err := rd.Load(context.TODO(), key)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("crt 0"), value)
+	}
+
+	// a value written between the read and the write is compared against again
+	newer, err := rd.encryptStorageData(key, &StorageData{Value: []byte("newer crt"), Modified: time.Now().Add(time.Hour)})
+	assert.NoError(t, err)
+	var once sync.Once
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "EXEC" {
+			once.Do(func() {
+				mr.Select(9)
+				mr.Set(rd.prefixKey(key), string(newer))
+			})
+		}
+		return false
+	})
+	err = rd.Store(context.TODO(), key, []byte("crt"))
+	assert.True(t, errors.Is(err, ErrStaleWrite), "%v", err)
+	value, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("newer crt"), value)
+}
+
+func TestRedisStorage_StoreUnsafe(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.VerifyWrites = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.StoreUnsafe(context.TODO(), key, []byte("crt data")))
+
+	value, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), value)
+	assert.Equal(t, 1, counter.count("get"), "the value shouldn't be read back")
+	for _, redisKey := range mr.DB(9).Keys() {
+		assert.False(t, strings.HasSuffix(redisKey, lockKeySuffix), "no lock keys should be created: %s", redisKey)
+	}
+	assert.ElementsMatch(t, []string{rd.prefixKey(key), rd.createdKey(key)}, mr.DB(9).Keys())
+}
+
+func TestRedisStorage_StoreWithTTL(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.LightStat = true
+	rd.TTLPatterns = []TTLPattern{{Pattern: "ocsp/*", TTL: Duration(time.Hour)}}
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+
+	key := path.Join("ocsp", "example.com-1234")
+	err := rd.Store(context.TODO(), key, []byte("ocsp"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 0, counter.count("expire"))
+	assert.Equal(t, 0, counter.count("pexpire"))
+	mr.Select(9)
+	assert.Equal(t, time.Hour, mr.TTL(rd.prefixKey(key)))
+	assert.Equal(t, time.Hour, mr.TTL(rd.metadataKey(key)))
+
+	// keys matching no pattern, as certificates, never expire
+	for _, key := range []string{
+		path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com", "example.com.crt"),
+		path.Join("ocsp", "nested", "example.com-1234"),
+	} {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("data")))
+		assert.Equal(t, time.Duration(0), mr.TTL(rd.prefixKey(key)))
+		assert.Equal(t, time.Duration(0), mr.TTL(rd.metadataKey(key)))
+	}
+}
+
 func TestRedisStorage_Exists(t *testing.T) {
-	rd := setupRedisEnv(t)
+	mr := miniredis.RunT(t)
+	core, logs := observer.New(zap.ErrorLevel)
+	rd := new(RedisStorage)
+	rd.Logger = zap.New(core).Sugar()
+	rd = setupRedisEnvWithStorage(t, mr, rd)
 
 	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
 
-	err := rd.Store(key, []byte("crt data"))
+	// a missing key is not an error
+	assert.False(t, rd.Exists(context.TODO(), key))
+	assert.Equal(t, 0, logs.Len())
+
+	err := rd.Store(context.TODO(), key, []byte("crt data"))
 	assert.NoError(t, err)
 
-	exists := rd.Exists(key)
+	exists := rd.Exists(context.TODO(), key)
 	assert.True(t, exists)
+
+	// a key which can't be read is reported missing, and the failure logged
+	mr.Close()
+	assert.False(t, rd.Exists(context.TODO(), key))
+	if assert.Equal(t, 1, logs.Len()) {
+		assert.Contains(t, logs.All()[0].Message, "Unable to check whether key exists")
+	}
 }
 
 func TestRedisStorage_Load(t *testing.T) {
@@ -63,10 +513,10 @@ func TestRedisStorage_Load(t *testing.T) {
 	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
 	content := []byte("crt data")
 
-	err := rd.Store(key, content)
+	err := rd.Store(context.TODO(), key, content)
 	assert.NoError(t, err)
 
-	contentLoded, err := rd.Load(key)
+	contentLoded, err := rd.Load(context.TODO(), key)
 	assert.NoError(t, err)
 
 	assert.Equal(t, content, contentLoded)
@@ -78,20 +528,127 @@ func TestRedisStorage_Delete(t *testing.T) {
 	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
 	content := []byte("crt data")
 
-	err := rd.Store(key, content)
+	err := rd.Store(context.TODO(), key, content)
 	assert.NoError(t, err)
 
-	err = rd.Delete(key)
+	err = rd.Delete(context.TODO(), key)
 	assert.NoError(t, err)
 
-	exists := rd.Exists(key)
+	exists := rd.Exists(context.TODO(), key)
 	assert.False(t, exists)
 
-	contentLoaded, err := rd.Load(key)
+	contentLoaded, err := rd.Load(context.TODO(), key)
 	assert.Nil(t, contentLoaded)
 
-	_, ok := err.(certmagic.ErrNotExist)
-	assert.True(t, ok)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+}
+
+func TestRedisStorage_DeleteLocked(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	assert.NoError(t, rd.Lock(context.TODO(), key))
+	assert.NoError(t, rd.Delete(context.TODO(), key))
+
+	_, held := rd.locks.Load(key)
+	assert.False(t, held)
+	mr.Select(9)
+	assert.False(t, mr.Exists(rd.prefixKey(key)+lockKeySuffix))
+
+	obtained, err := rd.TryLock(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.True(t, obtained)
+	assert.NoError(t, rd.Unlock(context.TODO(), key))
+}
+
+func TestRedisStorage_RoundTrips(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.LightStat = true
+	rd.DeleteLocks = true
+	rd.EncryptKeys = true
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	key := path.Join("certificates", "example.com", "example.com.crt")
+
+	// a lock left without expiration
+	mr.Select(9)
+	assert.NoError(t, mr.Set(rd.prefixKey(key)+lockKeySuffix, "stale"))
+
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+
+	// value, metadata and key index entry
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	assert.Equal(t, 1, counter.trips())
+	assert.True(t, mr.Exists(rd.metadataKey(key)))
+
+	// value, metadata, key index entry and lock
+	assert.NoError(t, rd.Delete(context.TODO(), key))
+	assert.Equal(t, 2, counter.trips())
+	assert.False(t, mr.Exists(rd.prefixKey(key)))
+	assert.False(t, mr.Exists(rd.metadataKey(key)))
+	assert.False(t, mr.Exists(rd.prefixKey(key)+lockKeySuffix))
+	assert.False(t, mr.Exists(rd.keyIndex(TestPrefix)))
+
+	err := rd.Delete(context.TODO(), key)
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "%v", err)
+}
+
+func TestRedisStorage_DeletePrefix(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.DeleteBatchSize = 500
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+	for i := 0; i < 2000; i++ {
+		err := rd.Store(context.TODO(), path.Join("acme", fmt.Sprintf("site%d.com", i), "cert.crt"), []byte("crt"))
+		assert.NoError(t, err)
+	}
+	keep := path.Join("ocsp", "example.com")
+	err := rd.Store(context.TODO(), keep, []byte("ocsp"))
+	assert.NoError(t, err)
+
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+
+	deleted, err := rd.DeletePrefix(context.TODO(), "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, 2000, deleted)
+	// a DEL of the values and one of their metadata per batch
+	assert.Equal(t, 8, counter.count("del"))
+
+	keys, err := rd.List(context.TODO(), "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{keep}, keys)
+}
+
+func TestRedisStorage_DeletePrefixCount(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	var keys []string
+	for i := 0; i < 10; i++ {
+		key := path.Join("acme", fmt.Sprintf("site%d.com", i), "cert.crt")
+		keys = append(keys, key)
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt")))
+	}
+
+	// some values are deleted by someone else between the scan and the DEL
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "DEL" {
+			mr.Select(9)
+			for _, key := range keys[:3] {
+				mr.Del(rd.prefixKey(key))
+			}
+		}
+		return false
+	})
+
+	deleted, err := rd.DeletePrefix(context.TODO(), "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, 7, deleted)
 }
 
 func TestRedisStorage_Stat(t *testing.T) {
@@ -100,75 +657,386 @@ func TestRedisStorage_Stat(t *testing.T) {
 	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
 	content := []byte("crt data")
 
-	err := rd.Store(key, content)
+	err := rd.Store(context.TODO(), key, content)
 	assert.NoError(t, err)
 
-	info, err := rd.Stat(key)
+	info, err := rd.Stat(context.TODO(), key)
 	assert.NoError(t, err)
 
 	assert.Equal(t, key, info.Key)
 }
 
+func TestRedisStorage_LightStat(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.LightStat = true
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	content := []byte("crt data")
+
+	err := rd.Store(context.TODO(), key, content)
+	assert.NoError(t, err)
+
+	// corrupt the value, so only the metadata can be used
+	err = rd.Client.Set(rd.ctx, rd.prefixKey(key), "garbage", 0).Err()
+	assert.NoError(t, err)
+
+	info, err := rd.Stat(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, key, info.Key)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.False(t, info.Modified.IsZero())
+
+	// metadata keys are never listed, and are removed with the value
+	keys, err := rd.List(context.TODO(), "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	err = rd.Delete(context.TODO(), key)
+	assert.NoError(t, err)
+	_, err = rd.Stat(context.TODO(), key)
+	assert.True(t, errors.Is(err, fs.ErrNotExist))
+
+	// storing with LightStat disabled removes the metadata, so it can't go stale
+	assert.NoError(t, rd.Store(context.TODO(), key, content))
+	rd.LightStat = false
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("longer crt data")))
+	exists, err := rd.Client.Exists(context.TODO(), rd.metadataKey(key)).Result()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), exists)
+	rd.LightStat = true
+	info, err = rd.Stat(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("longer crt data")), info.Size)
+}
+
+func BenchmarkRedisStorage_Stat(b *testing.B) {
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+
+	for _, lightStat := range []bool{false, true} {
+		b.Run(fmt.Sprintf("light_stat=%v", lightStat), func(b *testing.B) {
+			rd := new(RedisStorage)
+			rd.AesKey = "redistls-01234567890-caddytls-32"
+			rd.LightStat = lightStat
+			rd = setupRedisEnvWithStorage(b, miniredis.RunT(b), rd)
+
+			err := rd.Store(context.TODO(), key, make([]byte, 8192))
+			assert.NoError(b, err)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := rd.Stat(context.TODO(), key); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisStorage_ReadPrefixes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.ReadPrefixes = []string{"oldprefix"}
+	rd.ListReadPrefixes = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	old := setupRedisEnvWithServer(t, mr)
+	old.KeyPrefix = "oldprefix"
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	content := []byte("crt data")
+	err := old.Store(context.TODO(), key, content)
+	assert.NoError(t, err)
+
+	assert.True(t, rd.Exists(context.TODO(), key))
+
+	contentLoaded, err := rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, content, contentLoaded)
+
+	info, err := rd.Stat(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, key, info.Key)
+
+	keys, err := rd.List(context.TODO(), "acme", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	// writes only go to the primary prefix
+	err = rd.Store(context.TODO(), key, []byte("new crt data"))
+	assert.NoError(t, err)
+	mr.Select(9)
+	assert.True(t, mr.Exists(path.Join(TestPrefix, key)))
+
+	contentLoaded, err = rd.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new crt data"), contentLoaded)
+
+	contentLoaded, err = old.Load(context.TODO(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, content, contentLoaded)
+
+	// a key stored under both prefixes is listed once
+	keys, err = rd.List(context.TODO(), "acme", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+	leaves, err := rd.ListLeaves(context.TODO(), "acme")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, leaves)
+	var streamed []string
+	assert.NoError(t, rd.ListFunc(context.TODO(), "acme", func(key string) error {
+		streamed = append(streamed, key)
+		return nil
+	}))
+	assert.Equal(t, []string{key}, streamed)
+
+	// a deleted key doesn't come back from the read prefix, which is left alone
+	assert.NoError(t, rd.Delete(context.TODO(), key))
+	assert.False(t, rd.Exists(context.TODO(), key))
+	_, err = rd.Load(context.TODO(), key)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	keys, err = rd.List(context.TODO(), "acme", true)
+	assert.NoError(t, err)
+	assert.Empty(t, keys)
+	assert.NoError(t, rd.ListFunc(context.TODO(), "acme", func(key string) error {
+		t.Errorf("deleted key %s listed", key)
+		return nil
+	}))
+	assert.True(t, old.Exists(context.TODO(), key))
+
+	// until it is stored again
+	assert.NoError(t, rd.Store(context.TODO(), key, content))
+	assert.True(t, rd.Exists(context.TODO(), key))
+	keys, err = rd.List(context.TODO(), "acme", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	// a key only stored under the read prefix can be deleted too
+	onlyOld := path.Join("acme", "example.com", "sites", "example.com", "example.com.key")
+	assert.NoError(t, old.Store(context.TODO(), onlyOld, content))
+	assert.NoError(t, rd.Delete(context.TODO(), onlyOld))
+	assert.False(t, rd.Exists(context.TODO(), onlyOld))
+	assert.True(t, old.Exists(context.TODO(), onlyOld))
+}
+
+func TestRedisStorage_ReadPrefixesDuplicates(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.ReadPrefixes = []string{"old1", "old2"}
+	rd.ListReadPrefixes = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	old1 := setupRedisEnvWithServer(t, mr)
+	old1.KeyPrefix = "old1"
+	old2 := setupRedisEnvWithServer(t, mr)
+	old2.KeyPrefix = "old2"
+
+	inReadPrefixes := path.Join("certificates", "example.com", "example.com.crt")
+	inAll := path.Join("certificates", "example.com", "example.com.key")
+	for _, storage := range []*RedisStorage{old1, old2} {
+		assert.NoError(t, storage.Store(context.TODO(), inReadPrefixes, []byte("old")))
+		assert.NoError(t, storage.Store(context.TODO(), inAll, []byte("old")))
+	}
+	assert.NoError(t, rd.Store(context.TODO(), inAll, []byte("new")))
+
+	keys, err := rd.List(context.TODO(), "certificates", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{inReadPrefixes, inAll}, keys)
+
+	keys, err = rd.List(context.TODO(), "certificates", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join("certificates", "example.com")}, keys)
+
+	keys, err = rd.ListLeaves(context.TODO(), "certificates")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{inReadPrefixes, inAll}, keys)
+
+	// the primary prefix wins
+	content, err := rd.Load(context.TODO(), inAll)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("new"), content)
+}
+
 func TestRedisStorage_List(t *testing.T) {
 	rd := setupRedisEnv(t)
 
-	err := rd.Store(path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"), []byte("crt"))
+	err := rd.Store(context.TODO(), path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"), []byte("crt"))
 	assert.NoError(t, err)
-	err = rd.Store(path.Join("acme", "example.com", "sites", "example.com", "example.com.key"), []byte("key"))
+	err = rd.Store(context.TODO(), path.Join("acme", "example.com", "sites", "example.com", "example.com.key"), []byte("key"))
 	assert.NoError(t, err)
-	err = rd.Store(path.Join("acme", "example.com", "sites", "example.com", "example.com.json"), []byte("meta"))
+	err = rd.Store(context.TODO(), path.Join("acme", "example.com", "sites", "example.com", "example.com.json"), []byte("meta"))
 	assert.NoError(t, err)
 
-	keys, err := rd.List(path.Join("acme", "example.com", "sites", "example.com"), true)
+	keys, err := rd.List(context.TODO(), path.Join("acme", "example.com", "sites", "example.com"), true)
 	assert.NoError(t, err)
 	assert.Len(t, keys, 3)
 	assert.Contains(t, keys, path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"))
 
-	keys, err = rd.List("*", true)
+	keys, err = rd.List(context.TODO(), "*", true)
 	assert.NoError(t, err)
 	assert.Len(t, keys, 3)
 	assert.Contains(t, keys, path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"))
 
-	keys, err = rd.List("", true)
+	keys, err = rd.List(context.TODO(), "", true)
 	assert.NoError(t, err)
 	assert.Len(t, keys, 3)
 	assert.Contains(t, keys, path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"))
 
-	keys, err = rd.List("   ", true)
+	keys, err = rd.List(context.TODO(), "   ", true)
 	assert.NoError(t, err)
 	assert.Len(t, keys, 3)
 	assert.Contains(t, keys, path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"))
 }
 
+func TestRedisStorage_ListFunc(t *testing.T) {
+	rd := setupRedisEnv(t)
+
+	var keys []string
+	for i := 0; i < 500; i++ {
+		key := path.Join("acme", "example.com", "sites", fmt.Sprintf("site%d.com", i), "cert.crt")
+		keys = append(keys, key)
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt")))
+	}
+
+	var found []string
+	err := rd.ListFunc(context.TODO(), "acme", func(key string) error {
+		found = append(found, key)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, found)
+
+	// the callback stops the scan early
+	errStop := errors.New("stop")
+	visited := 0
+	err = rd.ListFunc(context.TODO(), "acme", func(key string) error {
+		visited++
+		if visited == 10 {
+			return errStop
+		}
+		return nil
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 10, visited)
+}
+
+func TestRedisStorage_ListLeaves(t *testing.T) {
+	rd := setupRedisEnv(t)
+
+	keys := []string{
+		path.Join("certificates", "acme", "example.com", "example.com.crt"),
+		path.Join("certificates", "acme", "example.com", "example.com.key"),
+		path.Join("certificates", "acme", "example.org", "example.org.crt"),
+	}
+	for _, key := range keys {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	}
+	assert.NoError(t, rd.Lock(context.TODO(), path.Join("certificates", "acme", "example.com")))
+	defer rd.Unlock(context.TODO(), path.Join("certificates", "acme", "example.com"))
+
+	leaves, err := rd.ListLeaves(context.TODO(), "certificates")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, leaves)
+
+	// even with directory entries in recursive listings
+	rd.ListOrder = ListOrderFilesystem
+	leaves, err = rd.ListLeaves(context.TODO(), path.Join("certificates", "acme"))
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, keys, leaves)
+}
+
+func TestRedisStorage_ListModifiedSince(t *testing.T) {
+	for _, lightStat := range []bool{false, true} {
+		t.Run(fmt.Sprintf("light_stat=%v", lightStat), func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rd := new(RedisStorage)
+			rd.UseServerTime = true
+			rd.LightStat = lightStat
+			rd = setupRedisEnvWithStorage(t, mr, rd)
+
+			now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+			ages := map[string]time.Duration{
+				"old.example.com":    30 * 24 * time.Hour,
+				"recent.example.com": 2 * 24 * time.Hour,
+				"new.example.com":    time.Hour,
+			}
+			for domain, age := range ages {
+				mr.SetTime(now.Add(-age))
+				key := path.Join("certificates", "acme", domain, domain+".crt")
+				assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+			}
+			assert.NoError(t, rd.Lock(context.TODO(), path.Join("certificates", "acme", "new.example.com")))
+			defer rd.Unlock(context.TODO(), path.Join("certificates", "acme", "new.example.com"))
+
+			keys, err := rd.ListModifiedSince(context.TODO(), "certificates", now.Add(-7*24*time.Hour))
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []string{
+				path.Join("certificates", "acme", "recent.example.com", "recent.example.com.crt"),
+				path.Join("certificates", "acme", "new.example.com", "new.example.com.crt"),
+			}, keys)
+
+			keys, err = rd.ListModifiedSince(context.TODO(), "certificates", now)
+			assert.NoError(t, err)
+			assert.Empty(t, keys)
+		})
+	}
+}
+
+func TestRedisStorage_ListMalformedKeys(t *testing.T) {
+	rd := setupRedisEnv(t)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	err := rd.Store(context.TODO(), key, []byte("crt"))
+	assert.NoError(t, err)
+
+	for _, malformed := range []string{
+		TestPrefix,
+		TestPrefix + "acme",
+		TestPrefix + "/acme//example.com",
+		TestPrefix + "/acme/example.com/\x00",
+		TestPrefix + "/acme/\xff\xfe",
+		TestPrefix + "/acme/example.com/",
+	} {
+		err = rd.Client.Set(rd.ctx, malformed, "foreign", 0).Err()
+		assert.NoError(t, err)
+	}
+
+	keys, err := rd.List(context.TODO(), "", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	keys, err = rd.List(context.TODO(), "acme", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{path.Join("acme", "example.com")}, keys)
+}
+
 func TestRedisStorage_ListNonRecursive(t *testing.T) {
 	rd := setupRedisEnv(t)
 
-	err := rd.Store(path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"), []byte("crt"))
+	err := rd.Store(context.TODO(), path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"), []byte("crt"))
 	assert.NoError(t, err)
-	err = rd.Store(path.Join("acme", "example.com", "sites", "example.com", "example.com.key"), []byte("key"))
+	err = rd.Store(context.TODO(), path.Join("acme", "example.com", "sites", "example.com", "example.com.key"), []byte("key"))
 	assert.NoError(t, err)
-	err = rd.Store(path.Join("acme", "example.com", "sites", "example.com", "example.com.json"), []byte("meta"))
+	err = rd.Store(context.TODO(), path.Join("acme", "example.com", "sites", "example.com", "example.com.json"), []byte("meta"))
 	assert.NoError(t, err)
 
-	keys, err := rd.List(path.Join("acme", "example.com", "sites"), false)
+	keys, err := rd.List(context.TODO(), path.Join("acme", "example.com", "sites"), false)
 	assert.NoError(t, err)
 
 	assert.Len(t, keys, 1)
 	assert.Contains(t, keys, path.Join("acme", "example.com", "sites", "example.com"))
 
-	keys, err = rd.List("*", false)
+	keys, err = rd.List(context.TODO(), "*", false)
 	assert.NoError(t, err)
 
 	assert.Len(t, keys, 3)
 	assert.Contains(t, keys, path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"))
 
-	keys, err = rd.List("", false)
+	keys, err = rd.List(context.TODO(), "", false)
 	assert.NoError(t, err)
 
 	assert.Len(t, keys, 3)
 	assert.Contains(t, keys, path.Join("acme", "example.com", "sites", "example.com", "example.com.crt"))
 
-	keys, err = rd.List("   ", false)
+	keys, err = rd.List(context.TODO(), "   ", false)
 	assert.NoError(t, err)
 
 	assert.Len(t, keys, 3)
@@ -182,7 +1050,262 @@ func TestRedisStorage_LockUnlock(t *testing.T) {
 	err := rd.Lock(context.TODO(), lockKey)
 	assert.NoError(t, err)
 
-	err = rd.Unlock(lockKey)
+	err = rd.Unlock(context.TODO(), lockKey)
+	assert.NoError(t, err)
+}
+
+func TestRedisStorage_LockTimeout(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.LockTimeout = Duration(time.Second)
+	rd.LockRefreshInterval = Duration(100 * time.Millisecond)
+	rd.LockPollInterval = Duration(10 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
+	lockName := rd.prefixKey(lockKey) + lockKeySuffix
+	mr.Select(9)
+
+	// the lock of an instance which stopped refreshing it can be obtained once
+	// the configured timeout is over
+	mr.Set(lockName, "token")
+	mr.SetTTL(lockName, time.Second)
+	obtained := make(chan error)
+	go func() { obtained <- rd.Lock(context.TODO(), lockKey) }()
+	time.Sleep(50 * time.Millisecond)
+	mr.FastForward(time.Second)
+	select {
+	case err := <-obtained:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("stale lock not obtained")
+	}
+	assert.Equal(t, time.Second, mr.TTL(lockName))
+
+	// while ours is kept past the timeout
+	mr.FastForward(600 * time.Millisecond)
+	time.Sleep(250 * time.Millisecond)
+	mr.FastForward(600 * time.Millisecond)
+	assert.True(t, mr.Exists(lockName))
+	assert.NoError(t, rd.Unlock(context.TODO(), lockKey))
+}
+
+func TestRedisStorage_LockTimeoutValidation(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.Address = mr.Addr()
+	rd.GetConfigValue()
+	rd.LockTimeout = Duration(time.Second)
+	rd.LockRefreshInterval = Duration(900 * time.Millisecond)
+	err := rd.BuildRedisClient()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid tunables")
+}
+
+func TestRedisStorage_LockNotifications(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.LockNotifications = true
+	rd.LockPollInterval = Duration(time.Second)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	other := new(RedisStorage)
+	other.Address = mr.Addr()
+	other.GetConfigValue()
+	other.LockNotifications = true
+	other.LockPollInterval = Duration(time.Second)
+	assert.NoError(t, other.BuildRedisClient())
+	t.Cleanup(func() { other.Cleanup() })
+	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
+
+	// the waiting instance is woken up by the release of the lock rather than
+	// by its next poll
+	assert.NoError(t, rd.Lock(context.TODO(), lockKey))
+	obtained := make(chan error)
+	go func() { obtained <- other.Lock(context.TODO(), lockKey) }()
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, rd.Unlock(context.TODO(), lockKey))
+	select {
+	case err := <-obtained:
+		assert.NoError(t, err)
+	case <-time.After(300 * time.Millisecond):
+		t.Fatal("released lock not obtained before the next poll")
+	}
+	assert.NoError(t, other.Unlock(context.TODO(), lockKey))
+}
+
+func TestRedisStorage_UnlockReacquired(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	other := new(RedisStorage)
+	other.Address = mr.Addr()
+	other.GetConfigValue()
+	assert.NoError(t, other.BuildRedisClient())
+	t.Cleanup(func() { other.Cleanup() })
+	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
+	lockName := rd.prefixKey(lockKey) + lockKeySuffix
+
+	// the instance stalls past the lock duration, so the lock expires and
+	// another instance obtains it
+	assert.NoError(t, rd.Lock(context.TODO(), lockKey))
+	mr.Select(9)
+	mr.FastForward(2 * LockDuration)
+	assert.False(t, mr.Exists(lockName))
+	assert.NoError(t, other.Lock(context.TODO(), lockKey))
+	value, err := mr.Get(lockName)
+	assert.NoError(t, err)
+
+	// releasing the expired lock isn't an error, and leaves the new one alone
+	assert.NoError(t, rd.Unlock(context.TODO(), lockKey))
+	held, err := mr.Get(lockName)
+	assert.NoError(t, err)
+	assert.Equal(t, value, held)
+	assert.NoError(t, other.Unlock(context.TODO(), lockKey))
+	assert.False(t, mr.Exists(lockName))
+}
+
+func TestRedisStorage_LockNotHeld(t *testing.T) {
+	mr := miniredis.RunT(t)
+	core, logs := observer.New(zap.WarnLevel)
+	rd := new(RedisStorage)
+	rd.Logger = zap.New(core).Sugar()
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
+	lockName := rd.prefixKey(lockKey) + lockKeySuffix
+	mr.Select(9)
+
+	// refreshing a lock which expired stops maintaining it and forgets it
+	assert.NoError(t, rd.Lock(context.TODO(), lockKey))
+	lockI, _ := rd.locks.Load(lockKey)
+	mr.Del(lockName)
+	done, err := rd.updateRedisLockFreshness(context.TODO(), rd.locks, lockKey, lockI.(*redislock.Lock))
+	assert.NoError(t, err)
+	assert.True(t, done)
+	_, exists := rd.locks.Load(lockKey)
+	assert.False(t, exists)
+	assert.NoError(t, rd.Unlock(context.TODO(), lockKey))
+
+	// releasing one succeeds
+	assert.NoError(t, rd.Lock(context.TODO(), lockKey))
+	mr.Del(lockName)
+	assert.NoError(t, rd.Unlock(context.TODO(), lockKey))
+	_, exists = rd.locks.Load(lockKey)
+	assert.False(t, exists)
+
+	assert.Equal(t, 2, logs.FilterMessageSnippet(lockKey).Len())
+	assert.Equal(t, 0, logs.FilterLevelExact(zap.ErrorLevel).Len())
+}
+
+func TestRedisStorage_TryLock(t *testing.T) {
+	rd := setupRedisEnv(t)
+	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
+
+	acquired, err := rd.TryLock(context.TODO(), lockKey)
+	assert.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = rd.TryLock(context.TODO(), lockKey)
+	assert.NoError(t, err)
+	assert.False(t, acquired)
+
+	err = rd.Unlock(context.TODO(), lockKey)
+	assert.NoError(t, err)
+}
+
+func TestRedisStorage_LockOwner(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.LockOwner = "caddy-{hostname}"
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
+
+	hostname, err := os.Hostname()
+	assert.NoError(t, err)
+
+	err = rd.Lock(context.TODO(), lockKey)
+	assert.NoError(t, err)
+
+	lockI, exists := rd.locks.Load(lockKey)
+	assert.True(t, exists)
+	lock := lockI.(*redislock.Lock)
+	assert.Equal(t, rd.locks.owner+"caddy-"+hostname, lock.Metadata())
+
+	value, err := rd.Client.Get(rd.ctx, rd.prefixKey(lockKey)+".lock").Result()
+	assert.NoError(t, err)
+	assert.Equal(t, lock.Token()+rd.locks.owner+"caddy-"+hostname, value)
+
+	err = rd.Unlock(context.TODO(), lockKey)
+	assert.NoError(t, err)
+}
+
+func TestRedisStorage_LockReload(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+	assert.NoError(t, rd.UpdateTunables(Tunables{
+		LockTimeout:         200 * time.Millisecond,
+		LockRefreshInterval: 20 * time.Millisecond,
+	}))
+	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
+	lockName := rd.prefixKey(lockKey) + lockKeySuffix
+
+	assert.NoError(t, rd.Lock(context.TODO(), lockKey))
+	oldLocks := rd.locks
+	lockI, _ := oldLocks.Load(lockKey)
+	oldLock := lockI.(*redislock.Lock)
+
+	// reloading builds the client again, under a new owner, after stopping
+	// the refresher of the lock obtained before
+	previousClient := rd.Client
+	previousBackground := rd.background
+	assert.NoError(t, rd.BuildRedisClient())
+	t.Cleanup(func() { previousClient.Close() })
+	assert.NotEqual(t, oldLocks.owner, rd.locks.owner)
+	stopped := make(chan struct{})
+	go func() {
+		previousBackground.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("background goroutines of the previous build still running")
+	}
+
+	// the lock obtained before can't be refreshed or released anymore
+	done, err := rd.updateRedisLockFreshness(context.TODO(), oldLocks, lockKey, oldLock)
+	assert.NoError(t, err)
+	assert.True(t, done)
+	rd.locks.Store(lockKey, oldLock)
+	assert.Error(t, rd.Unlock(context.TODO(), lockKey))
+	mr.Select(9)
+	assert.True(t, mr.Exists(lockName))
+
+	// so it expires, and the lock obtained after the reload carries the new owner
+	mr.FastForward(250 * time.Millisecond)
+	assert.False(t, mr.Exists(lockName))
+	assert.NoError(t, rd.Lock(context.TODO(), lockKey))
+	value, err := mr.Get(lockName)
+	assert.NoError(t, err)
+	assert.Contains(t, value, rd.locks.owner)
+	assert.NoError(t, rd.Unlock(context.TODO(), lockKey))
+	assert.False(t, mr.Exists(lockName))
+}
+
+func TestRedisStorage_LockHeldWarning(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	rd := new(RedisStorage)
+	rd.Logger = zap.New(core).Sugar()
+	rd.LockHeldWarnRefreshes = 3
+	rd = setupRedisEnvWithStorage(t, miniredis.RunT(t), rd)
+	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
+
+	err := rd.UpdateTunables(Tunables{LockRefreshInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+
+	err = rd.Lock(context.TODO(), lockKey)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return logs.FilterMessageSnippet(lockKey).Len() > 0
+	}, time.Second, 10*time.Millisecond)
+
+	err = rd.Unlock(context.TODO(), lockKey)
 	assert.NoError(t, err)
 }
 
@@ -191,18 +1314,53 @@ func lockAndUnlock(wg *sync.WaitGroup, t *testing.T, rd *RedisStorage, lockKey s
 
 	err := rd.Lock(context.TODO(), lockKey)
 	assert.NoError(t, err)
-	err = rd.Unlock(lockKey)
+	err = rd.Unlock(context.TODO(), lockKey)
 	assert.NoError(t, err)
 }
 
+func TestRedisStorage_Cleanup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.LockSweepInterval = Duration(time.Hour)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	assert.NoError(t, rd.Lock(context.TODO(), "example.com"))
+	assert.NoError(t, rd.Lock(context.TODO(), "example.org"))
+
+	done := make(chan struct{})
+	go func() {
+		assert.NoError(t, rd.Cleanup())
+		close(done)
+	}()
+
+	// the lock refreshers sleep for LockFreshnessInterval and the sweeper for an hour
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("background goroutines still running after Cleanup")
+	}
+
+	// the locks are released rather than left to expire, and the client closed
+	mr.Select(9)
+	assert.False(t, mr.Exists(rd.prefixKey("example.com")+lockKeySuffix))
+	assert.False(t, mr.Exists(rd.prefixKey("example.org")+lockKeySuffix))
+	_, exists := rd.locks.Load("example.com")
+	assert.False(t, exists)
+	assert.EqualError(t, rd.Client.Ping(context.TODO()).Err(), "redis: client is closed")
+
+	// cleaning up again does nothing
+	assert.NoError(t, rd.Cleanup())
+}
+
 func TestRedisStorage_MultipleLocks(t *testing.T) {
 	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
 
 	var wg sync.WaitGroup
 	rds := make([]*RedisStorage, 100)
+	mr := miniredis.RunT(t)
 
 	for i := 0; i < 100; i++ {
-		rd := setupRedisEnv(t)
+		rd := setupRedisEnvWithServer(t, mr)
 		wg.Add(1)
 		rds[i] = rd
 	}
@@ -251,3 +1409,76 @@ func TestRedisStorage_String(t *testing.T) {
 		})
 	})
 }
+
+func TestRedisStorage_ListDeadline(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	for i := 0; i < 1000; i++ {
+		err := rd.Store(context.TODO(), path.Join("acme", "example.com", "sites", fmt.Sprintf("site%d.com", i), "cert.crt"), []byte("crt"))
+		assert.NoError(t, err)
+	}
+
+	// a slow SCAN, so the deadline expires while the keys are being scanned
+	mr.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd == "SCAN" {
+			time.Sleep(50 * time.Millisecond)
+		}
+		return false
+	})
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := rd.List(ctx, path.Join("acme", "example.com", "sites"), true)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "%v", err)
+	assert.Less(t, time.Since(start), time.Second)
+	// stopped partway through, rather than before the first SCAN or after the last
+	assert.Greater(t, counter.count("scan"), 1)
+	assert.Less(t, counter.count("scan"), int(1000/ScanCount))
+}
+
+func TestRedisStorage_ListConsistency(t *testing.T) {
+	for _, consistency := range []string{ListConsistencyScan, ListConsistencyKeys} {
+		t.Run(consistency, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rd := new(RedisStorage)
+			rd.ListConsistency = consistency
+			rd = setupRedisEnvWithStorage(t, mr, rd)
+			counter := &commandCounter{}
+			rd.Client.AddHook(counter)
+
+			var keys []string
+			for i := 0; i < 300; i++ {
+				key := path.Join("acme", "example.com", "sites", fmt.Sprintf("site%d.com", i), "cert.crt")
+				keys = append(keys, key)
+				assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt")))
+			}
+
+			found, err := rd.List(context.TODO(), "acme", true)
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, keys, found)
+
+			if consistency == ListConsistencyKeys {
+				assert.Equal(t, 1, counter.count("keys"))
+				assert.Equal(t, 0, counter.count("scan"))
+			} else {
+				assert.Equal(t, 0, counter.count("keys"))
+				assert.Greater(t, counter.count("scan"), 1)
+			}
+		})
+	}
+}
+
+func TestRedisStorage_ListConsistencyUnknown(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.Address = mr.Addr()
+	rd.ListConsistency = "snapshot"
+	rd.GetConfigValue()
+
+	assert.Error(t, rd.BuildRedisClient())
+}
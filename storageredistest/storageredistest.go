@@ -0,0 +1,39 @@
+// Package storageredistest provides Redis storages backed by an in-memory Redis
+// server, for the tests of programs using storageredis, without running Redis.
+package storageredistest
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+
+	storageredis "github.com/webappio/caddy-tlsredis"
+)
+
+// New returns a storage with the default settings, backed by an in-memory Redis
+// server that is stopped, along with the storage, when the test ends. It
+// satisfies certmagic.Storage with the same semantics as when backed by Redis,
+// fs.ErrNotExist for missing keys included.
+func New(tb testing.TB) *storageredis.RedisStorage {
+	return Start(tb, new(storageredis.RedisStorage))
+}
+
+// Start builds rd, configured by the caller, against an in-memory Redis server
+// that is stopped, along with rd, when the test ends, and returns rd. The
+// address of the server replaces any address or shards set in rd.
+func Start(tb testing.TB, rd *storageredis.RedisStorage) *storageredis.RedisStorage {
+	tb.Helper()
+
+	mr := miniredis.RunT(tb)
+	rd.Address = mr.Addr()
+	rd.ShardAddresses = nil
+	rd.GetConfigValue()
+	if err := rd.BuildRedisClient(); err != nil {
+		tb.Fatalf("unable to build redis storage: %v", err)
+	}
+	tb.Cleanup(func() {
+		rd.Cleanup()
+		rd.Client.Close()
+	})
+	return rd
+}
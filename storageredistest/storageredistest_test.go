@@ -0,0 +1,71 @@
+package storageredistest
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+
+	storageredis "github.com/webappio/caddy-tlsredis"
+)
+
+func TestNew(t *testing.T) {
+	var storage certmagic.Storage = New(t)
+	ctx := context.TODO()
+	key := path.Join("certificates", "example.com", "example.com.crt")
+
+	_, err := storage.Load(ctx, key)
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "%v", err)
+	_, err = storage.Stat(ctx, key)
+	assert.True(t, errors.Is(err, fs.ErrNotExist), "%v", err)
+	assert.True(t, errors.Is(storage.Delete(ctx, key), fs.ErrNotExist))
+	assert.False(t, storage.Exists(ctx, key))
+
+	assert.NoError(t, storage.Store(ctx, key, []byte("crt data")))
+	assert.True(t, storage.Exists(ctx, key))
+	content, err := storage.Load(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), content)
+	info, err := storage.Stat(ctx, key)
+	assert.NoError(t, err)
+	assert.Equal(t, key, info.Key)
+	assert.Equal(t, int64(len("crt data")), info.Size)
+
+	keys, err := storage.List(ctx, "certificates", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	assert.NoError(t, storage.Lock(ctx, key))
+	assert.NoError(t, storage.Unlock(ctx, key))
+
+	assert.NoError(t, storage.Delete(ctx, key))
+	assert.False(t, storage.Exists(ctx, key))
+}
+
+func TestStart(t *testing.T) {
+	rd := new(storageredis.RedisStorage)
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+	rd.KeyPrefix = "test"
+	rd = Start(t, rd)
+
+	assert.NoError(t, rd.Store(context.TODO(), "key", []byte("value")))
+	stored, err := rd.Client.Get(context.TODO(), "test/key").Bytes()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(stored), "value")
+
+	content, err := rd.Load(context.TODO(), "key")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("value"), content)
+}
+
+func TestNewIsolated(t *testing.T) {
+	first := New(t)
+	second := New(t)
+
+	assert.NoError(t, first.Store(context.TODO(), "key", []byte("value")))
+	assert.False(t, second.Exists(context.TODO(), "key"))
+}
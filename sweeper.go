@@ -0,0 +1,94 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"runtime"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// SweepLocks deletes the lock keys that have no expiration. Locks are always
+// obtained with an expiration, so those are left behind by a bug and would
+// otherwise never be released. It returns how many lock keys were deleted.
+func (rd *RedisStorage) SweepLocks(ctx context.Context) (int, error) {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	swept, err := rd.sweepLocks(opCtx)
+	return swept, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd *RedisStorage) sweepLocks(ctx context.Context) (int, error) {
+	search := path.Join(rd.keyPrefix(), "*") + lockKeySuffix
+	swept := 0
+
+	err := rd.scan(ctx, search, func(keys []string) error {
+		for _, key := range keys {
+			deleted, err := rd.deleteStaleLock(ctx, key)
+			if err != nil {
+				return err
+			}
+			if deleted {
+				swept++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return swept, fmt.Errorf("unable to sweep locks: %v", err)
+	}
+	return swept, nil
+}
+
+// deleteStaleLockSource deletes a lock key only if it has no expiration, in a single
+// step so a lock obtained with an expiration in the meantime is never deleted
+const deleteStaleLockSource = `
+if redis.call("PTTL", KEYS[1]) == -1 then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`
+
+var deleteStaleLockScript = redis.NewScript(deleteStaleLockSource)
+
+// deleteStaleLock deletes the lock key lockKey if it has no expiration. A lock
+// with an expiration may be held, and goes away by itself otherwise.
+func (rd *RedisStorage) deleteStaleLock(ctx context.Context, lockKey string) (bool, error) {
+	deleted, err := deleteStaleLockScript.Run(ctx, rd.clientFor(lockKey), []string{lockKey}).Int()
+	if err != nil {
+		return false, fmt.Errorf("unable to delete lock %s: %v", lockKey, err)
+	}
+	if deleted == 0 {
+		return false, nil
+	}
+	rd.Logger.Infof("[INFO] Removed lock without expiration (lock: %s)", lockKey)
+	return true, nil
+}
+
+// sweepLocksPeriodically runs SweepLocks every LockSweepInterval until ctx is done
+func (rd *RedisStorage) sweepLocksPeriodically(ctx context.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, stackTraceBufferSize)
+			buf = buf[:runtime.Stack(buf, false)]
+			rd.Logger.Errorf("panic: sweeping locks: %v\n%s", err, buf)
+		}
+	}()
+
+	ticker := time.NewTicker(time.Duration(rd.LockSweepInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := rd.SweepLocks(ctx); err != nil {
+				rd.Logger.Errorf("[ERROR] Sweeping redis locks: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
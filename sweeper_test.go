@@ -0,0 +1,114 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_SweepLocks(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	key := path.Join("acme", "example.com", "sites", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	heldLock := path.Join("acme", "example.com", "held")
+	assert.NoError(t, rd.Lock(context.TODO(), heldLock))
+	staleLock := rd.prefixKey(path.Join("acme", "example.com", "stale")) + lockKeySuffix
+	assert.NoError(t, rd.Client.Set(rd.ctx, staleLock, "token", 0).Err())
+
+	swept, err := rd.SweepLocks(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, swept)
+
+	mr.Select(9)
+	assert.False(t, mr.Exists(staleLock))
+	assert.True(t, mr.Exists(rd.prefixKey(heldLock)+lockKeySuffix))
+	assert.True(t, rd.Exists(context.TODO(), key))
+
+	assert.NoError(t, rd.Unlock(context.TODO(), heldLock))
+}
+
+func TestRedisStorage_SweepLocksPeriodically(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.LockSweepInterval = Duration(10 * time.Millisecond)
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	staleLock := rd.prefixKey("stale") + lockKeySuffix
+	assert.NoError(t, rd.Client.Set(rd.ctx, staleLock, "token", 0).Err())
+
+	mr.Select(9)
+	assert.Eventually(t, func() bool {
+		return !mr.Exists(staleLock)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisStorage_DeleteLocks(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.DeleteLocks = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	staleKey := path.Join("certificates", "example.com", "example.com.crt")
+	heldKey := path.Join("certificates", "example.org", "example.org.crt")
+	for _, key := range []string{staleKey, heldKey} {
+		assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	}
+	staleLock := rd.prefixKey(staleKey) + lockKeySuffix
+	assert.NoError(t, rd.Client.Set(rd.ctx, staleLock, "token", 0).Err())
+	assert.NoError(t, rd.Lock(context.TODO(), heldKey))
+
+	assert.NoError(t, rd.Delete(context.TODO(), staleKey))
+	assert.NoError(t, rd.Delete(context.TODO(), heldKey))
+
+	mr.Select(9)
+	assert.False(t, mr.Exists(rd.prefixKey(staleKey)))
+	assert.False(t, mr.Exists(staleLock))
+	assert.False(t, mr.Exists(rd.prefixKey(heldKey)))
+	// our own lock goes with the key
+	assert.False(t, mr.Exists(rd.prefixKey(heldKey)+lockKeySuffix))
+}
+
+func TestRedisStorage_SweepLocksAtomic(t *testing.T) {
+	rd := setupRedisEnv(t)
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+
+	staleLock := rd.prefixKey("stale") + lockKeySuffix
+	assert.NoError(t, rd.Client.Set(rd.ctx, staleLock, "token", 0).Err())
+
+	swept, err := rd.SweepLocks(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, swept)
+
+	// the TTL check and the deletion happen in the same script
+	assert.Equal(t, 0, counter.count("pttl"))
+	assert.Equal(t, 0, counter.count("del"))
+}
+
+func TestRedisStorage_DeleteLocksHeldElsewhere(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.DeleteLocks = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+	other := setupRedisEnvWithStorage(t, mr, new(RedisStorage))
+	counter := &commandCounter{}
+	rd.Client.AddHook(counter)
+
+	key := path.Join("certificates", "example.com", "example.com.crt")
+	assert.NoError(t, rd.Store(context.TODO(), key, []byte("crt data")))
+	assert.NoError(t, other.Lock(context.TODO(), key))
+	defer other.Unlock(context.TODO(), key)
+
+	assert.NoError(t, rd.Delete(context.TODO(), key))
+
+	mr.Select(9)
+	assert.True(t, mr.Exists(rd.prefixKey(key)+lockKeySuffix))
+	// no separate TTL check another instance could slip a lock in after
+	assert.Equal(t, 0, counter.count("pttl"))
+}
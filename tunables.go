@@ -0,0 +1,110 @@
+package storageredis
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Tunables are the settings that can be changed at runtime with UpdateTunables,
+// without rebuilding the Redis client
+type Tunables struct {
+	// LockTimeout is the TTL of the locks we obtain
+	LockTimeout time.Duration
+	// LockPollInterval is how frequently Lock checks whether a held lock got released
+	LockPollInterval time.Duration
+	// LockRefreshInterval is how often the TTL of the locks we hold is refreshed
+	LockRefreshInterval time.Duration
+	// ScanCount is the COUNT hint of the SCAN commands issued by List
+	ScanCount int64
+}
+
+// defaultTunables returns the Tunables used unless configured otherwise
+func defaultTunables() Tunables {
+	return Tunables{
+		LockTimeout:         LockDuration,
+		LockPollInterval:    LockPollInterval,
+		LockRefreshInterval: LockFreshnessInterval,
+		ScanCount:           ScanCount,
+	}
+}
+
+// configuredTunables returns the default Tunables overridden by the configured ones
+func (rd *RedisStorage) configuredTunables() Tunables {
+	t := defaultTunables()
+	if rd.LockTimeout != 0 {
+		t.LockTimeout = time.Duration(rd.LockTimeout)
+	}
+	if rd.LockRefreshInterval != 0 {
+		t.LockRefreshInterval = time.Duration(rd.LockRefreshInterval)
+	}
+	if rd.LockPollInterval != 0 {
+		t.LockPollInterval = time.Duration(rd.LockPollInterval)
+	}
+	if rd.ScanCount != 0 {
+		t.ScanCount = rd.ScanCount
+	}
+	return t
+}
+
+// validate checks that t is usable
+func (t Tunables) validate() error {
+	if t.LockTimeout <= 0 || t.LockPollInterval <= 0 || t.LockRefreshInterval <= 0 {
+		return fmt.Errorf("lock timeout, poll interval and refresh interval must be positive")
+	}
+	// leave room for a refresh to be late or fail once before the lock expires
+	if 2*t.LockRefreshInterval > t.LockTimeout {
+		return fmt.Errorf("lock refresh interval %v must be at most half of lock timeout %v", t.LockRefreshInterval, t.LockTimeout)
+	}
+	if t.ScanCount <= 0 {
+		return fmt.Errorf("scan count must be positive")
+	}
+	return nil
+}
+
+// tunables guards the Tunables shared by in-flight operations and lock refresh goroutines
+type tunables struct {
+	mu      sync.RWMutex
+	current Tunables
+}
+
+// Tunables returns the Tunables currently in use
+func (rd *RedisStorage) Tunables() Tunables {
+	if rd.tunables == nil {
+		return defaultTunables()
+	}
+	rd.tunables.mu.RLock()
+	defer rd.tunables.mu.RUnlock()
+	return rd.tunables.current
+}
+
+// UpdateTunables replaces the Tunables used by subsequent operations, including the
+// refresh of locks already held. Zero fields in t keep their current value.
+func (rd *RedisStorage) UpdateTunables(t Tunables) error {
+	if rd.tunables == nil {
+		return fmt.Errorf("redis client is not built yet")
+	}
+
+	rd.tunables.mu.Lock()
+	defer rd.tunables.mu.Unlock()
+
+	updated := rd.tunables.current
+	if t.LockTimeout != 0 {
+		updated.LockTimeout = t.LockTimeout
+	}
+	if t.LockPollInterval != 0 {
+		updated.LockPollInterval = t.LockPollInterval
+	}
+	if t.LockRefreshInterval != 0 {
+		updated.LockRefreshInterval = t.LockRefreshInterval
+	}
+	if t.ScanCount != 0 {
+		updated.ScanCount = t.ScanCount
+	}
+	if err := updated.validate(); err != nil {
+		return fmt.Errorf("invalid tunables: %v", err)
+	}
+
+	rd.tunables.current = updated
+	return nil
+}
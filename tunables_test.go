@@ -0,0 +1,68 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_UpdateTunables(t *testing.T) {
+	rd := setupRedisEnv(t)
+
+	err := rd.UpdateTunables(Tunables{LockRefreshInterval: time.Hour})
+	assert.Error(t, err)
+	assert.Equal(t, defaultTunables(), rd.Tunables())
+
+	err = rd.UpdateTunables(Tunables{ScanCount: 10, LockPollInterval: 10 * time.Millisecond})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), rd.Tunables().ScanCount)
+	assert.Equal(t, 10*time.Millisecond, rd.Tunables().LockPollInterval)
+	assert.Equal(t, LockDuration, rd.Tunables().LockTimeout)
+}
+
+// run with -race to check the tunables are safe to update while in use
+func TestRedisStorage_UpdateTunablesConcurrently(t *testing.T) {
+	rd := setupRedisEnv(t)
+	lockKey := "issue_cert_example.com"
+
+	for i := 0; i < 50; i++ {
+		err := rd.Store(context.TODO(), path.Join("acme", fmt.Sprintf("site%d.com", i)), []byte("crt"))
+		assert.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 20; i++ {
+			err := rd.UpdateTunables(Tunables{
+				ScanCount:           int64(i),
+				LockPollInterval:    time.Duration(i) * time.Millisecond,
+				LockRefreshInterval: time.Duration(i) * time.Millisecond,
+			})
+			assert.NoError(t, err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			keys, err := rd.List(context.TODO(), "acme", true)
+			assert.NoError(t, err)
+			assert.Len(t, keys, 50)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			assert.NoError(t, rd.Lock(context.TODO(), lockKey))
+			time.Sleep(25 * time.Millisecond)
+			assert.NoError(t, rd.Unlock(context.TODO(), lockKey))
+		}
+	}()
+	wg.Wait()
+}
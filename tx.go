@@ -0,0 +1,128 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// execTx runs commands, given as their arguments, in a MULTI/EXEC transaction on
+// client, in a single round trip, and returns their replies. TxPipelined replaces
+// the error Redis rejects a queued command with, such as OOM, by the EXECABORT of
+// the whole transaction; execTx returns it instead.
+func execTx(ctx context.Context, client redis.UniversalClient, commands [][]interface{}) ([]interface{}, error) {
+	if _, ok := client.(*redis.ClusterClient); ok {
+		return execClusterTx(ctx, client, commands)
+	}
+
+	pipe := client.Pipeline()
+	pipe.Do(ctx, "multi")
+	for _, args := range commands {
+		pipe.Do(ctx, args...)
+	}
+	exec := pipe.Do(ctx, "exec")
+
+	// the first error is the one a command was rejected with when queued
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	// errors of commands that failed when executed are in the reply of EXEC
+	results, _ := exec.Val().([]interface{})
+	for _, result := range results {
+		if err, ok := result.(error); ok {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// execClusterTx runs commands in a transaction on the node of the Redis Cluster
+// serving their slot, with TxPipeline, as MULTI and EXEC have no key to route them
+// by. The commands must all use keys of the same slot, see HashTagKeys.
+func execClusterTx(ctx context.Context, client redis.UniversalClient, commands [][]interface{}) ([]interface{}, error) {
+	pipe := client.TxPipeline()
+	cmds := make([]*redis.Cmd, len(commands))
+	for i, args := range commands {
+		cmds[i] = pipe.Do(ctx, args...)
+	}
+	_, _ = pipe.Exec(ctx)
+
+	results := make([]interface{}, len(cmds))
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil && err != redis.Nil {
+			return nil, err
+		}
+		results[i] = cmd.Val()
+	}
+	return results, nil
+}
+
+// maxCheckedTxAttempts is how many times execChecked starts over when the keys it
+// watches are written by someone else in the meantime
+const maxCheckedTxAttempts = 10
+
+// txCheck reads what it needs through tx, and returns an error if the
+// transaction of execChecked mustn't run
+type txCheck func(tx *redis.Tx) error
+
+// execChecked runs commands like execTx, unless one of checks fails. The watched
+// keys, which the checks read, are watched from before the checks run, so the
+// transaction fails if one is written before it runs, and starts over.
+func execChecked(ctx context.Context, client redis.UniversalClient, watched []string, checks []txCheck, commands [][]interface{}) error {
+	checkAndSet := func(tx *redis.Tx) error {
+		for _, check := range checks {
+			if err := check(tx); err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, args := range commands {
+				pipe.Do(ctx, args...)
+			}
+			return nil
+		})
+		return err
+	}
+
+	for attempt := 0; attempt < maxCheckedTxAttempts; attempt++ {
+		err := client.Watch(ctx, checkAndSet, watched...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("%v kept being written concurrently", strings.Join(watched, ", "))
+}
+
+// newerCheck fails with ErrStaleWrite when the value stored at key was modified at
+// or after modified, see StoreIfNewer. It reads the Redis key of key.
+func (rd RedisStorage) newerCheck(ctx context.Context, key string, modified time.Time) txCheck {
+	return func(tx *redis.Tx) error {
+		stored, err := tx.Get(ctx, rd.prefixKey(key)).Bytes()
+		if err == redis.Nil {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		data, err := rd.decryptData(key, stored)
+		if err != nil {
+			return err
+		}
+		if !modified.After(data.Modified) {
+			return fmt.Errorf("%w for %v: modified at %v", ErrStaleWrite, key, data.Modified)
+		}
+		return nil
+	}
+}
+
+// setCommand returns the arguments of a SET of key to value, expiring after ttl unless 0
+func setCommand(key string, value interface{}, ttl time.Duration) []interface{} {
+	if ttl > 0 {
+		return []interface{}{"set", key, value, "px", ttl.Milliseconds()}
+	}
+	return []interface{}{"set", key, value}
+}
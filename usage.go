@@ -0,0 +1,107 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// usageBatchSize is the number of keys measured per pipeline by Usage
+const usageBatchSize = 1000
+
+// Usage is the space used by the storage in Redis
+type Usage struct {
+	// Keys is the number of stored values
+	Keys int `json:"keys"`
+
+	// Bytes is the approximate size of the stored values, including their metadata
+	Bytes int64 `json:"bytes"`
+
+	// Categories breaks Keys and Bytes down by the first segment of the keys,
+	// like certificates, ocsp or acme
+	Categories map[string]CategoryUsage `json:"categories"`
+}
+
+// CategoryUsage is the space used by the values under a top-level key
+type CategoryUsage struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Usage scans all keys under KeyPrefix and measures their size. It reads every
+// key, so it shouldn't be called on a hot path.
+func (rd RedisStorage) Usage(ctx context.Context) (Usage, error) {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	usage, err := rd.computeUsage(opCtx)
+	return usage, classifyTimeout(ctx, opCtx, err)
+}
+
+func (rd RedisStorage) computeUsage(ctx context.Context) (Usage, error) {
+	usage := Usage{Categories: make(map[string]CategoryUsage)}
+
+	keys, err := rd.scanKeys(ctx, rd.keyPrefix(), "")
+	if err != nil {
+		return usage, fmt.Errorf("unable to compute usage: %v", err)
+	}
+
+	for start := 0; start < len(keys); start += usageBatchSize {
+		end := start + usageBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		batches := make(map[redis.UniversalClient][]string)
+		for _, key := range keys[start:end] {
+			if !strings.HasSuffix(key, lockKeySuffix) {
+				client := rd.clientFor(rd.prefixKey(key))
+				batches[client] = append(batches[client], key)
+			}
+		}
+
+		for client, batch := range batches {
+			if err := rd.measureUsage(ctx, client, batch, &usage); err != nil {
+				return usage, fmt.Errorf("unable to compute usage: %v", err)
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+// measureUsage adds the size of keys, all stored on client, to usage
+func (rd RedisStorage) measureUsage(ctx context.Context, client redis.UniversalClient, keys []string, usage *Usage) error {
+	valueLens := make([]*redis.IntCmd, len(keys))
+	metadataLens := make([]*redis.IntCmd, len(keys))
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			valueLens[i] = pipe.StrLen(ctx, rd.prefixKey(key))
+			metadataLens[i] = pipe.StrLen(ctx, rd.metadataKey(key))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		// a missing key has a length of 0, it was deleted since the scan
+		if valueLens[i].Val() == 0 {
+			continue
+		}
+		size := valueLens[i].Val() + metadataLens[i].Val()
+		category := strings.SplitN(key, "/", 2)[0]
+
+		categoryUsage := usage.Categories[category]
+		categoryUsage.Keys++
+		categoryUsage.Bytes += size
+		usage.Categories[category] = categoryUsage
+
+		usage.Keys++
+		usage.Bytes += size
+	}
+	return nil
+}
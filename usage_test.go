@@ -0,0 +1,48 @@
+package storageredis
+
+import (
+	"context"
+	"path"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_Usage(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	values := map[string][]byte{
+		path.Join("certificates", "acme", "example.com", "example.com.crt"): []byte("crt data"),
+		path.Join("certificates", "acme", "example.com", "example.com.key"): []byte("key data"),
+		path.Join("ocsp", "example.com-1234"):                               []byte("ocsp"),
+		path.Join("acme", "users", "me", "me.json"):                         []byte("{}"),
+	}
+	sizes := make(map[string]int64)
+	for key, value := range values {
+		assert.NoError(t, rd.Store(context.TODO(), key, value))
+		size, err := rd.Client.StrLen(context.TODO(), rd.prefixKey(key)).Result()
+		assert.NoError(t, err)
+		sizes[key] = size
+	}
+	assert.NoError(t, rd.Lock(context.TODO(), path.Join("certificates", "example.com")))
+	defer rd.Unlock(context.TODO(), path.Join("certificates", "example.com"))
+
+	usage, err := rd.Usage(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 4, usage.Keys)
+	assert.Equal(t, sizes[path.Join("certificates", "acme", "example.com", "example.com.crt")]+
+		sizes[path.Join("certificates", "acme", "example.com", "example.com.key")]+
+		sizes[path.Join("ocsp", "example.com-1234")]+
+		sizes[path.Join("acme", "users", "me", "me.json")], usage.Bytes)
+	assert.Equal(t, map[string]CategoryUsage{
+		"certificates": {
+			Keys: 2,
+			Bytes: sizes[path.Join("certificates", "acme", "example.com", "example.com.crt")] +
+				sizes[path.Join("certificates", "acme", "example.com", "example.com.key")],
+		},
+		"ocsp": {Keys: 1, Bytes: sizes[path.Join("ocsp", "example.com-1234")]},
+		"acme": {Keys: 1, Bytes: sizes[path.Join("acme", "users", "me", "me.json")]},
+	}, usage.Categories)
+}
@@ -0,0 +1,76 @@
+package storageredis
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ErrInvalidCertData is returned by Store when ValidateCertData is enabled and
+// the certificate material doesn't parse
+var ErrInvalidCertData = errors.New("invalid certificate data")
+
+// validateCertData checks that certificates and private keys stored under certmagic's
+// certificates/ path parse as PEM. Other keys, like account or OCSP data, aren't checked.
+func validateCertData(key string, value []byte) error {
+	if !strings.HasPrefix(key, "certificates/") {
+		return nil
+	}
+
+	switch path.Ext(key) {
+	case ".crt":
+		return validateCertificates(value)
+	case ".key":
+		return validatePrivateKey(value)
+	default:
+		return nil
+	}
+}
+
+// validateCertificates checks value is a PEM encoded certificate chain
+func validateCertificates(value []byte) error {
+	found := 0
+	for rest := value; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return fmt.Errorf("%w: certificate %d: %v", ErrInvalidCertData, found+1, err)
+		}
+		found++
+	}
+	if found == 0 {
+		return fmt.Errorf("%w: no PEM encoded certificate found", ErrInvalidCertData)
+	}
+	return nil
+}
+
+// validatePrivateKey checks value is a PEM encoded private key
+func validatePrivateKey(value []byte) error {
+	block, _ := pem.Decode(value)
+	if block == nil || !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+		return fmt.Errorf("%w: no PEM encoded private key found", ErrInvalidCertData)
+	}
+
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		_, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		_, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		_, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCertData, err)
+	}
+	return nil
+}
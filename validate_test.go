@@ -0,0 +1,70 @@
+package storageredis
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate returns a PEM encoded self-signed certificate and its private key
+func testCertificate(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestRedisStorage_ValidateCertData(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.ValidateCertData = true
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	crtPEM, keyPEM := testCertificate(t)
+	dir := path.Join("certificates", "acme-v02.api.letsencrypt.org-directory", "example.com")
+
+	assert.NoError(t, rd.Store(context.TODO(), path.Join(dir, "example.com.crt"), crtPEM))
+	assert.NoError(t, rd.Store(context.TODO(), path.Join(dir, "example.com.key"), keyPEM))
+	assert.NoError(t, rd.Store(context.TODO(), path.Join(dir, "example.com.json"), []byte(`{"sans":["example.com"]}`)))
+
+	garbage := []byte("not a certificate")
+	err := rd.Store(context.TODO(), path.Join(dir, "example.com.crt"), garbage)
+	assert.True(t, errors.Is(err, ErrInvalidCertData))
+	err = rd.Store(context.TODO(), path.Join(dir, "example.com.key"), crtPEM)
+	assert.True(t, errors.Is(err, ErrInvalidCertData))
+
+	// the valid certificate was kept
+	content, err := rd.Load(context.TODO(), path.Join(dir, "example.com.crt"))
+	assert.NoError(t, err)
+	assert.Equal(t, crtPEM, content)
+
+	// other data isn't checked
+	assert.NoError(t, rd.Store(context.TODO(), path.Join("ocsp", "example.com-1234"), garbage))
+	assert.NoError(t, rd.Store(context.TODO(), path.Join("acme", "example.com", "users", "me", "me.key"), garbage))
+}
@@ -0,0 +1,77 @@
+package storageredis
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// formatVersion is one version of the encoding of ValueFormatVersioned
+type formatVersion struct {
+	encode func(data *StorageData) ([]byte, error)
+	decode func(bytes []byte) (*StorageData, error)
+}
+
+// formatVersions are all the versions of ValueFormatVersioned ever written, by
+// version byte. Stored values must stay readable, so never change or remove a
+// version; add a new one, with a golden sample in versions_test.go.
+var formatVersions = map[byte]formatVersion{
+	// the JSON encoded StorageData
+	1: {encode: jsonSerializer{}.Serialize, decode: jsonSerializer{}.Deserialize},
+	// the modified time, as big endian seconds since the Unix epoch on 8 bytes and
+	// nanoseconds on 4 bytes, followed by the value as is, saving the base64 of JSON
+	2: {encode: encodeBinary, decode: decodeBinary},
+}
+
+// latestFormatVersion is the version ValueFormatVersioned writes
+const latestFormatVersion byte = 2
+
+// binaryHeaderSize is the size of the modified time in version 2
+const binaryHeaderSize = 12
+
+func encodeBinary(data *StorageData) ([]byte, error) {
+	bytes := make([]byte, binaryHeaderSize, binaryHeaderSize+len(data.Value))
+	binary.BigEndian.PutUint64(bytes, uint64(data.Modified.Unix()))
+	binary.BigEndian.PutUint32(bytes[8:], uint32(data.Modified.Nanosecond()))
+	return append(bytes, data.Value...), nil
+}
+
+func decodeBinary(bytes []byte) (*StorageData, error) {
+	if len(bytes) < binaryHeaderSize {
+		return nil, fmt.Errorf("invalid data format")
+	}
+	seconds := int64(binary.BigEndian.Uint64(bytes))
+	nanoseconds := int64(binary.BigEndian.Uint32(bytes[8:]))
+	return &StorageData{
+		Value:    append([]byte{}, bytes[binaryHeaderSize:]...),
+		Modified: time.Unix(seconds, nanoseconds).UTC(),
+	}, nil
+}
+
+// versionedSerializer implements ValueFormatVersioned, writing version
+type versionedSerializer struct {
+	version byte
+}
+
+func (s versionedSerializer) Serialize(data *StorageData) ([]byte, error) {
+	version, ok := formatVersions[s.version]
+	if !ok {
+		return nil, fmt.Errorf("unknown format version %d", s.version)
+	}
+	encoded, err := version.encode(data)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{s.version}, encoded...), nil
+}
+
+func (versionedSerializer) Deserialize(bytes []byte) (*StorageData, error) {
+	if len(bytes) == 0 {
+		return nil, fmt.Errorf("invalid data format")
+	}
+	version, ok := formatVersions[bytes[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown format version %d", bytes[0])
+	}
+	return version.decode(bytes[1:])
+}
@@ -0,0 +1,78 @@
+package storageredis
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// goldenSamples are values written by every version of ValueFormatVersioned, holding
+// "crt data" modified at goldenModified. They must keep decoding as long as the
+// version exists, so never change them.
+var goldenSamples = map[byte]string{
+	1: hex.EncodeToString([]byte("\x01" + `{"value":"Y3J0IGRhdGE=","modified":"2022-11-28T10:00:00.0000005Z"}`)),
+	2: "0200000000638486a0000001f46372742064617461",
+}
+
+var goldenModified = time.Date(2022, 11, 28, 10, 0, 0, 500, time.UTC)
+
+func TestFormatVersions_GoldenSamples(t *testing.T) {
+	assert.Contains(t, formatVersions, latestFormatVersion)
+
+	for version := range formatVersions {
+		sample, ok := goldenSamples[version]
+		if !assert.True(t, ok, "format version %d has no golden sample", version) {
+			continue
+		}
+		golden, err := hex.DecodeString(sample)
+		assert.NoError(t, err)
+
+		// still decoded by the current code, whichever version it writes
+		data, err := versionedSerializer{version: latestFormatVersion}.Deserialize(golden)
+		assert.NoError(t, err, "format version %d", version)
+		assert.Equal(t, []byte("crt data"), data.Value, "format version %d", version)
+		assert.True(t, goldenModified.Equal(data.Modified), "format version %d: %v", version, data.Modified)
+
+		// and encoded the same way as when the sample was written
+		encoded, err := versionedSerializer{version: version}.Serialize(data)
+		assert.NoError(t, err)
+		assert.Equal(t, sample, hex.EncodeToString(encoded), "format version %d", version)
+	}
+}
+
+func TestFormatVersions_Unknown(t *testing.T) {
+	_, err := versionedSerializer{version: latestFormatVersion}.Deserialize([]byte{0xff, 0x00})
+	assert.Error(t, err)
+	_, err = versionedSerializer{version: latestFormatVersion}.Deserialize(nil)
+	assert.Error(t, err)
+}
+
+func TestRedisStorage_ValueFormatVersioned(t *testing.T) {
+	rd := new(RedisStorage)
+	rd.ValueFormat = ValueFormatVersioned
+	rd.GetConfigValue()
+	rd.AesKey = "redistls-01234567890-caddytls-32"
+
+	// values are written with the latest version
+	encoded, err := rd.EncryptStorageData(&StorageData{Value: []byte("crt data"), Modified: goldenModified})
+	assert.NoError(t, err)
+	decrypted, err := rd.decrypt(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, latestFormatVersion, decrypted[0])
+
+	data, err := rd.DecryptStorageData(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), data.Value)
+	assert.True(t, goldenModified.Equal(data.Modified))
+
+	// and values written with an older version are still read
+	old, err := versionedSerializer{version: 1}.Serialize(&StorageData{Value: []byte("old crt data"), Modified: goldenModified})
+	assert.NoError(t, err)
+	encoded, err = rd.encrypt(old)
+	assert.NoError(t, err)
+	data, err = rd.DecryptStorageData(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("old crt data"), data.Value)
+}
@@ -0,0 +1,57 @@
+package storageredis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Warmup opens n connections to every Redis node and checks each with a PING, so
+// they are idle in the pool when the first requests arrive instead of being
+// opened on demand. n is capped at the pool size. Connections that stay idle are
+// closed by go-redis after its idle timeout, like any other.
+func (rd *RedisStorage) Warmup(ctx context.Context, n int) error {
+	ctx = orBackground(ctx)
+	opCtx, cancel := rd.withDeadlineMargin(ctx)
+	defer cancel()
+	return classifyTimeout(ctx, opCtx, rd.warmup(opCtx, n))
+}
+
+func (rd *RedisStorage) warmup(ctx context.Context, n int) error {
+	nodes, err := rd.nodes(ctx)
+	if err != nil {
+		return err
+	}
+	for _, client := range nodes {
+		if err := warmupClient(ctx, client, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmupClient opens n connections of client, holding them all until every one
+// answered, so the pool can't hand out the same connection twice
+func warmupClient(ctx context.Context, client *redis.Client, n int) error {
+	if poolSize := client.Options().PoolSize; n > poolSize {
+		n = poolSize
+	}
+
+	conns := make([]*redis.Conn, 0, n)
+	defer func() {
+		// back to the pool
+		for _, cn := range conns {
+			cn.Close()
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		cn := client.Conn(ctx)
+		conns = append(conns, cn)
+		if err := cn.Ping(ctx).Err(); err != nil {
+			return fmt.Errorf("unable to warm up connections to %s: %v", client.Options().Addr, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package storageredis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStorage_Warmup(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := setupRedisEnvWithServer(t, mr)
+
+	assert.NoError(t, rd.Warmup(context.TODO(), 5))
+	stats := rd.Client.PoolStats()
+	assert.GreaterOrEqual(t, stats.TotalConns, uint32(5))
+	assert.GreaterOrEqual(t, stats.IdleConns, uint32(5))
+}
+
+func TestRedisStorage_WarmupConnections(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rd := new(RedisStorage)
+	rd.WarmupConnections = 4
+	rd = setupRedisEnvWithStorage(t, mr, rd)
+
+	assert.GreaterOrEqual(t, rd.Client.PoolStats().IdleConns, uint32(4))
+}